@@ -24,8 +24,11 @@ import (
 
 	"coriolis-logger/apiserver/controllers"
 	"coriolis-logger/apiserver/routers"
+	"coriolis-logger/archive"
 	"coriolis-logger/config"
 	"coriolis-logger/datastore/common"
+	"coriolis-logger/pipeline"
+	"coriolis-logger/retention"
 	wsWriter "coriolis-logger/writers/websocket"
 
 	"github.com/pkg/errors"
@@ -62,8 +65,9 @@ func (h *APIServer) Stop() error {
 	return nil
 }
 
-func GetAPIServer(cfg config.APIServer, hub *wsWriter.Hub, datastore common.DataStore) (*APIServer, error) {
-	logHandler := controllers.NewLogHandler(hub, datastore, cfg)
+func GetAPIServer(svcCfg *config.Config, hub *wsWriter.Hub, datastore common.DataStore, retentionMgr *retention.Manager, archiver *archive.Archiver, pipe *pipeline.Pipeline) (*APIServer, error) {
+	cfg := svcCfg.APIServer
+	logHandler := controllers.NewLogHandler(hub, datastore, retentionMgr, archiver, pipe, svcCfg)
 	router, err := routers.GetRouter(cfg, logHandler)
 	if err != nil {
 		return nil, errors.Wrap(err, "getting router")
@@ -0,0 +1,452 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package controllers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	bundleFormatTarGz = "tar.gz"
+	bundleFormatZip   = "zip"
+)
+
+// bundleFile describes a log file included in a support bundle
+type bundleFile struct {
+	Name     string `json:"name"`
+	AppName  string `json:"app_name"`
+	Hostname string `json:"hostname"`
+	Lines    int64  `json:"lines"`
+	Bytes    int64  `json:"bytes"`
+	// Changed is set if the log changed while the bundle was built.
+	// tar entries are then truncated or padded with newlines to the
+	// size measured first.
+	Changed bool `json:"changed,omitempty"`
+}
+
+type bundleFilters struct {
+	StartDate *time.Time `json:"start_date,omitempty"`
+	EndDate   time.Time  `json:"end_date"`
+	Apps      []string   `json:"apps"`
+	Severity  string     `json:"severity,omitempty"`
+	Format    string     `json:"line_format,omitempty"`
+	// Fields holds the structured message field filters, by key.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// bundleManifest describes the contents of a support bundle
+type bundleManifest struct {
+	CreatedAt time.Time     `json:"created_at"`
+	Filters   bundleFilters `json:"filters"`
+	Files     []bundleFile  `json:"files"`
+}
+
+// bundleArchive abstracts the tar and zip writers.
+type bundleArchive interface {
+	// WriteEntry adds an entry to the archive, holding the data
+	// written by write. size is the expected size of the entry, which
+	// tar needs upfront. It returns the size of the entry.
+	WriteEntry(name string, size int64, write func(w io.Writer) error) (int64, error)
+	Close() error
+}
+
+// countingWriter counts the bytes and lines written to w, and the
+// bytes it was handed, which differ if w drops data.
+type countingWriter struct {
+	w        io.Writer
+	n        int64
+	lines    int64
+	received int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.lines += int64(bytes.Count(p[:n], []byte("\n")))
+	c.received += int64(len(p))
+	return n, err
+}
+
+type zipBundle struct {
+	zw *zip.Writer
+}
+
+func (z *zipBundle) WriteEntry(name string, size int64, write func(w io.Writer) error) (int64, error) {
+	// zip entries are streamed, so the size is not needed.
+	entry, err := z.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "creating zip entry")
+	}
+	counter := &countingWriter{w: entry}
+	if err := write(counter); err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+func (z *zipBundle) Close() error {
+	return z.zw.Close()
+}
+
+type tarBundle struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+// paddedWriter writes exactly size bytes to w. Extra data is dropped,
+// and missing data is padded with newlines.
+type paddedWriter struct {
+	w    io.Writer
+	size int64
+}
+
+// Write returns the number of bytes kept. Dropping data is not an
+// error.
+func (p *paddedWriter) Write(data []byte) (int, error) {
+	if int64(len(data)) > p.size {
+		data = data[:p.size]
+	}
+	n, err := p.w.Write(data)
+	p.size -= int64(n)
+	return n, err
+}
+
+func (p *paddedWriter) pad() error {
+	if p.size <= 0 {
+		return nil
+	}
+	_, err := p.w.Write(bytes.Repeat([]byte("\n"), int(p.size)))
+	return err
+}
+
+func (t *tarBundle) WriteEntry(name string, size int64, write func(w io.Writer) error) (int64, error) {
+	err := t.tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "writing tar header")
+	}
+	// The entry must hold exactly the size in the header, to keep the
+	// archive valid, even if the data changed since it was measured.
+	padded := &paddedWriter{w: t.tw, size: size}
+	if err := write(padded); err != nil {
+		return 0, err
+	}
+	if err := padded.pad(); err != nil {
+		return 0, errors.Wrap(err, "writing tar entry")
+	}
+	return size, nil
+}
+
+func (t *tarBundle) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+// bundleName sanitizes a path component of a bundle entry
+func bundleName(val string) string {
+	val = strings.NewReplacer("/", "_", "\\", "_").Replace(val)
+	if val == "" || val == "." || val == ".." {
+		return "unknown"
+	}
+	return val
+}
+
+// buildSummary returns details about the running binary
+func buildSummary() map[string]string {
+	ret := map[string]string{
+		"go_version": runtime.Version(),
+	}
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ret
+	}
+	ret["path"] = info.Main.Path
+	ret["version"] = info.Main.Version
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision", "vcs.time", "vcs.modified":
+			ret[setting.Key] = setting.Value
+		}
+	}
+	return ret
+}
+
+// copyReader writes all data returned by reader to w.
+func copyReader(reader common.Reader, w io.Writer) error {
+	for {
+		data, err := reader.ReadNext()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, "reading log")
+		}
+		if _, err := w.Write(data); err != nil {
+			return errors.Wrap(err, "writing log")
+		}
+	}
+}
+
+// measureLogs returns the size of the rendered messages matching p,
+// for each hostname. The rendered messages are discarded, so logs of
+// any size can be measured without buffering them.
+func (l *LogHandlers) measureLogs(p params.QueryParams, format *logging.LineFormat) (map[string]int64, error) {
+	sizes := map[string]int64{}
+	iterator, err := l.store.Query(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying logs")
+	}
+	defer iterator.Close()
+
+	buf := bytes.NewBuffer(nil)
+	for iterator.Next() {
+		msg := iterator.Message()
+		buf.Reset()
+		common.AppendText(buf, msg, format)
+		sizes[msg.Hostname] += int64(buf.Len())
+	}
+	if err := iterator.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading logs")
+	}
+	return sizes, nil
+}
+
+// writeLogEntries adds the messages of a single app to the bundle, one
+// entry per host, and returns the resulting file descriptions. The
+// log is measured first, then each entry is streamed from its own
+// query.
+func (l *LogHandlers) writeLogEntries(bundle bundleArchive, p params.QueryParams, format *logging.LineFormat) ([]bundleFile, error) {
+	sizes, err := l.measureLogs(p, format)
+	if err != nil {
+		return nil, errors.Wrapf(err, "measuring %q", p.AppName)
+	}
+	hostnames := make([]string, 0, len(sizes))
+	for hostname, size := range sizes {
+		if size > 0 {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	sort.Strings(hostnames)
+
+	files := []bundleFile{}
+	for _, hostname := range hostnames {
+		file := bundleFile{
+			Name:     path.Join("logs", bundleName(p.AppName), bundleName(hostname)+".log"),
+			AppName:  p.AppName,
+			Hostname: hostname,
+		}
+		hostParams := p
+		hostFilter := params.Eq(params.FieldHostname, hostname)
+		if p.Filter != nil {
+			hostParams.Filter = params.And{p.Filter, hostFilter}
+		} else {
+			hostParams.Filter = hostFilter
+		}
+
+		var counter *countingWriter
+		size, err := bundle.WriteEntry(file.Name, sizes[hostname], func(w io.Writer) error {
+			iterator, err := l.store.Query(hostParams)
+			if err != nil {
+				return errors.Wrap(err, "querying logs")
+			}
+			defer iterator.Close()
+			counter = &countingWriter{w: w}
+			return copyReader(common.NewFormattedTextReader(iterator, format), counter)
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "adding %s", file.Name)
+		}
+		file.Lines = counter.lines
+		file.Bytes = size
+		if counter.received != sizes[hostname] {
+			file.Changed = true
+			log.Warningf("%s changed while building the bundle, measured %d bytes, read %d", file.Name, sizes[hostname], counter.received)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func writeJSONEntry(bundle bundleArchive, name string, val interface{}) error {
+	data, err := json.MarshalIndent(val, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "encoding %s", name)
+	}
+	_, err = bundle.WriteEntry(name, int64(len(data)), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	return err
+}
+
+// BundleHandler streams a support bundle holding the logs of the
+// requested apps, one file per app and host, along with a manifest
+// and a summary of the logger build and config.
+func (l *LogHandlers) BundleHandler(writer http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if !canAccess(ctx) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("you need admin level access to view logs"))
+		return
+	}
+	format := req.URL.Query().Get("format")
+	switch format {
+	case "":
+		format = bundleFormatTarGz
+	case bundleFormatTarGz, bundleFormatZip:
+	default:
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid format: %q", format)
+		return
+	}
+
+	// The format arg selects the archive format, so the line format
+	// has its own arg.
+	lineFormat, err := l.lineFormat(req, "line_format", "")
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+
+	startDateStamp := req.URL.Query().Get("start_date")
+	startDate, err := timestampToTime(startDateStamp)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid start date: %q", startDateStamp)
+		return
+	}
+	endDateStamp := req.URL.Query().Get("end_date")
+	endDate, err := timestampToTime(endDateStamp)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid end date: %q", endDateStamp)
+		return
+	}
+	// Pin the end of the range, so that messages arriving while the
+	// bundle is being built do not change its contents.
+	now := time.Now()
+	if endDate.IsZero() || endDate.After(now) {
+		endDate = now
+	}
+
+	filter, err := queryFilter(req)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+	fields, _ := getFieldFilters(req)
+
+	patterns := getAppPatterns(req)
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+	apps, err := l.resolveApps(patterns)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+	manifest := bundleManifest{
+		CreatedAt: now.UTC(),
+		Filters: bundleFilters{
+			EndDate:  endDate.UTC(),
+			Apps:     patterns,
+			Severity: req.URL.Query().Get("severity"),
+			Format:   req.URL.Query().Get("line_format"),
+			Fields:   fields,
+		},
+		Files: []bundleFile{},
+	}
+	if !startDate.IsZero() {
+		start := startDate.UTC()
+		manifest.Filters.StartDate = &start
+	}
+
+	var bundle bundleArchive
+	filename := fmt.Sprintf("coriolis-logs-%s.%s", now.UTC().Format("20060102T150405Z"), format)
+	writer.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	switch format {
+	case bundleFormatZip:
+		writer.Header().Set("Content-Type", "application/zip")
+		bundle = &zipBundle{zw: zip.NewWriter(writer)}
+	default:
+		writer.Header().Set("Content-Type", "application/gzip")
+		gz := gzip.NewWriter(writer)
+		bundle = &tarBundle{gz: gz, tw: tar.NewWriter(gz)}
+	}
+
+	for _, app := range apps {
+		files, err := l.writeLogEntries(bundle, params.QueryParams{
+			StartDate: startDate,
+			EndDate:   endDate,
+			AppName:   app,
+			Filter:    filter,
+		}, lineFormat)
+		if err != nil {
+			// Headers are already sent. The best we can do is
+			// to abort, leaving the client with a truncated archive.
+			log.Errorf("error building bundle: %v", err)
+			return
+		}
+		manifest.Files = append(manifest.Files, files...)
+	}
+
+	summary := map[string]interface{}{
+		"build":  buildSummary(),
+		"config": l.redactedConfig,
+	}
+	if err := writeJSONEntry(bundle, "logger.json", summary); err != nil {
+		log.Errorf("error building bundle: %v", err)
+		return
+	}
+	if err := writeJSONEntry(bundle, "manifest.json", manifest); err != nil {
+		log.Errorf("error building bundle: %v", err)
+		return
+	}
+	if err := bundle.Close(); err != nil {
+		log.Errorf("error finalizing bundle: %v", err)
+	}
+}
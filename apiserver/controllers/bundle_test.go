@@ -0,0 +1,185 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package controllers
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+func bundleStore() *memStore {
+	base := time.Now().Add(-time.Hour)
+	store := &memStore{}
+	for i := 0; i < 5; i++ {
+		store.add(
+			logging.LogMessage{AppName: "app", Hostname: "host-a", Severity: logging.Informational, Message: "a", Timestamp: base.Add(time.Duration(i) * time.Second)},
+			logging.LogMessage{AppName: "app", Hostname: "host-b", Severity: logging.Informational, Message: "b", Timestamp: base.Add(time.Duration(i) * time.Second)},
+		)
+	}
+	store.add(logging.LogMessage{AppName: "other", Hostname: "host-a", Severity: logging.Informational, Message: "other", Timestamp: base})
+	return store
+}
+
+func readBundle(t *testing.T, format string, body []byte) map[string]string {
+	t.Helper()
+	entries := map[string]string{}
+	switch format {
+	case bundleFormatZip:
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatalf("reading zip: %v", err)
+		}
+		for _, file := range zr.File {
+			r, err := file.Open()
+			if err != nil {
+				t.Fatalf("opening %s: %v", file.Name, err)
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("reading %s: %v", file.Name, err)
+			}
+			entries[file.Name] = string(data)
+		}
+	default:
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("reading gzip: %v", err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("reading tar: %v", err)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("reading %s: %v", header.Name, err)
+			}
+			entries[header.Name] = string(data)
+		}
+	}
+	return entries
+}
+
+func TestBundleHandler(t *testing.T) {
+	for _, format := range []string{bundleFormatTarGz, bundleFormatZip} {
+		t.Run(format, func(t *testing.T) {
+			store := bundleStore()
+			han := &LogHandlers{store: store, redactedConfig: &config.Config{}}
+			req := adminRequest(httptest.NewRequest(http.MethodGet, "/api/v1/bundle?apps=app&format="+format, nil))
+			rec := httptest.NewRecorder()
+			han.BundleHandler(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+			}
+
+			entries := readBundle(t, format, rec.Body.Bytes())
+			want := map[string]string{
+				"logs/app/host-a.log": "a\na\na\na\na\n",
+				"logs/app/host-b.log": "b\nb\nb\nb\nb\n",
+			}
+			for name, content := range want {
+				if entries[name] != content {
+					t.Errorf("entry %s = %q, want %q", name, entries[name], content)
+				}
+			}
+			if _, ok := entries["logs/other/host-a.log"]; ok {
+				t.Errorf("bundle includes a log that was not requested")
+			}
+			// The app is measured once, then each host is streamed.
+			if store.queries != 3 {
+				t.Errorf("got %d queries, want 3", store.queries)
+			}
+
+			var manifest bundleManifest
+			if err := json.Unmarshal([]byte(entries["manifest.json"]), &manifest); err != nil {
+				t.Fatalf("decoding manifest: %v", err)
+			}
+			if len(manifest.Files) != 2 {
+				t.Fatalf("manifest lists %d files, want 2", len(manifest.Files))
+			}
+			for _, file := range manifest.Files {
+				if file.Lines != 5 || file.Bytes != 10 {
+					t.Errorf("manifest entry %s has %d lines and %d bytes, want 5 and 10", file.Name, file.Lines, file.Bytes)
+				}
+			}
+		})
+	}
+}
+
+func TestBundleLogChanged(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+		lines  int64
+		bytes  int64
+	}{
+		// tar entries keep the size measured first.
+		{bundleFormatTarGz, "a\na\na\na\na\n", 5, 10},
+		{bundleFormatZip, "a\na\na\na\na\nlate\n", 6, 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			store := bundleStore()
+			// A late message arrives once the log was measured.
+			store.onQuery = func(queries int) {
+				if queries == 1 {
+					store.add(logging.LogMessage{
+						AppName:   "app",
+						Hostname:  "host-a",
+						Message:   "late",
+						Timestamp: time.Now().Add(-time.Minute),
+					})
+				}
+			}
+			han := &LogHandlers{store: store, redactedConfig: &config.Config{}}
+			req := adminRequest(httptest.NewRequest(http.MethodGet, "/api/v1/bundle?apps=app&format="+tt.format, nil))
+			rec := httptest.NewRecorder()
+			han.BundleHandler(rec, req)
+
+			entries := readBundle(t, tt.format, rec.Body.Bytes())
+			if got := entries["logs/app/host-a.log"]; got != tt.want {
+				t.Errorf("got entry %q, want %q", got, tt.want)
+			}
+			var manifest bundleManifest
+			if err := json.Unmarshal([]byte(entries["manifest.json"]), &manifest); err != nil {
+				t.Fatalf("decoding manifest: %v", err)
+			}
+			for _, file := range manifest.Files {
+				changed := file.Hostname == "host-a"
+				if file.Changed != changed {
+					t.Errorf("manifest entry %s changed = %v, want %v", file.Name, file.Changed, changed)
+				}
+				if changed && (file.Lines != tt.lines || file.Bytes != tt.bytes) {
+					t.Errorf("manifest entry %s has %d lines and %d bytes, want %d and %d", file.Name, file.Lines, file.Bytes, tt.lines, tt.bytes)
+				}
+			}
+		})
+	}
+}
@@ -18,18 +18,21 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
-	"os"
+	"path"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"coriolis-logger/apiserver/auth"
+	"coriolis-logger/archive"
 	"coriolis-logger/config"
 	"coriolis-logger/datastore/common"
 	"coriolis-logger/logging"
 	"coriolis-logger/params"
+	"coriolis-logger/pipeline"
+	"coriolis-logger/retention"
 	wsWriter "coriolis-logger/writers/websocket"
 
 	"github.com/gorilla/mux"
@@ -50,14 +53,20 @@ func canAccess(ctx context.Context) bool {
 	return authDetails.IsAdmin
 }
 
-func NewLogHandler(hub *wsWriter.Hub, datastore common.DataStore, cfg config.APIServer) *LogHandlers {
+func NewLogHandler(hub *wsWriter.Hub, datastore common.DataStore, retentionMgr *retention.Manager, archiver *archive.Archiver, pipe *pipeline.Pipeline, cfg *config.Config) *LogHandlers {
 	han := &LogHandlers{
-		hub:   hub,
-		store: datastore,
-		cfg:   cfg,
+		hub:             hub,
+		pipeline:        pipe,
+		store:           datastore,
+		retention:       retentionMgr,
+		archiver:        archiver,
+		cfg:             cfg.APIServer,
+		correlationTags: cfg.Syslog.Correlation.GetTags(),
+		redactedConfig:  cfg.Redacted(),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 16384,
+			Subprotocols:    []string{wsWriter.ProtocolV1},
 		},
 	}
 
@@ -67,10 +76,17 @@ func NewLogHandler(hub *wsWriter.Hub, datastore common.DataStore, cfg config.API
 }
 
 type LogHandlers struct {
-	hub      *wsWriter.Hub
-	store    common.DataStore
-	cfg      config.APIServer
-	upgrader websocket.Upgrader
+	hub       *wsWriter.Hub
+	store     common.DataStore
+	retention *retention.Manager
+	archiver  *archive.Archiver
+	pipeline  *pipeline.Pipeline
+	cfg       config.APIServer
+	// correlationTags are the tags correlation IDs are stored in
+	correlationTags []string
+	upgrader        websocket.Upgrader
+	// redactedConfig is the service config, without credentials
+	redactedConfig *config.Config
 }
 
 func getSeverity(severity string) (logging.Severity, error) {
@@ -90,6 +106,99 @@ func getSeverity(severity string) (logging.Severity, error) {
 	return ret, nil
 }
 
+// severityFilter returns a filter matching the severity level in
+// the request query args, or nil if no valid severity was requested.
+func severityFilter(req *http.Request) params.Expression {
+	severityStr := req.URL.Query().Get("severity")
+	if severityStr == "" {
+		return nil
+	}
+	severity, err := getSeverity(severityStr)
+	if err != nil {
+		log.Warningf("invalid severity %q. Ignoring", severityStr)
+		return nil
+	}
+	return params.Condition{
+		Field:    params.FieldSeverity,
+		Operator: params.OpLessOrEqual,
+		Value:    severity,
+	}
+}
+
+// getFieldFilters returns the values of structured message fields in
+// the "field" query args, by key. Each arg holds a key and a value,
+// separated by a colon, as in "field=task_id:1234".
+func getFieldFilters(req *http.Request) (map[string]string, error) {
+	args := req.URL.Query()["field"]
+	if len(args) == 0 {
+		return nil, nil
+	}
+	fields := map[string]string{}
+	for _, arg := range args {
+		idx := strings.Index(arg, ":")
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid field filter %q", arg)
+		}
+		fields[arg[:idx]] = arg[idx+1:]
+	}
+	return fields, nil
+}
+
+// queryFilter returns the filter for the severity level and the
+// structured message fields in the request query args, or nil if
+// none were requested.
+func queryFilter(req *http.Request) (params.Expression, error) {
+	fields, err := getFieldFilters(req)
+	if err != nil {
+		return nil, err
+	}
+	filter := params.And{}
+	if severity := severityFilter(req); severity != nil {
+		filter = append(filter, severity)
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		filter = append(filter, params.Eq(params.FieldOf(key), fields[key]))
+	}
+	switch len(filter) {
+	case 0:
+		return nil, nil
+	case 1:
+		return filter[0], nil
+	}
+	return filter, nil
+}
+
+// lineFormat returns the line format named by the supplied query arg.
+// The value may be the name of a built-in or configured format, or an
+// inline template. If the arg is missing, defaultFormat is used. An
+// empty defaultFormat returns a nil format, which renders the message
+// as sent by the app.
+func (l *LogHandlers) lineFormat(req *http.Request, arg, defaultFormat string) (*logging.LineFormat, error) {
+	name := req.URL.Query().Get(arg)
+	if name == "" {
+		name = defaultFormat
+	}
+	if name == "" {
+		return nil, nil
+	}
+	tmpl, ok := logging.BuiltinFormats[name]
+	if !ok {
+		tmpl, ok = l.cfg.LineFormats[name]
+	}
+	if !ok {
+		if !strings.Contains(name, "{") {
+			return nil, fmt.Errorf("unknown format %q", name)
+		}
+		tmpl = name
+	}
+	return logging.ParseLineFormat(tmpl)
+}
+
 func (l *LogHandlers) getCORSChecker() func(r *http.Request) bool {
 	if l.cfg.CORSOrigins == nil || len(l.cfg.CORSOrigins) == 0 {
 		return nil
@@ -109,6 +218,60 @@ func (l *LogHandlers) getCORSChecker() func(r *http.Request) bool {
 	}
 }
 
+// splitList returns the values of a query arg. Both repeated args
+// and comma separated lists are accepted.
+func splitList(req *http.Request, arg string) []string {
+	ret := []string{}
+	for _, val := range req.URL.Query()[arg] {
+		for _, item := range strings.Split(val, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				ret = append(ret, item)
+			}
+		}
+	}
+	return ret
+}
+
+// getClientFilterOptions returns the initial websocket filters in the
+// request query args.
+func getClientFilterOptions(req *http.Request) (wsWriter.ClientFilterOptions, error) {
+	query := req.URL.Query()
+	severityStr := query.Get("severity")
+	severity, err := getSeverity(severityStr)
+	if err != nil {
+		log.Warningf("invalid severity %q. Ignoring", severityStr)
+		severity = logging.DefaultSeverityLevel
+	}
+	binName := query.Get("app_name")
+	opts := wsWriter.ClientFilterOptions{
+		Severity:  &severity,
+		AppName:   &binName,
+		AppNames:  getAppPatterns(req),
+		Hostnames: splitList(req, "hostnames"),
+		Include:   query.Get("include"),
+		Exclude:   query.Get("exclude"),
+	}
+	if minSeverityStr := query.Get("min_severity"); minSeverityStr != "" {
+		minSeverity, err := strconv.Atoi(minSeverityStr)
+		if err != nil {
+			return opts, fmt.Errorf("invalid min_severity %q", minSeverityStr)
+		}
+		val := logging.Severity(minSeverity)
+		opts.MinSeverity = &val
+	}
+	for _, facilityStr := range splitList(req, "facilities") {
+		facility, err := strconv.Atoi(facilityStr)
+		if err != nil {
+			return opts, fmt.Errorf("invalid facility %q", facilityStr)
+		}
+		opts.Facilities = append(opts.Facilities, facility)
+	}
+	if opts.Fields, err = getFieldFilters(req); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
 func (l *LogHandlers) WSHandler(writer http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
 	if !canAccess(ctx) {
@@ -116,29 +279,35 @@ func (l *LogHandlers) WSHandler(writer http.ResponseWriter, req *http.Request) {
 		writer.Write([]byte("you need admin level access to view logs"))
 		return
 	}
-	severityStr := req.URL.Query().Get("severity")
-	severity, err := getSeverity(severityStr)
+	opts, err := getClientFilterOptions(req)
 	if err != nil {
-		log.Warningf("invalid severity %q. Ignoring", severityStr)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+	filter, err := wsWriter.NewFilter(opts)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
 	}
-	binName := req.URL.Query().Get("app_name")
 
 	conn, err := l.upgrader.Upgrade(writer, req, nil)
 	if err != nil {
 		log.Errorf("error upgrading to websockets: %v", err)
 		return
 	}
-
-	opts := wsWriter.ClientFilterOptions{
-		Severity: &severity,
-		AppName:  &binName,
+	if conn.Subprotocol() == wsWriter.ProtocolV1 {
+		// Versioned clients manage their own subscriptions.
+		filter = nil
 	}
+
 	// TODO (gsamfira): Handle ExpiresAt. Right now, if a client uses
 	// a valid token to authenticate, and keeps the websocket connection
 	// open, it will allow that client to stream logs via websockets
 	// until the connection is broken. We need to forcefully disconnect
 	// the client once the token expires.
-	client, err := wsWriter.NewClient(conn, opts, l.hub)
+	client, err := wsWriter.NewClient(conn, filter, l.hub)
 	if err != nil {
 		log.Errorf("failed to create new client: %v", err)
 		return
@@ -162,166 +331,557 @@ func timestampToTime(stamp string) (time.Time, error) {
 	return tm, nil
 }
 
-// downloadAsFile prepares a log for download by creating a temporary file
-// to which it dumps the log, then serves it as a plain file to the client.
-// This is done because some browsers like Safari have issues with
-// chunked downloads. This is a workaround that should be removed at a later
-// time.
-func (l *LogHandlers) downloadAsFile(reader common.Reader, writer http.ResponseWriter, logName string) {
-	tmpfile, err := ioutil.TempFile("", "coriolis-logger")
-	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		log.Errorf("error creating temp file: %v", err)
-		return
+const (
+	// maxPageSize is the maximum number of lines that may be
+	// requested in a single page.
+	maxPageSize = 50000
+
+	nextCursorHeader = "X-Next-Cursor"
+)
+
+// paging holds the pagination options of a download request
+type paging struct {
+	limit      int
+	tail       bool
+	descending bool
+	cursor     *params.Cursor
+}
+
+func (p paging) enabled() bool {
+	return p.limit > 0
+}
+
+func getPaging(req *http.Request) (paging, error) {
+	var ret paging
+	query := req.URL.Query()
+
+	if tail := query.Get("tail"); tail != "" {
+		lines, err := strconv.Atoi(tail)
+		if err != nil || lines < 1 || lines > maxPageSize {
+			return ret, fmt.Errorf("invalid tail: %q", tail)
+		}
+		if query.Get("limit") != "" || query.Get("order") != "" || query.Get("cursor") != "" {
+			return ret, fmt.Errorf("tail cannot be combined with limit, order or cursor")
+		}
+		// The last lines are the first ones when reading backwards.
+		ret.limit = lines
+		ret.tail = true
+		ret.descending = true
+		return ret, nil
 	}
 
-	defer func() {
-		tmpfile.Close()
-		os.Remove(tmpfile.Name())
-	}()
+	if limit := query.Get("limit"); limit != "" {
+		val, err := strconv.Atoi(limit)
+		if err != nil || val < 1 || val > maxPageSize {
+			return ret, fmt.Errorf("invalid limit: %q", limit)
+		}
+		ret.limit = val
+	}
 
-	for {
-		data, err := reader.ReadNext()
+	order := query.Get("order")
+	switch order {
+	case "", "asc":
+	case "desc":
+		ret.descending = true
+	default:
+		return ret, fmt.Errorf("invalid order: %q", order)
+	}
+
+	if cursorStr := query.Get("cursor"); cursorStr != "" {
+		cursor, err := params.DecodeCursor(cursorStr)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			writer.WriteHeader(http.StatusInternalServerError)
-			log.Errorf("error reading log: %v", err)
-			return
+			return ret, err
 		}
-		_, err = tmpfile.Write(data)
-		if err != nil {
-			writer.WriteHeader(http.StatusInternalServerError)
-			log.Errorf("error writing to temp file: %v", err)
-			return
+		if order == "" {
+			ret.descending = cursor.Descending
+		} else if cursor.Descending != ret.descending {
+			return ret, fmt.Errorf("cursor order does not match requested order")
 		}
+		ret.cursor = &cursor
 	}
+	return ret, nil
+}
 
-	logStat, err := tmpfile.Stat()
-	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		log.Errorf("error getting log info: %v", err)
+// readPage reads a page of messages and sets the cursor of the next
+// page in the response headers, if there may be more messages. It
+// returns the messages of the page, in the order lines should be
+// sent to the client.
+func (l *LogHandlers) readPage(iterator common.Iterator, writer http.ResponseWriter, pages paging) ([]logging.LogMessage, error) {
+	msgs := []logging.LogMessage{}
+	timestamps := []time.Time{}
+	for iterator.Next() {
+		msg := iterator.Message()
+		msgs = append(msgs, msg)
+		timestamps = append(timestamps, msg.Timestamp)
+	}
+	if err := iterator.Err(); err != nil {
+		return nil, err
+	}
+	if len(msgs) == pages.limit {
+		next := params.Advance(pages.cursor, timestamps, pages.descending)
+		writer.Header().Set(nextCursorHeader, next.Encode())
+	}
+	if pages.tail {
+		for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+			msgs[i], msgs[j] = msgs[j], msgs[i]
+		}
+	}
+	return msgs, nil
+}
+
+func (l *LogHandlers) DownloadLogHandler(writer http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if !canAccess(ctx) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("you need admin level access to view logs"))
 		return
 	}
 
-	if _, err := tmpfile.Seek(0, 0); err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		log.Errorf("error seeking log: %v", err)
+	vars := mux.Vars(req)
+	filter, err := queryFilter(req)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+	if vars["log"] == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "missing log name")
+		return
+	}
+	startDateStamp := req.URL.Query().Get("start_date")
+	startDate, err := timestampToTime(startDateStamp)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid start date: %q", startDateStamp)
 		return
 	}
 
-	size := strconv.FormatInt(logStat.Size(), 10)
-	writer.Header().Set("Content-Disposition", "attachment; filename="+logName+".log")
-	writer.Header().Set("Content-Type", "text/plain")
-	writer.Header().Set("Content-Length", size)
+	endDateStamp := req.URL.Query().Get("end_date")
+	endDate, err := timestampToTime(endDateStamp)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid end date: %q", endDateStamp)
+		return
+	}
 
-	if _, err := io.Copy(writer, tmpfile); err != nil {
-		log.Errorf("error sending file: %v", err)
+	pages, err := getPaging(req)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
 		return
 	}
-	return
-}
 
-func (l *LogHandlers) downloadAsChuks(reader common.Reader, writer http.ResponseWriter, logName string) {
-	data, err := reader.ReadNext()
+	format, err := l.lineFormat(req, "format", "")
 	if err != nil {
-		if err != io.EOF {
-			writer.WriteHeader(http.StatusInternalServerError)
-			log.Errorf("error fetching logs: %v", err)
-			return
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+
+	dl := newDownload(req, vars["log"], endDate)
+	queryParams := params.QueryParams{
+		StartDate:  startDate,
+		EndDate:    dl.endDate,
+		AppName:    vars["log"],
+		Filter:     filter,
+		Limit:      pages.limit,
+		Descending: pages.descending,
+		Cursor:     pages.cursor,
+	}
+
+	if !pages.enabled() {
+		dl.open = func(end time.Time) (common.Reader, func(), error) {
+			p := queryParams
+			p.EndDate = end
+			iterator, err := l.store.Query(p)
+			if err != nil {
+				return nil, nil, err
+			}
+			return common.NewFormattedTextReader(iterator, format), func() { iterator.Close() }, nil
 		}
+		l.serveDownload(writer, req, dl)
+		return
 	}
-	writer.Header().Set("Content-Disposition", "attachment; filename="+logName+".log")
-	writer.Header().Set("Content-Type", "text/plain")
 
-	_, err = writer.Write(data)
+	// Pages are bounded, so we can read them in full to find the
+	// cursor for the next page before sending any data.
+	iterator, err := l.store.Query(queryParams)
 	if err != nil {
-		log.Errorf("sending logs: %v", err)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid query: %v", err)
+		return
+	}
+	msgs, err := l.readPage(iterator, writer, pages)
+	iterator.Close()
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("error reading log: %v", err)
 		return
 	}
+	dl.open = func(time.Time) (common.Reader, func(), error) {
+		return common.NewFormattedTextReader(common.NewSliceIterator(msgs), format), func() {}, nil
+	}
+	l.serveDownload(writer, req, dl)
+}
 
-	for {
-		data, err := reader.ReadNext()
-		if err != nil {
-			if err == io.EOF {
+// getAppPatterns returns the app names or globs in the "apps" query
+// arg. Both repeated args and comma separated lists are accepted.
+func getAppPatterns(req *http.Request) []string {
+	return splitList(req, "apps")
+}
+
+// resolveApps returns the names of all logs matching any of the
+// supplied app names or globs.
+func (l *LogHandlers) resolveApps(patterns []string) ([]string, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid app pattern %q", pattern)
+		}
+	}
+	logs, err := l.store.List(params.ListParams{NamesOnly: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing logs")
+	}
+	ret := []string{}
+	for _, info := range logs {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, info.Name); matched {
+				ret = append(ret, info.Name)
 				break
 			}
-			log.Errorf("error fetching logs: %v", err)
-			return
-		}
-		_, err = writer.Write(data)
-		if err != nil {
-			log.Errorf("sending logs: %v", err)
-			return
 		}
 	}
-	return
+	return ret, nil
 }
 
-func (l *LogHandlers) DownloadLogHandler(writer http.ResponseWriter, req *http.Request) {
+// MergedLogsHandler streams the messages of several logs as a single
+// time ordered download. Each line is prefixed with the app name and
+// hostname of the message.
+func (l *LogHandlers) MergedLogsHandler(writer http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
 	if !canAccess(ctx) {
 		writer.WriteHeader(http.StatusForbidden)
 		writer.Write([]byte("you need admin level access to view logs"))
 		return
 	}
-	disableChunked := req.URL.Query().Get("disable_chunked")
-	disableChunkedAsBool, _ := strconv.ParseBool(disableChunked)
 
-	vars := mux.Vars(req)
-	severityStr := req.URL.Query().Get("severity")
-	severity, err := getSeverity(severityStr)
+	patterns := getAppPatterns(req)
+	if len(patterns) == 0 {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "missing apps")
+		return
+	}
+	// Cursors mark a position in a single log, so merged downloads
+	// cannot be paged.
+	for _, key := range []string{"limit", "order", "cursor", "tail"} {
+		if req.URL.Query().Get(key) != "" {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "%s is not supported by merged downloads", key)
+			return
+		}
+	}
+	startDateStamp := req.URL.Query().Get("start_date")
+	startDate, err := timestampToTime(startDateStamp)
 	if err != nil {
-		log.Warningf("invalid severity %q. Ignoring", severityStr)
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid start date: %q", startDateStamp)
+		return
 	}
-	if vars["log"] == "" {
+	endDateStamp := req.URL.Query().Get("end_date")
+	endDate, err := timestampToTime(endDateStamp)
+	if err != nil {
 		writer.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(writer, fmt.Sprintf("missing log name"))
+		fmt.Fprintf(writer, "invalid end date: %q", endDateStamp)
+		return
+	}
+
+	apps, err := l.resolveApps(patterns)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+	if len(apps) == 0 {
+		writer.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(writer, "no logs match the requested apps")
+		return
+	}
+
+	format, err := l.lineFormat(req, "format", logging.FormatPrefixed)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+
+	filter, err := queryFilter(req)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+	dl := newDownload(req, "merged", endDate)
+	dl.open = l.openMerged(apps, startDate, filter, format)
+	l.serveDownload(writer, req, dl)
+}
+
+// openMerged returns a download opener that merges the messages of
+// apps matching filter, in time order.
+func (l *LogHandlers) openMerged(apps []string, startDate time.Time, filter params.Expression, format *logging.LineFormat) func(time.Time) (common.Reader, func(), error) {
+	return func(end time.Time) (common.Reader, func(), error) {
+		iterators := []common.Iterator{}
+		for _, app := range apps {
+			iterator, err := l.store.Query(params.QueryParams{
+				StartDate: startDate,
+				EndDate:   end,
+				AppName:   app,
+				Filter:    filter,
+			})
+			if err != nil {
+				for _, it := range iterators {
+					it.Close()
+				}
+				return nil, nil, err
+			}
+			iterators = append(iterators, iterator)
+		}
+		iterator := common.NewMergeIterator(iterators)
+		return common.NewFormattedTextReader(iterator, format), func() { iterator.Close() }, nil
 	}
+}
+
+const (
+	defaultStatsInterval = time.Minute
+	defaultStatsRange    = 24 * time.Hour
+)
+
+func (l *LogHandlers) LogStatsHandler(writer http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if !canAccess(ctx) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("you need admin level access to view logs"))
+		return
+	}
+	vars := mux.Vars(req)
 	startDateStamp := req.URL.Query().Get("start_date")
 	startDate, err := timestampToTime(startDateStamp)
 	if err != nil {
 		writer.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(writer, fmt.Sprintf("invalid start date: %q", startDateStamp))
+		fmt.Fprintf(writer, "invalid start date: %q", startDateStamp)
+		return
 	}
-
 	endDateStamp := req.URL.Query().Get("end_date")
 	endDate, err := timestampToTime(endDateStamp)
 	if err != nil {
 		writer.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(writer, fmt.Sprintf("invalid end date: %q", endDateStamp))
+		fmt.Fprintf(writer, "invalid end date: %q", endDateStamp)
+		return
+	}
+	if endDate.IsZero() {
+		endDate = time.Now()
+	}
+	if startDate.IsZero() {
+		startDate = endDate.Add(-defaultStatsRange)
 	}
 
+	interval := defaultStatsInterval
+	if intervalStr := req.URL.Query().Get("interval"); intervalStr != "" {
+		interval, err = time.ParseDuration(intervalStr)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "invalid interval: %q", intervalStr)
+			return
+		}
+	}
+
+	filter, err := queryFilter(req)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
 	queryParams := params.QueryParams{
 		StartDate: startDate,
 		EndDate:   endDate,
 		AppName:   vars["log"],
-		Severity:  int(severity),
+		Filter:    filter,
+	}
+	if err := queryParams.Validate(); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid query: %v", err)
+		return
+	}
+	if err := common.ValidateHistogramParams(queryParams, interval); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid query: %v", err)
+		return
 	}
 
-	reader := l.store.ResultReader(queryParams)
-	if disableChunkedAsBool {
-		l.downloadAsFile(reader, writer, vars["log"])
+	buckets, err := l.store.Histogram(queryParams, interval)
+	if errors.Is(err, common.ErrInvalidFilter) {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid query: %v", err)
+		return
+	}
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("error fetching log stats: %v", err)
 		return
 	}
-	l.downloadAsChuks(reader, writer, vars["log"])
-	return
+	ret := map[string]interface{}{
+		"log_name":   vars["log"],
+		"start_date": startDate.UTC(),
+		"end_date":   endDate.UTC(),
+		"interval":   interval.String(),
+		"buckets":    buckets,
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(ret); err != nil {
+		log.Errorf("error sending log stats: %v", err)
+	}
 }
 
 func (l *LogHandlers) ListLogsHandler(writer http.ResponseWriter, req *http.Request) {
-	logs, err := l.store.List()
+	ctx := req.Context()
+	if !canAccess(ctx) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("you need admin level access to list logs"))
+		return
+	}
+	sinceStamp := req.URL.Query().Get("since")
+	since, err := timestampToTime(sinceStamp)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid since date: %q", sinceStamp)
+		return
+	}
+	listParams := params.ListParams{
+		Since:  since,
+		SortBy: req.URL.Query().Get("sort"),
+	}
+	switch order := req.URL.Query().Get("order"); order {
+	case "", "asc":
+	case "desc":
+		listParams.Descending = true
+	default:
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid order: %q", order)
+		return
+	}
+	if err := common.ValidateListParams(listParams); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+
+	logs, err := l.store.List(listParams)
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		log.Errorf("error listing logs: %v", err)
+		return
 	}
-	ret := map[string][]map[string]string{
+	ret := map[string][]common.LogInfo{
 		"logs": logs,
 	}
 	js, err := json.Marshal(ret)
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		log.Errorf("error listing logs: %v", err)
+		return
 	}
 	fmt.Fprintf(writer, string(js))
 }
+
+func (l *LogHandlers) RetentionHandler(writer http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if !canAccess(ctx) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("you need admin level access to view retention policies"))
+		return
+	}
+	policies, err := l.retention.Policies()
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("error fetching retention policies: %v", err)
+		return
+	}
+	ret := map[string][]retention.Policy{
+		"policies": policies,
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(ret); err != nil {
+		log.Errorf("error sending retention policies: %v", err)
+	}
+}
+
+// PipelineHandler returns the counters of the ingestion pipeline
+func (l *LogHandlers) PipelineHandler(writer http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if !canAccess(ctx) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("you need admin level access to view pipeline stats"))
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(l.pipeline.Stats()); err != nil {
+		log.Errorf("error sending pipeline stats: %v", err)
+	}
+}
+
+func (l *LogHandlers) ListArchivesHandler(writer http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if !canAccess(ctx) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("you need admin level access to view archives"))
+		return
+	}
+	if l.archiver == nil {
+		writer.WriteHeader(http.StatusNotFound)
+		writer.Write([]byte("archiving is not enabled"))
+		return
+	}
+	archives, err := l.archiver.List()
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("error listing archives: %v", err)
+		return
+	}
+	ret := map[string][]archive.Manifest{
+		"archives": archives,
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(ret); err != nil {
+		log.Errorf("error sending archives: %v", err)
+	}
+}
+
+func (l *LogHandlers) RestoreArchiveHandler(writer http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if !canAccess(ctx) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("you need admin level access to restore archives"))
+		return
+	}
+	if l.archiver == nil {
+		writer.WriteHeader(http.StatusNotFound)
+		writer.Write([]byte("archiving is not enabled"))
+		return
+	}
+	vars := mux.Vars(req)
+	restored, err := l.archiver.Restore(vars["archive"])
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("error restoring archive %q: %v", vars["archive"], err)
+		fmt.Fprintf(writer, "error restoring archive: %v", err)
+		return
+	}
+	ret := map[string]interface{}{
+		"archive":  vars["archive"],
+		"restored": restored,
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(ret); err != nil {
+		log.Errorf("error sending restore result: %v", err)
+	}
+}
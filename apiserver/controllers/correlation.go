@@ -0,0 +1,128 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package controllers
+
+import (
+	"fmt"
+	"net/http"
+
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+
+	"github.com/gorilla/mux"
+)
+
+// correlationFilter returns a filter matching the messages holding id
+// in any of the supplied tags.
+func correlationFilter(id string, tags []string) params.Expression {
+	filter := params.Or{}
+	for _, tag := range tags {
+		filter = append(filter, params.Eq(params.FieldOf(tag), id))
+	}
+	return filter
+}
+
+// CorrelationLogsHandler streams the messages of all logs that hold a
+// correlation ID, such as a Coriolis task or migration ID, as a single
+// time ordered download.
+func (l *LogHandlers) CorrelationLogsHandler(writer http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if !canAccess(ctx) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("you need admin level access to view logs"))
+		return
+	}
+
+	id := mux.Vars(req)["id"]
+	if id == "" {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "missing correlation ID")
+		return
+	}
+	if len(l.correlationTags) == 0 {
+		writer.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(writer, "no correlation rules are configured")
+		return
+	}
+	tags := l.correlationTags
+	if tag := req.URL.Query().Get("tag"); tag != "" {
+		found := false
+		for _, val := range tags {
+			if val == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "invalid correlation tag %q", tag)
+			return
+		}
+		tags = []string{tag}
+	}
+
+	startDateStamp := req.URL.Query().Get("start_date")
+	startDate, err := timestampToTime(startDateStamp)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid start date: %q", startDateStamp)
+		return
+	}
+	endDateStamp := req.URL.Query().Get("end_date")
+	endDate, err := timestampToTime(endDateStamp)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid end date: %q", endDateStamp)
+		return
+	}
+
+	patterns := getAppPatterns(req)
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+	apps, err := l.resolveApps(patterns)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+	if len(apps) == 0 {
+		writer.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(writer, "no logs match the requested apps")
+		return
+	}
+
+	format, err := l.lineFormat(req, "format", logging.FormatPrefixed)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+
+	filter := params.And{correlationFilter(id, tags)}
+	extra, err := queryFilter(req)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+	if extra != nil {
+		filter = append(filter, extra)
+	}
+
+	dl := newDownload(req, "correlation", endDate)
+	dl.open = l.openMerged(apps, startDate, filter, format)
+	l.serveDownload(writer, req, dl)
+}
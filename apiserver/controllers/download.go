@@ -0,0 +1,415 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package controllers
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/params"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+const (
+	encodingIdentity = "identity"
+	encodingGzip     = "gzip"
+	encodingZstd     = "zstd"
+)
+
+// openFunc returns a reader over the messages of a download, up to
+// and including endDate, and a function that releases it.
+type openFunc func(endDate time.Time) (common.Reader, func(), error)
+
+// download is a plain text log download. The end of the downloaded
+// range is pinned when the download starts, and is sent to the client
+// in the ETag, along with a digest of the log, filters and format
+// requested. Resumed requests presenting the ETag read the same range
+// of the log. Responses that need a Content-Length read the log twice,
+// once to measure it and once to send it.
+type download struct {
+	name    string
+	endDate time.Time
+	open    openFunc
+	// variant identifies the log, filters and format of the download.
+	variant string
+
+	// compressed is set when the client asked for a .log.gz file
+	// instead of a plain text one.
+	compressed bool
+	// sized is set when the response must have a Content-Length.
+	sized bool
+	// ranged is set when a single byte range was requested.
+	ranged     bool
+	rangeStart int64
+	rangeEnd   int64
+}
+
+// etag returns the entity tag of the download
+func (d *download) etag() string {
+	cursor := params.Cursor{Timestamp: d.endDate}
+	return `"` + cursor.Encode() + "." + d.variant + `"`
+}
+
+// parseETag returns the end date and variant of an entity tag returned
+// by download.etag.
+func parseETag(tag string) (time.Time, string, bool) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return time.Time{}, "", false
+	}
+	parts := strings.SplitN(tag[1:len(tag)-1], ".", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", false
+	}
+	cursor, err := params.DecodeCursor(parts[0])
+	if err != nil || cursor.Descending || cursor.Skip != 0 {
+		return time.Time{}, "", false
+	}
+	return cursor.Timestamp, parts[1], true
+}
+
+// downloadVariant returns a digest of the request path and query
+// args, which select the log, filters and format of a download.
+// Authentication args are left out, as they do not change the data.
+func downloadVariant(req *http.Request) string {
+	query := req.URL.Query()
+	query.Del("auth_type")
+	query.Del("auth_token")
+	digest := sha256.New()
+	io.WriteString(digest, req.URL.Path)
+	digest.Write([]byte{0})
+	io.WriteString(digest, query.Encode())
+	return hex.EncodeToString(digest.Sum(nil))[:16]
+}
+
+// parseRange parses a single byte range. Suffix ranges (bytes=-N) are
+// returned with a negative start.
+func parseRange(header string) (int64, int64, error) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range: %q", header)
+	}
+	parts := strings.SplitN(strings.TrimSpace(spec), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid range: %q", header)
+	}
+	if parts[0] == "" {
+		suffix, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, fmt.Errorf("invalid range: %q", header)
+		}
+		return -suffix, -1, nil
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid range: %q", header)
+	}
+	end := int64(-1)
+	if parts[1] != "" {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid range: %q", header)
+		}
+	}
+	return start, end, nil
+}
+
+// newDownload returns a download for req. If the request resumes a
+// previous download, the end date of the original download is used.
+// Otherwise endDate is used, capped to the current time.
+func newDownload(req *http.Request, name string, endDate time.Time) *download {
+	query := req.URL.Query()
+	d := &download{name: name, variant: downloadVariant(req)}
+	d.compressed, _ = strconv.ParseBool(query.Get("compressed"))
+	d.sized, _ = strconv.ParseBool(query.Get("disable_chunked"))
+
+	now := time.Now()
+	d.endDate = endDate
+	if d.endDate.IsZero() || d.endDate.After(now) {
+		d.endDate = now
+	}
+
+	rangeHeader := req.Header.Get("Range")
+	if rangeHeader == "" || d.compressed {
+		return d
+	}
+	if ifRange := req.Header.Get("If-Range"); ifRange != "" {
+		pinned, variant, ok := parseETag(ifRange)
+		if !ok || variant != d.variant || (!endDate.IsZero() && !pinned.Equal(endDate)) {
+			// The client holds a different version of the log,
+			// and must get all of it.
+			return d
+		}
+		d.endDate = pinned
+	}
+	start, end, err := parseRange(rangeHeader)
+	if err != nil {
+		// Ranges we do not understand are ignored.
+		return d
+	}
+	d.ranged = true
+	d.sized = true
+	d.rangeStart = start
+	d.rangeEnd = end
+	return d
+}
+
+// negotiateEncoding picks the content encoding of a response, based
+// on the Accept-Encoding header. zstd is preferred over gzip when the
+// client accepts both with the same quality.
+func negotiateEncoding(header string, allowZstd bool) string {
+	best, bestQ := encodingIdentity, 0.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, field := range fields[1:] {
+			field = strings.TrimSpace(field)
+			if strings.HasPrefix(field, "q=") {
+				if val, err := strconv.ParseFloat(field[2:], 64); err == nil {
+					q = val
+				}
+			}
+		}
+		if name == "*" {
+			name = encodingGzip
+		}
+		switch {
+		case q <= 0:
+			continue
+		case name == encodingZstd && !allowZstd:
+			continue
+		case name != encodingZstd && name != encodingGzip:
+			continue
+		}
+		if q > bestQ || (q == bestQ && name == encodingZstd) {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func newEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case encodingGzip:
+		return gzip.NewWriter(w), nil
+	case encodingZstd:
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, errors.Wrap(err, "creating zstd encoder")
+		}
+		return enc, nil
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// encode writes all data returned by reader to w, using the supplied
+// encoding.
+func encode(reader common.Reader, w io.Writer, encoding string) error {
+	enc, err := newEncoder(encoding, w)
+	if err != nil {
+		return err
+	}
+	if err := copyReader(reader, enc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// errRangeSent is returned by rangeWriter once a range that ends
+// before the end of the data was written.
+var errRangeSent = errors.New("range sent")
+
+// rangeWriter writes the bytes from skip to skip+remaining of the data
+// written to it. The last byte of the range is held back until commit
+// is called, so a response whose data changed since it was measured
+// can be aborted before it is complete.
+type rangeWriter struct {
+	w         io.Writer
+	skip      int64
+	remaining int64
+	// partial is set if the range ends before the end of the data, in
+	// which case there is no need to read the rest of it.
+	partial  bool
+	received int64
+	held     []byte
+}
+
+func (r *rangeWriter) Write(data []byte) (int, error) {
+	total := len(data)
+	r.received += int64(total)
+	if r.skip > 0 {
+		if int64(len(data)) <= r.skip {
+			r.skip -= int64(len(data))
+			return total, nil
+		}
+		data = data[r.skip:]
+		r.skip = 0
+	}
+	if int64(len(data)) > r.remaining {
+		data = data[:r.remaining]
+	}
+	if len(data) > 0 && int64(len(data)) == r.remaining {
+		r.held = []byte{data[len(data)-1]}
+		data = data[:len(data)-1]
+		r.remaining--
+	}
+	n, err := r.w.Write(data)
+	r.remaining -= int64(n)
+	if err != nil {
+		return n, err
+	}
+	if r.partial && r.remaining == 0 {
+		return total, errRangeSent
+	}
+	return total, nil
+}
+
+// commit writes the byte held back
+func (r *rangeWriter) commit() error {
+	_, err := r.w.Write(r.held)
+	return err
+}
+
+// serveDownload sends a download to the client. Downloads are never
+// buffered. When a Content-Length is needed, for byte ranges or when
+// chunked transfer is disabled, the log is read once to measure it,
+// and once more to send it. If the log changed in between, the
+// response is aborted before it is complete, rather than sending data
+// that does not match the announced size.
+func (l *LogHandlers) serveDownload(writer http.ResponseWriter, req *http.Request, d *download) {
+	reader, release, err := d.open(d.endDate)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "invalid query: %v", err)
+		return
+	}
+
+	filename := d.name + ".log"
+	contentType := "text/plain"
+	encoding := encodingIdentity
+	switch {
+	case d.compressed:
+		filename += ".gz"
+		contentType = "application/gzip"
+		encoding = encodingGzip
+	case !d.ranged:
+		// zstd frames are not guaranteed to be identical across
+		// passes, so they are only used for streamed responses.
+		encoding = negotiateEncoding(req.Header.Get("Accept-Encoding"), !d.sized)
+	}
+
+	header := writer.Header()
+	header.Set("Content-Disposition", "attachment; filename="+filename)
+	header.Set("Content-Type", contentType)
+	header.Set("Vary", "Accept-Encoding")
+	header.Set("ETag", d.etag())
+	if !d.compressed {
+		header.Set("Accept-Ranges", "bytes")
+	}
+	if !d.compressed && encoding != encodingIdentity {
+		header.Set("Content-Encoding", encoding)
+	}
+
+	if !d.sized {
+		defer release()
+		if err := encode(reader, writer, encoding); err != nil {
+			log.Errorf("error sending log: %v", err)
+		}
+		return
+	}
+
+	counter := &countingWriter{w: io.Discard}
+	err = encode(reader, counter, encoding)
+	release()
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("error reading log: %v", err)
+		return
+	}
+	size := counter.n
+
+	start, end := int64(0), size-1
+	status := http.StatusOK
+	if d.ranged {
+		start = d.rangeStart
+		if start < 0 {
+			start += size
+			if start < 0 {
+				start = 0
+			}
+		}
+		if d.rangeEnd >= 0 && d.rangeEnd < end {
+			end = d.rangeEnd
+		}
+		if start >= size {
+			header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+			writer.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+		status = http.StatusPartialContent
+	}
+	length := end - start + 1
+	header.Set("Content-Length", strconv.FormatInt(length, 10))
+	writer.WriteHeader(status)
+	if length == 0 {
+		return
+	}
+
+	reader, release, err = d.open(d.endDate)
+	if err != nil {
+		log.Errorf("error reading log: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+	defer release()
+	ranged := &rangeWriter{
+		w:         writer,
+		skip:      start,
+		remaining: length,
+		partial:   end < size-1,
+	}
+	err = encode(reader, ranged, encoding)
+	if err != nil && errors.Cause(err) != errRangeSent {
+		log.Errorf("error sending log: %v", err)
+		panic(http.ErrAbortHandler)
+	}
+	if ranged.remaining != 0 || (!ranged.partial && ranged.received != size) {
+		log.Errorf("log %s changed while it was sent, aborting the response", d.name)
+		panic(http.ErrAbortHandler)
+	}
+	if err := ranged.commit(); err != nil {
+		log.Errorf("error sending log: %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package controllers
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"coriolis-logger/logging"
+)
+
+func downloadStore() *memStore {
+	base := time.Now().Add(-time.Hour)
+	store := &memStore{}
+	for i := 0; i < 10; i++ {
+		store.add(logging.LogMessage{
+			AppName:   "app",
+			Hostname:  "host",
+			Severity:  logging.Informational,
+			Message:   fmt.Sprintf("line %d", i),
+			Timestamp: base.Add(time.Duration(i) * time.Second),
+		})
+	}
+	return store
+}
+
+func serveLog(han *LogHandlers, target string, header http.Header) *httptest.ResponseRecorder {
+	req := adminRequest(httptest.NewRequest(http.MethodGet, target, nil))
+	for key, vals := range header {
+		req.Header[key] = vals
+	}
+	req = mux.SetURLVars(req, map[string]string{"log": "app"})
+	rec := httptest.NewRecorder()
+	han.DownloadLogHandler(rec, req)
+	return rec
+}
+
+func TestDownloadSized(t *testing.T) {
+	store := downloadStore()
+	han := &LogHandlers{store: store}
+
+	rec := serveLog(han, "/api/v1/logs/app/?disable_chunked=true", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	if got := rec.Header().Get("Content-Length"); got != fmt.Sprint(len(body)) {
+		t.Errorf("Content-Length is %s, body has %d bytes", got, len(body))
+	}
+	if !strings.HasPrefix(body, "line 0\n") || !strings.HasSuffix(body, "line 9\n") {
+		t.Errorf("unexpected body: %q", body)
+	}
+	// The log is measured, then streamed.
+	if store.queries != 2 {
+		t.Errorf("got %d queries, want 2", store.queries)
+	}
+}
+
+func TestDownloadSizedGzip(t *testing.T) {
+	han := &LogHandlers{store: downloadStore()}
+	rec := serveLog(han, "/api/v1/logs/app/?disable_chunked=true", http.Header{"Accept-Encoding": {"gzip"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Length"); got != fmt.Sprint(rec.Body.Len()) {
+		t.Errorf("Content-Length is %s, body has %d bytes", got, rec.Body.Len())
+	}
+	gz, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("reading gzip: %v", err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("reading gzip: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "line 0\n") || !strings.HasSuffix(string(data), "line 9\n") {
+		t.Errorf("unexpected body: %q", data)
+	}
+}
+
+func TestDownloadChangedWhileSent(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		header http.Header
+	}{
+		{"sized", "/api/v1/logs/app/?disable_chunked=true", nil},
+		{"range", "/api/v1/logs/app/", http.Header{"Range": {"bytes=7-"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := downloadStore()
+			// A late message arrives once the log was measured.
+			store.onQuery = func(queries int) {
+				if queries == 1 {
+					store.add(logging.LogMessage{
+						AppName:   "app",
+						Message:   "late",
+						Timestamp: time.Now().Add(-time.Minute),
+					})
+				}
+			}
+			han := &LogHandlers{store: store}
+
+			var rec *httptest.ResponseRecorder
+			func() {
+				defer func() {
+					if r := recover(); r != http.ErrAbortHandler {
+						t.Errorf("got panic %v, want the response to be aborted", r)
+					}
+				}()
+				req := adminRequest(httptest.NewRequest(http.MethodGet, tt.target, nil))
+				req.Header = tt.header
+				req = mux.SetURLVars(req, map[string]string{"log": "app"})
+				rec = httptest.NewRecorder()
+				han.DownloadLogHandler(rec, req)
+			}()
+			if got := rec.Header().Get("Content-Length"); got == fmt.Sprint(rec.Body.Len()) {
+				t.Errorf("a changed log was sent in full")
+			}
+		})
+	}
+}
+
+func TestDownloadRange(t *testing.T) {
+	store := downloadStore()
+	han := &LogHandlers{store: store}
+
+	full := serveLog(han, "/api/v1/logs/app/", nil)
+	etag := full.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("missing ETag")
+	}
+
+	// Messages arriving after the download started are not part of
+	// the resumed range.
+	store.add(logging.LogMessage{
+		AppName:   "app",
+		Severity:  logging.Informational,
+		Message:   "late",
+		Timestamp: time.Now(),
+	})
+
+	tests := []struct {
+		name    string
+		target  string
+		ifRange string
+		rng     string
+		status  int
+		want    string
+	}{
+		{
+			name:    "resumed",
+			target:  "/api/v1/logs/app/",
+			ifRange: etag,
+			status:  http.StatusPartialContent,
+			want:    full.Body.String()[7:],
+		},
+		{
+			name:    "different filter",
+			target:  "/api/v1/logs/app/?severity=7",
+			ifRange: etag,
+			status:  http.StatusOK,
+		},
+		{
+			name:    "different format",
+			target:  "/api/v1/logs/app/?format=prefixed",
+			ifRange: etag,
+			status:  http.StatusOK,
+		},
+		{
+			name:    "range within the log",
+			target:  "/api/v1/logs/app/",
+			rng:     "bytes=7-13",
+			ifRange: etag,
+			status:  http.StatusPartialContent,
+			want:    "line 1\n",
+		},
+		{
+			name:    "suffix range",
+			target:  "/api/v1/logs/app/",
+			rng:     "bytes=-7",
+			ifRange: etag,
+			status:  http.StatusPartialContent,
+			want:    "line 9\n",
+		},
+		{
+			name:   "range past the end",
+			target: "/api/v1/logs/app/",
+			rng:    "bytes=1000-",
+			status: http.StatusRequestedRangeNotSatisfiable,
+		},
+		{
+			name:    "invalid etag",
+			target:  "/api/v1/logs/app/",
+			ifRange: `"bogus"`,
+			status:  http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rng := tt.rng
+			if rng == "" {
+				rng = "bytes=7-"
+			}
+			header := http.Header{"Range": {rng}}
+			if tt.ifRange != "" {
+				header.Set("If-Range", tt.ifRange)
+			}
+			rec := serveLog(han, tt.target, header)
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.want != "" && rec.Body.String() != tt.want {
+				t.Errorf("got body %q, want %q", rec.Body.String(), tt.want)
+			}
+			if tt.status == http.StatusOK && rec.Header().Get("ETag") == etag {
+				t.Errorf("different downloads share the ETag %s", etag)
+			}
+		})
+	}
+}
+
+func TestMergedDownload(t *testing.T) {
+	store := downloadStore()
+	store.add(logging.LogMessage{
+		AppName:   "other",
+		Hostname:  "host",
+		Message:   "other line",
+		Timestamp: time.Now().Add(-time.Hour).Add(1500 * time.Millisecond),
+	})
+	han := &LogHandlers{store: store}
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"merged", "/api/v1/merged/?apps=app,other&format=message", http.StatusOK},
+		{"limit", "/api/v1/merged/?apps=app&limit=10", http.StatusBadRequest},
+		{"order", "/api/v1/merged/?apps=app&order=desc", http.StatusBadRequest},
+		{"cursor", "/api/v1/merged/?apps=app&cursor=abc", http.StatusBadRequest},
+		{"tail", "/api/v1/merged/?apps=app&tail=5", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := adminRequest(httptest.NewRequest(http.MethodGet, tt.target, nil))
+			rec := httptest.NewRecorder()
+			han.MergedLogsHandler(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+			if len(lines) != 11 || lines[1] != "line 1" || lines[2] != "other line" {
+				t.Errorf("got lines %q", lines)
+			}
+		})
+	}
+}
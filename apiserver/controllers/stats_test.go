@@ -0,0 +1,121 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+)
+
+func TestLogStats(t *testing.T) {
+	start := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	window := fmt.Sprintf("start_date=%d&end_date=%d", start.Unix(), start.Add(3*time.Minute).Unix())
+
+	tests := []struct {
+		name         string
+		query        string
+		histogramErr error
+		wantStatus   int
+		wantTotals   []int64
+	}{
+		{
+			name:       "all messages",
+			query:      window + "&interval=1m",
+			wantStatus: http.StatusOK,
+			wantTotals: []int64{2, 1, 0, 0},
+		},
+		{
+			name:       "field filter",
+			query:      window + "&interval=1m&field=task_id:1",
+			wantStatus: http.StatusOK,
+			wantTotals: []int64{1, 1, 0, 0},
+		},
+		{
+			name:       "invalid interval",
+			query:      window + "&interval=soon",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:         "filter the datastore cannot apply",
+			query:        window,
+			histogramErr: fmt.Errorf("%w: unsupported expression", common.ErrInvalidFilter),
+			wantStatus:   http.StatusBadRequest,
+		},
+		{
+			name:         "datastore error",
+			query:        window,
+			histogramErr: fmt.Errorf("connection refused"),
+			wantStatus:   http.StatusInternalServerError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &memStore{histogramErr: tt.histogramErr}
+			for _, msg := range []struct {
+				offset time.Duration
+				taskID string
+			}{
+				{0, "1"},
+				{30 * time.Second, "2"},
+				{70 * time.Second, "1"},
+			} {
+				store.add(logging.LogMessage{
+					AppName:   "app",
+					Hostname:  "host",
+					Severity:  logging.Informational,
+					Message:   "message",
+					Timestamp: start.Add(msg.offset),
+					Fields:    map[string]interface{}{"task_id": msg.taskID},
+				})
+			}
+
+			han := &LogHandlers{store: store}
+			req := adminRequest(httptest.NewRequest(http.MethodGet, "/api/v1/logs/app/stats/?"+tt.query, nil))
+			req = mux.SetURLVars(req, map[string]string{"log": "app"})
+			rec := httptest.NewRecorder()
+			han.LogStatsHandler(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var resp struct {
+				Buckets []common.HistogramBucket `json:"buckets"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decoding response: %v", err)
+			}
+			if len(resp.Buckets) != len(tt.wantTotals) {
+				t.Fatalf("got %d buckets, want %d", len(resp.Buckets), len(tt.wantTotals))
+			}
+			for idx, bucket := range resp.Buckets {
+				if bucket.Total != tt.wantTotals[idx] {
+					t.Errorf("bucket %d has %d messages, want %d", idx, bucket.Total, tt.wantTotals[idx])
+				}
+			}
+		})
+	}
+}
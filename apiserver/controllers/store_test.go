@@ -0,0 +1,116 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"coriolis-logger/apiserver/auth"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+// memStore is an in-memory datastore, holding enough of the
+// DataStore behaviour for the handlers under test.
+type memStore struct {
+	common.DataStore
+
+	mut      sync.Mutex
+	messages []logging.LogMessage
+	queries  int
+	// histogramErr, if set, is returned by Histogram.
+	histogramErr error
+	// onQuery, if set, is called with the number of queries run so
+	// far, before each query.
+	onQuery func(queries int)
+}
+
+func (s *memStore) add(msgs ...logging.LogMessage) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.messages = append(s.messages, msgs...)
+}
+
+func (s *memStore) Query(p params.QueryParams) (common.Iterator, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if s.onQuery != nil {
+		s.onQuery(s.queries)
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.queries++
+	matched := []logging.LogMessage{}
+	for _, msg := range s.messages {
+		if p.Match(msg) {
+			matched = append(matched, msg)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		if p.Descending {
+			return matched[i].Timestamp.After(matched[j].Timestamp)
+		}
+		return matched[i].Timestamp.Before(matched[j].Timestamp)
+	})
+	if p.Limit > 0 && len(matched) > p.Limit {
+		matched = matched[:p.Limit]
+	}
+	return common.NewSliceIterator(matched), nil
+}
+
+func (s *memStore) Count(p params.QueryParams) (int64, error) {
+	it, err := s.Query(p)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for it.Next() {
+		count++
+	}
+	return count, nil
+}
+
+func (s *memStore) Histogram(p params.QueryParams, interval time.Duration) ([]common.HistogramBucket, error) {
+	if s.histogramErr != nil {
+		return nil, s.histogramErr
+	}
+	return common.ComputeHistogram(s, p, interval)
+}
+
+func (s *memStore) List(p params.ListParams) ([]common.LogInfo, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	seen := map[string]bool{}
+	ret := []common.LogInfo{}
+	for _, msg := range s.messages {
+		if !seen[msg.AppName] {
+			seen[msg.AppName] = true
+			ret = append(ret, common.LogInfo{Name: msg.AppName})
+		}
+	}
+	return common.FilterAndSortLogs(ret, params.ListParams{})
+}
+
+// adminRequest returns req, authenticated as an admin.
+func adminRequest(req *http.Request) *http.Request {
+	ctx := context.WithValue(req.Context(), auth.AuthDetailsKey, auth.AuthDetails{IsAdmin: true})
+	return req.WithContext(ctx)
+}
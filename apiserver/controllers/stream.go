@@ -0,0 +1,349 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package controllers
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+	wsWriter "coriolis-logger/writers/websocket"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// streamKeepalive is the interval at which comments are sent on
+	// idle event streams, to keep proxies from closing them.
+	streamKeepalive = 30 * time.Second
+	// streamRetry is the reconnect delay suggested to clients, in
+	// milliseconds.
+	streamRetry = 3000
+	// maxReplayMessages is the maximum number of stored messages
+	// replayed in a single request when a client resumes a stream.
+	maxReplayMessages = 10000
+)
+
+// replayKey identifies a replayed message, so that it is not sent
+// again if it also comes through the live feed.
+type replayKey struct {
+	receivedAt int64
+	appName    string
+	hostname   string
+	message    string
+}
+
+func replayKeyOf(msg wsWriter.LogMessage) replayKey {
+	return replayKey{
+		receivedAt: msg.ReceivedAt.UnixNano(),
+		appName:    msg.AppName,
+		hostname:   msg.Hostname,
+		message:    msg.Message,
+	}
+}
+
+// replayEntry is a stored message waiting to be replayed. Entries
+// received at the same time are replayed in the order they were read.
+type replayEntry struct {
+	msg   logging.LogMessage
+	order int
+}
+
+func (e replayEntry) before(other replayEntry) bool {
+	if !e.msg.ReceivedAt.Equal(other.msg.ReceivedAt) {
+		return e.msg.ReceivedAt.Before(other.msg.ReceivedAt)
+	}
+	return e.order < other.order
+}
+
+// replayHeap holds the earliest entries read so far, with the latest
+// of them on top.
+type replayHeap []replayEntry
+
+func (h replayHeap) Len() int            { return len(h) }
+func (h replayHeap) Less(i, j int) bool  { return h[j].before(h[i]) }
+func (h replayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *replayHeap) Push(x interface{}) { *h = append(*h, x.(replayEntry)) }
+func (h *replayHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// eventStream writes log messages as server-sent events. Each event ID
+// is a cursor holding the receive time of the message, and the number
+// of messages received at the same time sent before it, which is
+// enough to resume the stream from the datastore. The receive time is
+// used rather than the timestamp, as the live feed is sent in the order
+// messages are received.
+type eventStream struct {
+	writer  http.ResponseWriter
+	flusher http.Flusher
+	last    params.Cursor
+}
+
+func (e *eventStream) send(msg wsWriter.LogMessage) error {
+	if msg.ReceivedAt.Equal(e.last.Timestamp) {
+		e.last.Skip++
+	} else {
+		e.last = params.Cursor{Timestamp: msg.ReceivedAt, Skip: 1}
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrap(err, "encoding message")
+	}
+	if _, err := fmt.Fprintf(e.writer, "id: %s\nevent: log\ndata: %s\n\n", e.last.Encode(), data); err != nil {
+		return err
+	}
+	e.flusher.Flush()
+	return nil
+}
+
+// dropped tells the client that messages were dropped because it
+// could not keep up.
+func (e *eventStream) dropped(count int64) error {
+	if _, err := fmt.Fprintf(e.writer, "event: dropped\ndata: {\"dropped\": %d}\n\n", count); err != nil {
+		return err
+	}
+	e.flusher.Flush()
+	return nil
+}
+
+// truncated tells the client that the replay stopped before catching
+// up with the live feed. The event ID is the cursor to resume from, so
+// EventSource clients pick up where the replay stopped when they
+// reconnect.
+func (e *eventStream) truncated() error {
+	cursor := e.last.Encode()
+	if _, err := fmt.Fprintf(e.writer, "id: %s\nevent: truncated\ndata: {\"cursor\": %q}\n\n", cursor, cursor); err != nil {
+		return err
+	}
+	e.flusher.Flush()
+	return nil
+}
+
+func (e *eventStream) comment(text string) error {
+	if _, err := fmt.Fprintf(e.writer, ": %s\n\n", text); err != nil {
+		return err
+	}
+	e.flusher.Flush()
+	return nil
+}
+
+// replay sends the stored messages that match filter, received after
+// the cursor and up to the time the client subscribed to the live feed,
+// in the order they were received. At most maxReplayMessages are sent.
+// It returns the number of times each message was sent, and whether
+// more messages are left.
+func (l *LogHandlers) replay(stream *eventStream, client *wsWriter.Client, filter *wsWriter.Filter, cursor params.Cursor, subscribed time.Time) (map[replayKey]int, bool, error) {
+	replayed := map[replayKey]int{}
+	logs, err := l.store.List(params.ListParams{NamesOnly: true})
+	if err != nil {
+		return replayed, false, errors.Wrap(err, "listing logs")
+	}
+	received := params.And{
+		filter.Expression(),
+		params.Condition{Field: params.FieldReceivedTime, Operator: params.OpGreaterOrEqual, Value: cursor.Timestamp.UnixNano()},
+		params.Condition{Field: params.FieldReceivedTime, Operator: params.OpLessOrEqual, Value: subscribed.UnixNano()},
+	}
+
+	// The datastore returns messages by timestamp, so the earliest
+	// received ones are picked here. One more than can be sent is kept,
+	// to know if the replay is truncated.
+	keep := cursor.Skip + maxReplayMessages + 1
+	earliest := &replayHeap{}
+	read := 0
+	for _, info := range logs {
+		if !filter.MatchApp(info.Name) {
+			continue
+		}
+		iterator, err := l.store.Query(params.QueryParams{
+			AppName: info.Name,
+			Filter:  received,
+		})
+		if err != nil {
+			return replayed, false, errors.Wrapf(err, "querying %q", info.Name)
+		}
+		for iterator.Next() {
+			entry := replayEntry{msg: iterator.Message(), order: read}
+			read++
+			if earliest.Len() < keep {
+				heap.Push(earliest, entry)
+			} else if entry.before((*earliest)[0]) {
+				(*earliest)[0] = entry
+				heap.Fix(earliest, 0)
+			}
+		}
+		err = iterator.Err()
+		iterator.Close()
+		if err != nil {
+			return replayed, false, errors.Wrapf(err, "querying %q", info.Name)
+		}
+	}
+	entries := []replayEntry(*earliest)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].before(entries[j]) })
+
+	stream.last = cursor
+	skip := cursor.Skip
+	sent := 0
+	for _, entry := range entries {
+		if skip > 0 && entry.msg.ReceivedAt.Equal(cursor.Timestamp) {
+			skip--
+			continue
+		}
+		if sent == maxReplayMessages {
+			return replayed, true, nil
+		}
+		payload := client.SyslogMessageToLogMessage(entry.msg)
+		if err := stream.send(payload); err != nil {
+			return replayed, false, err
+		}
+		replayed[replayKeyOf(payload)]++
+		sent++
+	}
+	return replayed, false, nil
+}
+
+// StreamHandler serves the live log feed as server-sent events. It
+// accepts the same filters as WSHandler. Clients that reconnect with a
+// Last-Event-ID header get the messages they missed from the datastore
+// before the live feed resumes. If there are too many of them, or if
+// live messages were dropped while replaying, the replay ends with a
+// truncated event and the stream is closed, so the client reconnects
+// and resumes from there.
+func (l *LogHandlers) StreamHandler(writer http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	if !canAccess(ctx) {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("you need admin level access to view logs"))
+		return
+	}
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("response writer does not support streaming")
+		return
+	}
+	opts, err := getClientFilterOptions(req)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+	filter, err := wsWriter.NewFilter(opts)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(writer, "%v", err)
+		return
+	}
+
+	// EventSource polyfills that cannot set headers may pass the
+	// last event ID as a query arg.
+	lastEventID := req.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = req.URL.Query().Get("last_event_id")
+	}
+	var resume *params.Cursor
+	if lastEventID != "" {
+		cursor, err := params.DecodeCursor(lastEventID)
+		if err != nil || cursor.Descending || cursor.Skip > maxReplayMessages {
+			writer.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(writer, "invalid last event ID: %q", lastEventID)
+			return
+		}
+		resume = &cursor
+	}
+
+	// Register before replaying, so no message is lost between the
+	// end of the replay and the start of the live feed.
+	client := wsWriter.NewStreamClient(filter, l.hub)
+	if err := l.hub.Register(client); err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		log.Errorf("failed to register stream client: %v", err)
+		return
+	}
+	defer l.hub.Unregister(client)
+	subscribed := time.Now()
+
+	header := writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
+	fmt.Fprintf(writer, "retry: %d\n\n", streamRetry)
+	flusher.Flush()
+
+	stream := &eventStream{writer: writer, flusher: flusher}
+	// Live messages that were already replayed are skipped. At most
+	// maxReplayMessages are tracked.
+	var replayed map[replayKey]int
+	if resume != nil {
+		var truncated bool
+		replayed, truncated, err = l.replay(stream, client, filter, *resume, subscribed)
+		if err != nil {
+			log.Errorf("error replaying logs: %v", err)
+			return
+		}
+		// Live messages dropped during the replay are in the
+		// datastore, and are sent when the client resumes.
+		if truncated || client.Stats().Dropped > 0 {
+			if err := stream.truncated(); err != nil {
+				log.Errorf("error sending event: %v", err)
+			}
+			return
+		}
+	}
+
+	keepalive := time.NewTicker(streamKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-client.Done():
+			return
+		case <-client.Ready():
+			batch, dropped := client.Receive()
+			if dropped > 0 {
+				if err := stream.dropped(dropped); err != nil {
+					log.Errorf("error sending event: %v", err)
+					return
+				}
+			}
+			for _, msg := range batch {
+				if key := replayKeyOf(msg); replayed[key] > 0 {
+					if replayed[key]--; replayed[key] == 0 {
+						delete(replayed, key)
+					}
+					continue
+				}
+				if err := stream.send(msg); err != nil {
+					log.Errorf("error sending event: %v", err)
+					return
+				}
+			}
+		case <-keepalive.C:
+			if err := stream.comment("keepalive"); err != nil {
+				return
+			}
+		}
+	}
+}
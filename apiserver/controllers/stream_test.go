@@ -0,0 +1,199 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+	wsWriter "coriolis-logger/writers/websocket"
+)
+
+type sseEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// readEvents parses the server-sent events in body, until it is
+// closed.
+func readEvents(resp *http.Response) <-chan sseEvent {
+	events := make(chan sseEvent, 100)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		current := sseEvent{}
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if current.event != "" {
+					events <- current
+				}
+				current = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				current.id = line[len("id: "):]
+			case strings.HasPrefix(line, "event: "):
+				current.event = line[len("event: "):]
+			case strings.HasPrefix(line, "data: "):
+				current.data = line[len("data: "):]
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan sseEvent) (sseEvent, bool) {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		return event, ok
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for event")
+	}
+	return sseEvent{}, false
+}
+
+func openStream(t *testing.T, server *httptest.Server, lastEventID string) (*http.Response, <-chan sseEvent) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/v1/stream/", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Last-Event-ID", lastEventID)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("opening stream: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+	return resp, readEvents(resp)
+}
+
+func TestStreamReplay(t *testing.T) {
+	hub := wsWriter.NewHub(context.Background(), &config.Stream{QueueSize: 100})
+	hub.Start()
+	t.Cleanup(func() { hub.Stop() })
+
+	base := time.Now().Add(-time.Hour)
+	store := &memStore{}
+	total := maxReplayMessages + 5
+	for idx := 0; idx < total; idx++ {
+		// Timestamps are in the reverse order of receive times, and
+		// messages are replayed in the order they were received.
+		store.add(logging.LogMessage{
+			AppName:    "app",
+			Hostname:   "host",
+			Severity:   logging.Informational,
+			Message:    fmt.Sprintf("message %d", idx),
+			Timestamp:  base.Add(-time.Duration(idx) * time.Millisecond),
+			ReceivedAt: base.Add(time.Duration(idx) * time.Millisecond),
+		})
+	}
+	// Messages that do not match the filter, or were received after
+	// the client subscribed, are not replayed.
+	store.add(logging.LogMessage{
+		AppName:    "app",
+		Hostname:   "host",
+		Severity:   logging.Debug,
+		Message:    "debug",
+		Timestamp:  base,
+		ReceivedAt: base,
+	}, logging.LogMessage{
+		AppName:    "app",
+		Hostname:   "host",
+		Severity:   logging.Informational,
+		Message:    "future",
+		Timestamp:  base,
+		ReceivedAt: time.Now().Add(time.Hour),
+	})
+	han := &LogHandlers{store: store, hub: hub}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		han.StreamHandler(w, adminRequest(req))
+	}))
+	// Registered before the streams are opened, so they are closed
+	// first.
+	t.Cleanup(server.Close)
+
+	start := params.Cursor{Timestamp: base.Add(-time.Second)}
+	_, events := openStream(t, server, start.Encode())
+	for idx := 0; idx < maxReplayMessages; idx++ {
+		event, _ := nextEvent(t, events)
+		if want := fmt.Sprintf("message %d", idx); event.event != "log" || !strings.Contains(event.data, `"`+want+`"`) {
+			t.Fatalf("got %v, want %s", event, want)
+		}
+	}
+	event, _ := nextEvent(t, events)
+	if event.event != "truncated" || !strings.Contains(event.data, event.id) {
+		t.Fatalf("got %v, want a truncated event holding its cursor", event)
+	}
+	if _, ok := nextEvent(t, events); ok {
+		t.Fatalf("stream was not closed after the truncated event")
+	}
+
+	// Resuming from the truncated event sends the rest of the log.
+	_, events = openStream(t, server, event.id)
+	var last string
+	for idx := maxReplayMessages; idx < total; idx++ {
+		event, _ := nextEvent(t, events)
+		if want := fmt.Sprintf("message %d", idx); event.event != "log" || !strings.Contains(event.data, `"`+want+`"`) {
+			t.Fatalf("got %v, want %s", event, want)
+		}
+		last = event.id
+	}
+
+	// A replayed message coming through the live feed is skipped,
+	// even though live messages with older timestamps are sent.
+	hub.Write(store.messages[total-1])
+	hub.Write(logging.LogMessage{
+		AppName:    "app",
+		Hostname:   "host",
+		Severity:   logging.Informational,
+		Message:    "late",
+		Timestamp:  base,
+		ReceivedAt: time.Now(),
+	})
+	event, _ = nextEvent(t, events)
+	if event.event != "log" || !strings.Contains(event.data, `"late"`) {
+		t.Fatalf("got %v, want the late message", event)
+	}
+
+	// A message received after the last event is replayed, even
+	// though its timestamp is older.
+	store.add(logging.LogMessage{
+		AppName:    "app",
+		Hostname:   "host",
+		Severity:   logging.Informational,
+		Message:    "delayed",
+		Timestamp:  base.Add(-time.Hour),
+		ReceivedAt: base.Add(time.Duration(total) * time.Millisecond),
+	})
+	_, events = openStream(t, server, last)
+	event, _ = nextEvent(t, events)
+	if event.event != "log" || !strings.Contains(event.data, `"delayed"`) {
+		t.Fatalf("got %v, want the delayed message", event)
+	}
+}
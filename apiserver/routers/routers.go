@@ -39,9 +39,21 @@ func GetRouter(cfg config.APIServer, han *controllers.LogHandlers) (*mux.Router,
 	}
 
 	apiRouter.Handle("/{ws:ws\\/?}", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.WSHandler))).Methods("GET")
+	apiRouter.Handle("/{stream:stream\\/?}", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.StreamHandler))).Methods("GET")
 	apiRouter.Handle("/{logs:logs\\/?}", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.ListLogsHandler))).Methods("GET")
 	apiRouter.Handle("/logs/{log}", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.DownloadLogHandler))).Methods("GET")
 	apiRouter.Handle("/logs/{log}/", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.DownloadLogHandler))).Methods("GET")
+	apiRouter.Handle("/{merged:merged\\/?}", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.MergedLogsHandler))).Methods("GET")
+	apiRouter.Handle("/correlations/{id}/logs", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.CorrelationLogsHandler))).Methods("GET")
+	apiRouter.Handle("/correlations/{id}/logs/", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.CorrelationLogsHandler))).Methods("GET")
+	apiRouter.Handle("/logs/{log}/stats", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.LogStatsHandler))).Methods("GET")
+	apiRouter.Handle("/logs/{log}/stats/", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.LogStatsHandler))).Methods("GET")
+	apiRouter.Handle("/{archives:archives\\/?}", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.ListArchivesHandler))).Methods("GET")
+	apiRouter.Handle("/archives/{archive}/restore", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.RestoreArchiveHandler))).Methods("POST")
+	apiRouter.Handle("/archives/{archive}/restore/", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.RestoreArchiveHandler))).Methods("POST")
+	apiRouter.Handle("/{retention:retention\\/?}", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.RetentionHandler))).Methods("GET")
+	apiRouter.Handle("/{pipeline:pipeline\\/?}", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.PipelineHandler))).Methods("GET")
+	apiRouter.Handle("/{bundle:bundle\\/?}", gorillaHandlers.LoggingHandler(os.Stdout, http.HandlerFunc(han.BundleHandler))).Methods("GET")
 
 	return router, nil
 }
@@ -0,0 +1,337 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+
+	"github.com/google/uuid"
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+)
+
+var log = loggo.GetLogger("coriolis.logger.archive")
+
+const manifestName = "manifest.json"
+
+// Chunk describes a single compressed NDJSON file in an archive
+type Chunk struct {
+	Name     string `json:"name"`
+	Messages int64  `json:"messages"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+}
+
+// Manifest describes the contents of an archive. An archive holds
+// the messages of a single log that were exported before being
+// deleted by the retention policy.
+type Manifest struct {
+	ID        string    `json:"id"`
+	AppName   string    `json:"app_name"`
+	CreatedAt time.Time `json:"created_at"`
+	// StartDate and EndDate are the timestamps of the oldest and
+	// newest archived messages.
+	StartDate  time.Time `json:"start_date"`
+	EndDate    time.Time `json:"end_date"`
+	Severities []int     `json:"severities,omitempty"`
+	Messages   int64     `json:"messages"`
+	Chunks     []Chunk   `json:"chunks"`
+}
+
+// record is the archived representation of a log message
+type record struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Hostname  string                 `json:"hostname"`
+	AppName   string                 `json:"app_name"`
+	Priority  int                    `json:"priority"`
+	Facility  int                    `json:"facility"`
+	Severity  int                    `json:"severity"`
+	ProcID    int                    `json:"proc_id,omitempty"`
+	Message   string                 `json:"message"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+	// SenderTimestamp and ReceivedAt are only set if they differ
+	// from Timestamp.
+	SenderTimestamp *time.Time `json:"sender_timestamp,omitempty"`
+	ReceivedAt      *time.Time `json:"received_at,omitempty"`
+}
+
+// optionalTime returns a pointer to val, or nil if it is zero or
+// equal to stamp.
+func optionalTime(val, stamp time.Time) *time.Time {
+	if val.IsZero() || val.Equal(stamp) {
+		return nil
+	}
+	return &val
+}
+
+func newRecord(msg logging.LogMessage) record {
+	return record{
+		Timestamp: msg.Timestamp,
+		Hostname:  msg.Hostname,
+		AppName:   msg.AppName,
+		Priority:  msg.Priority,
+		Facility:  int(msg.Facility),
+		Severity:  int(msg.Severity),
+		ProcID:    msg.ProcID,
+		Message:   msg.Message,
+		Fields:    msg.Fields,
+
+		SenderTimestamp: optionalTime(msg.SenderTimestamp, msg.Timestamp),
+		ReceivedAt:      optionalTime(msg.ReceivedAt, msg.Timestamp),
+	}
+}
+
+// logMessage converts the record back into a log message.
+func (r record) logMessage() logging.LogMessage {
+	msg := logging.LogMessage{
+		Timestamp: r.Timestamp,
+		Hostname:  r.Hostname,
+		AppName:   r.AppName,
+		Priority:  r.Priority,
+		Facility:  logging.Facility(r.Facility),
+		Severity:  logging.Severity(r.Severity),
+		ProcID:    r.ProcID,
+		Message:   r.Message,
+		Fields:    r.Fields,
+	}
+	msg.SenderTimestamp = msg.Timestamp
+	if r.SenderTimestamp != nil {
+		msg.SenderTimestamp = *r.SenderTimestamp
+	}
+	msg.ReceivedAt = msg.Timestamp
+	if r.ReceivedAt != nil {
+		msg.ReceivedAt = *r.ReceivedAt
+	}
+	return msg
+}
+
+func NewArchiver(cfg *config.Archive, store common.DataStore) (*Archiver, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating archive config")
+	}
+	backend, err := getBackend(cfg)
+	if err != nil {
+		return nil, errors.Wrap(err, "getting archive backend")
+	}
+	return &Archiver{
+		backend:   backend,
+		store:     store,
+		chunkSize: cfg.GetChunkSize(),
+	}, nil
+}
+
+// Archiver exports logs from a datastore into compressed archives,
+// and restores them.
+type Archiver struct {
+	backend   Backend
+	store     common.DataStore
+	chunkSize int
+}
+
+type chunkWriter struct {
+	buf      *bytes.Buffer
+	gz       *gzip.Writer
+	enc      *json.Encoder
+	messages int64
+}
+
+func newChunkWriter() *chunkWriter {
+	buf := bytes.NewBuffer(nil)
+	gz := gzip.NewWriter(buf)
+	return &chunkWriter{
+		buf: buf,
+		gz:  gz,
+		enc: json.NewEncoder(gz),
+	}
+}
+
+func (a *Archiver) putChunk(manifest *Manifest, chunk *chunkWriter) error {
+	if err := chunk.gz.Close(); err != nil {
+		return errors.Wrap(err, "compressing chunk")
+	}
+	data := chunk.buf.Bytes()
+	sum := sha256.Sum256(data)
+	name := fmt.Sprintf("chunk-%05d.ndjson.gz", len(manifest.Chunks))
+	if err := a.backend.Put(path.Join(manifest.ID, name), data); err != nil {
+		return errors.Wrap(err, "storing chunk")
+	}
+	manifest.Chunks = append(manifest.Chunks, Chunk{
+		Name:     name,
+		Messages: chunk.messages,
+		Size:     int64(len(data)),
+		SHA256:   hex.EncodeToString(sum[:]),
+	})
+	manifest.Messages += chunk.messages
+	return nil
+}
+
+// Archive exports all messages matching p. The manifest is written
+// last, so archives without a manifest are incomplete and ignored.
+// If no messages match, no archive is created and a nil manifest
+// is returned.
+func (a *Archiver) Archive(p params.QueryParams, severities []int) (*Manifest, error) {
+	iterator, err := a.store.Query(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying logs")
+	}
+	defer iterator.Close()
+
+	now := time.Now().UTC()
+	manifest := &Manifest{
+		ID:         fmt.Sprintf("%s-%s", now.Format("20060102T150405Z"), uuid.New().String()[:8]),
+		AppName:    p.AppName,
+		CreatedAt:  now,
+		Severities: severities,
+		Chunks:     []Chunk{},
+	}
+
+	chunk := newChunkWriter()
+	for iterator.Next() {
+		msg := iterator.Message()
+		if manifest.StartDate.IsZero() || msg.Timestamp.Before(manifest.StartDate) {
+			manifest.StartDate = msg.Timestamp
+		}
+		if msg.Timestamp.After(manifest.EndDate) {
+			manifest.EndDate = msg.Timestamp
+		}
+		if err := chunk.enc.Encode(newRecord(msg)); err != nil {
+			return nil, errors.Wrap(err, "encoding message")
+		}
+		chunk.messages++
+		if chunk.messages >= int64(a.chunkSize) {
+			if err := a.putChunk(manifest, chunk); err != nil {
+				return nil, err
+			}
+			chunk = newChunkWriter()
+		}
+	}
+	if err := iterator.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading logs")
+	}
+	if chunk.messages > 0 {
+		if err := a.putChunk(manifest, chunk); err != nil {
+			return nil, err
+		}
+	}
+	if manifest.Messages == 0 {
+		return nil, nil
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "encoding manifest")
+	}
+	if err := a.backend.Put(path.Join(manifest.ID, manifestName), data); err != nil {
+		return nil, errors.Wrap(err, "storing manifest")
+	}
+	log.Infof("archived %d messages from %q as %s", manifest.Messages, manifest.AppName, manifest.ID)
+	return manifest, nil
+}
+
+func (a *Archiver) getManifest(id string) (Manifest, error) {
+	var manifest Manifest
+	data, err := readAll(a.backend, path.Join(id, manifestName))
+	if err != nil {
+		return manifest, err
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, errors.Wrap(err, "decoding manifest")
+	}
+	return manifest, nil
+}
+
+// List returns the manifests of all complete archives, oldest first.
+func (a *Archiver) List() ([]Manifest, error) {
+	names, err := a.backend.List("")
+	if err != nil {
+		return nil, errors.Wrap(err, "listing archives")
+	}
+	ret := []Manifest{}
+	for _, name := range names {
+		id, file := path.Split(name)
+		if file != manifestName {
+			continue
+		}
+		manifest, err := a.getManifest(strings.TrimSuffix(id, "/"))
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, manifest)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].CreatedAt.Before(ret[j].CreatedAt)
+	})
+	return ret, nil
+}
+
+// Restore writes all messages in an archive back to the datastore.
+// It returns the number of restored messages.
+func (a *Archiver) Restore(id string) (int64, error) {
+	if id == "" || strings.Contains(id, "/") {
+		return 0, fmt.Errorf("invalid archive id %q", id)
+	}
+	manifest, err := a.getManifest(id)
+	if err != nil {
+		return 0, errors.Wrapf(err, "fetching archive %q", id)
+	}
+
+	var restored int64
+	for _, chunk := range manifest.Chunks {
+		data, err := readAll(a.backend, path.Join(id, chunk.Name))
+		if err != nil {
+			return restored, err
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != chunk.SHA256 {
+			return restored, fmt.Errorf("checksum mismatch for %s/%s", id, chunk.Name)
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return restored, errors.Wrapf(err, "decompressing %s/%s", id, chunk.Name)
+		}
+		scanner := bufio.NewScanner(gz)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var rec record
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				return restored, errors.Wrapf(err, "decoding %s/%s", id, chunk.Name)
+			}
+			if err := a.store.Write(rec.logMessage()); err != nil {
+				return restored, errors.Wrap(err, "writing message")
+			}
+			restored++
+		}
+		if err := scanner.Err(); err != nil {
+			return restored, errors.Wrapf(err, "reading %s/%s", id, chunk.Name)
+		}
+	}
+	log.Infof("restored %d messages from archive %s", restored, id)
+	return restored, nil
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+// memStore is an in-memory datastore, holding enough of the
+// DataStore behaviour for the archiver.
+type memStore struct {
+	common.DataStore
+
+	messages []logging.LogMessage
+}
+
+func (s *memStore) Query(p params.QueryParams) (common.Iterator, error) {
+	matched := []logging.LogMessage{}
+	for _, msg := range s.messages {
+		if p.Match(msg) {
+			matched = append(matched, msg)
+		}
+	}
+	return common.NewSliceIterator(matched), nil
+}
+
+func (s *memStore) Write(msg logging.LogMessage) error {
+	s.messages = append(s.messages, msg)
+	return nil
+}
+
+func newTestArchiver(t *testing.T, dir string, store common.DataStore) *Archiver {
+	t.Helper()
+	archiver, err := NewArchiver(&config.Archive{
+		Backend:   config.LocalArchiveBackend,
+		Path:      dir,
+		ChunkSize: 2,
+	}, store)
+	if err != nil {
+		t.Fatalf("creating archiver: %v", err)
+	}
+	return archiver
+}
+
+func testMessages() []logging.LogMessage {
+	base := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	msgs := []logging.LogMessage{}
+	for i := 0; i < 5; i++ {
+		stamp := base.Add(time.Duration(i) * time.Minute)
+		msgs = append(msgs, logging.LogMessage{
+			Timestamp:       stamp,
+			SenderTimestamp: stamp.Add(-time.Second),
+			ReceivedAt:      stamp,
+			Hostname:        "host-1",
+			AppName:         "app",
+			Priority:        11,
+			Facility:        logging.UserLevelMessages,
+			Severity:        logging.Error,
+			ProcID:          i,
+			Message:         "message",
+			Fields:          map[string]interface{}{"task_id": "1234"},
+		})
+	}
+	// A message of another log, which is not archived.
+	msgs = append(msgs, logging.LogMessage{
+		Timestamp:       base,
+		SenderTimestamp: base,
+		ReceivedAt:      base,
+		AppName:         "other",
+	})
+	return msgs
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	msgs := testMessages()
+	archiver := newTestArchiver(t, dir, &memStore{messages: msgs})
+
+	manifest, err := archiver.Archive(params.QueryParams{AppName: "app"}, nil)
+	if err != nil {
+		t.Fatalf("archiving: %v", err)
+	}
+	if manifest.Messages != 5 || len(manifest.Chunks) != 3 {
+		t.Errorf("got %d messages in %d chunks, want 5 in 3", manifest.Messages, len(manifest.Chunks))
+	}
+	if !manifest.StartDate.Equal(msgs[0].Timestamp) || !manifest.EndDate.Equal(msgs[4].Timestamp) {
+		t.Errorf("got range %s - %s", manifest.StartDate, manifest.EndDate)
+	}
+
+	manifests, err := archiver.List()
+	if err != nil {
+		t.Fatalf("listing archives: %v", err)
+	}
+	if len(manifests) != 1 || manifests[0].ID != manifest.ID {
+		t.Fatalf("got archives %+v, want %s", manifests, manifest.ID)
+	}
+
+	restoreStore := &memStore{}
+	restored, err := newTestArchiver(t, dir, restoreStore).Restore(manifest.ID)
+	if err != nil {
+		t.Fatalf("restoring: %v", err)
+	}
+	if restored != 5 {
+		t.Errorf("restored %d messages, want 5", restored)
+	}
+	if !reflect.DeepEqual(restoreStore.messages, msgs[:5]) {
+		t.Errorf("restored messages %+v, want %+v", restoreStore.messages, msgs[:5])
+	}
+}
+
+func TestArchiveNothingMatches(t *testing.T) {
+	archiver := newTestArchiver(t, t.TempDir(), &memStore{messages: testMessages()})
+	manifest, err := archiver.Archive(params.QueryParams{AppName: "missing"}, nil)
+	if err != nil || manifest != nil {
+		t.Fatalf("got manifest %+v and error %v, want neither", manifest, err)
+	}
+	manifests, err := archiver.List()
+	if err != nil || len(manifests) != 0 {
+		t.Errorf("got archives %+v and error %v, want none", manifests, err)
+	}
+}
+
+func TestRestoreChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	archiver := newTestArchiver(t, dir, &memStore{messages: testMessages()})
+	manifest, err := archiver.Archive(params.QueryParams{AppName: "app"}, nil)
+	if err != nil {
+		t.Fatalf("archiving: %v", err)
+	}
+
+	chunk := filepath.Join(dir, manifest.ID, manifest.Chunks[1].Name)
+	if err := os.WriteFile(chunk, []byte("corrupted"), 0640); err != nil {
+		t.Fatalf("corrupting chunk: %v", err)
+	}
+	restoreStore := &memStore{}
+	restored, err := newTestArchiver(t, dir, restoreStore).Restore(manifest.ID)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("got error %v, want a checksum mismatch", err)
+	}
+	// The chunks before the corrupted one are restored.
+	if restored != 2 || len(restoreStore.messages) != 2 {
+		t.Errorf("restored %d messages, want 2", restored)
+	}
+}
+
+func TestRestoreInvalidID(t *testing.T) {
+	archiver := newTestArchiver(t, t.TempDir(), &memStore{})
+	for _, id := range []string{"", "../archive", "missing"} {
+		if _, err := archiver.Restore(id); err == nil {
+			t.Errorf("restoring %q did not fail", id)
+		}
+	}
+}
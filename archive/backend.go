@@ -0,0 +1,132 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package archive
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"coriolis-logger/config"
+
+	"github.com/pkg/errors"
+)
+
+// Backend stores archive objects. Object names are slash separated
+// paths relative to the root of the archive.
+type Backend interface {
+	Put(name string, data []byte) error
+	Get(name string) (io.ReadCloser, error)
+	// List returns the names of all objects starting with prefix.
+	List(prefix string) ([]string, error)
+}
+
+func getBackend(cfg *config.Archive) (Backend, error) {
+	switch cfg.Backend {
+	case config.LocalArchiveBackend:
+		return &localBackend{root: cfg.Path}, nil
+	case config.S3ArchiveBackend:
+		return newS3Backend(cfg.S3)
+	default:
+		return nil, fmt.Errorf("invalid archive backend %q", cfg.Backend)
+	}
+}
+
+// localBackend stores archives in a local directory
+type localBackend struct {
+	root string
+}
+
+func (l *localBackend) path(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid object name %q", name)
+	}
+	return filepath.Join(l.root, clean), nil
+}
+
+func (l *localBackend) Put(name string, data []byte) error {
+	dst, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0750); err != nil {
+		return errors.Wrap(err, "creating archive dir")
+	}
+	// Write to a temporary file first, so that a partially written
+	// object is never visible under its final name.
+	tmp := dst + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return errors.Wrap(err, "writing archive object")
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "writing archive object")
+	}
+	return nil
+}
+
+func (l *localBackend) Get(name string) (io.ReadCloser, error) {
+	src, err := l.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(src)
+}
+
+func (l *localBackend) List(prefix string) ([]string, error) {
+	ret := []string{}
+	err := filepath.Walk(l.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == l.root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) {
+			ret = append(ret, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing archive dir")
+	}
+	return ret, nil
+}
+
+func readAll(backend Backend, name string) ([]byte, error) {
+	obj, err := backend.Get(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching %q", name)
+	}
+	defer obj.Close()
+	buf := bytes.NewBuffer(nil)
+	if _, err := io.Copy(buf, obj); err != nil {
+		return nil, errors.Wrapf(err, "reading %q", name)
+	}
+	return buf.Bytes(), nil
+}
@@ -22,9 +22,11 @@ import (
 	"syscall"
 
 	"coriolis-logger/apiserver"
+	"coriolis-logger/archive"
 	"coriolis-logger/config"
 	"coriolis-logger/datastore"
-	"coriolis-logger/logging"
+	"coriolis-logger/pipeline"
+	"coriolis-logger/retention"
 	"coriolis-logger/syslog"
 	"coriolis-logger/writers/stdout"
 	"coriolis-logger/writers/websocket"
@@ -35,7 +37,7 @@ import (
 var log = loggo.GetLogger("coriolis.logger.cmd")
 
 func main() {
-	stop := make(chan os.Signal)
+	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGTERM)
 	signal.Notify(stop, syscall.SIGINT)
 	log.SetLogLevel(loggo.DEBUG)
@@ -60,10 +62,13 @@ func main() {
 	// ctx, cancel := context.WithCancel(context.Background())
 	ctx, cancel := context.WithCancel(context.Background())
 	errChan := make(chan error)
+	// The datastore outlives ctx, so it can store the messages still
+	// queued in the pipeline on shutdown.
+	storeCtx, storeCancel := context.WithCancel(context.Background())
 
-	configuredWriters := []logging.Writer{}
+	writer := pipeline.NewPipeline(cfg.Syslog.Pipeline)
 
-	datastore, err := datastore.GetDatastore(ctx, cfg.Syslog)
+	datastore, err := datastore.GetDatastore(storeCtx, cfg.Syslog)
 	if err != nil {
 		log.Errorf("error getting datastore: %q", err)
 		os.Exit(1)
@@ -72,7 +77,25 @@ func main() {
 		log.Errorf("error starting datastore: %q", err)
 		os.Exit(1)
 	}
-	configuredWriters = append(configuredWriters, datastore)
+	if err := writer.Add(config.DatastoreWriter, datastore); err != nil {
+		log.Errorf("error adding datastore writer: %q", err)
+		os.Exit(1)
+	}
+
+	var archiver *archive.Archiver
+	if cfg.Syslog.Archive != nil {
+		archiver, err = archive.NewArchiver(cfg.Syslog.Archive, datastore)
+		if err != nil {
+			log.Errorf("error getting archiver: %q", err)
+			os.Exit(1)
+		}
+	}
+
+	retentionMgr := retention.NewManager(ctx, cfg.Syslog, datastore, archiver)
+	if err := retentionMgr.Start(); err != nil {
+		log.Errorf("error starting retention worker: %q", err)
+		os.Exit(1)
+	}
 
 	if cfg.Syslog.LogToStdout {
 		stdoutWriter, err := stdout.NewStdOutWriter()
@@ -80,17 +103,79 @@ func main() {
 			log.Errorf("error getting stdout datastore: %q", err)
 			os.Exit(1)
 		}
-		configuredWriters = append(configuredWriters, stdoutWriter)
+		if err := writer.Add(config.StdOutWriter, stdoutWriter); err != nil {
+			log.Errorf("error adding stdout writer: %q", err)
+			os.Exit(1)
+		}
 	}
 
-	websocketWorker := websocket.NewHub(ctx)
+	websocketWorker := websocket.NewHub(ctx, cfg.APIServer.Stream)
 	if err := websocketWorker.Start(); err != nil {
 		log.Errorf("error starting websocket worker: %q", err)
 		os.Exit(1)
 	}
-	configuredWriters = append(configuredWriters, websocketWorker)
-
-	writer := logging.NewAggregateWriter(configuredWriters...)
+	if err := writer.Add(config.WebsocketWriter, websocketWorker); err != nil {
+		log.Errorf("error adding websocket writer: %q", err)
+		os.Exit(1)
+	}
+	if cfg.Syslog.Routing != nil {
+		if err := writer.Route(*cfg.Syslog.Routing); err != nil {
+			log.Errorf("error setting up routing: %q", err)
+			os.Exit(1)
+		}
+	}
+	if cfg.Syslog.Multiline != nil {
+		multiline, err := pipeline.NewMultiline(*cfg.Syslog.Multiline)
+		if err != nil {
+			log.Errorf("error getting multi-line stage: %q", err)
+			os.Exit(1)
+		}
+		writer.Use(multiline)
+	}
+	if cfg.Syslog.Dedup != nil {
+		writer.Use(pipeline.NewDedup(*cfg.Syslog.Dedup))
+	}
+	if cfg.Syslog.RateLimit != nil {
+		writer.Use(pipeline.NewRateLimiter(*cfg.Syslog.RateLimit))
+	}
+	if cfg.Syslog.Redaction == nil || !cfg.Syslog.Redaction.Disabled {
+		redactor, err := pipeline.NewRedactor(cfg.Syslog.Redaction)
+		if err != nil {
+			log.Errorf("error getting redactor: %q", err)
+			os.Exit(1)
+		}
+		writer.Use(redactor)
+	}
+	if cfg.Syslog.Parser != nil {
+		// The parser runs after redaction, so that fields never hold
+		// redacted secrets.
+		parser, err := pipeline.NewParser(*cfg.Syslog.Parser)
+		if err != nil {
+			log.Errorf("error getting parser: %q", err)
+			os.Exit(1)
+		}
+		writer.Use(parser)
+	}
+	if cfg.Syslog.Correlation != nil {
+		correlator, err := pipeline.NewCorrelator(*cfg.Syslog.Correlation)
+		if err != nil {
+			log.Errorf("error getting correlation stage: %q", err)
+			os.Exit(1)
+		}
+		writer.Use(correlator)
+	}
+	if cfg.Syslog.Enrichment != nil {
+		enricher, err := pipeline.NewEnricher(*cfg.Syslog.Enrichment)
+		if err != nil {
+			log.Errorf("error getting enrichment stage: %q", err)
+			os.Exit(1)
+		}
+		writer.Use(enricher)
+	}
+	if err := writer.Start(); err != nil {
+		log.Errorf("error starting pipeline: %q", err)
+		os.Exit(1)
+	}
 
 	syslogSvc, err := syslog.NewSyslogServer(ctx, cfg.Syslog, writer, errChan)
 	if err != nil {
@@ -103,7 +188,7 @@ func main() {
 	}
 
 	apiServer, err := apiserver.GetAPIServer(
-		cfg.APIServer, websocketWorker, datastore)
+		cfg, websocketWorker, datastore, retentionMgr, archiver, writer)
 	if err != nil {
 		log.Errorf("error getting api worker: %q", err)
 		os.Exit(1)
@@ -129,6 +214,11 @@ func main() {
 		cancel()
 	}
 	syslogSvc.Wait()
+	if err := writer.Stop(); err != nil {
+		log.Errorf("error draining pipeline: %q", err)
+	}
+	storeCancel()
 	datastore.Wait()
+	retentionMgr.Wait()
 	apiServer.Stop()
 }
@@ -22,7 +22,15 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"coriolis-logger/logging"
 
 	"github.com/BurntSushi/toml"
 	"github.com/juju/loggo"
@@ -118,6 +126,69 @@ type APIServer struct {
 	TLSConfig      TLSConfig     `toml:"tls"`
 	KeystoneAuth   *KeystoneAuth `toml:"keystone_auth"`
 	CORSOrigins    []string      `toml:"cors_origins"`
+	// LineFormats holds named line templates, that can be selected
+	// with the format query parameter of text downloads.
+	LineFormats map[string]string `toml:"line_formats"`
+	// Stream holds the settings of live log streams.
+	Stream *Stream `toml:"stream"`
+}
+
+// OverflowPolicy is the action taken when the queue of a live
+// stream client is full.
+type OverflowPolicy string
+
+const (
+	// OverflowDropOldest drops the oldest queued message.
+	OverflowDropOldest OverflowPolicy = "drop_oldest"
+	// OverflowDropNotify drops the new message, and tells the client
+	// how many messages were dropped.
+	OverflowDropNotify OverflowPolicy = "drop_notify"
+	// OverflowDisconnect disconnects the client.
+	OverflowDisconnect OverflowPolicy = "disconnect"
+
+	DefaultStreamQueueSize = 1024
+	DefaultStreamBatchSize = 500
+)
+
+// Stream holds the settings of live log streams, served over
+// websockets and server-sent events.
+type Stream struct {
+	// QueueSize is the number of messages queued for each client.
+	QueueSize int `toml:"queue_size"`
+	// BatchSize is the maximum number of messages sent to a client
+	// in a single frame, for clients that support batches.
+	BatchSize      int            `toml:"batch_size"`
+	OverflowPolicy OverflowPolicy `toml:"overflow_policy"`
+}
+
+func (s *Stream) GetQueueSize() int {
+	if s == nil || s.QueueSize <= 0 {
+		return DefaultStreamQueueSize
+	}
+	return s.QueueSize
+}
+
+func (s *Stream) GetBatchSize() int {
+	if s == nil || s.BatchSize <= 0 {
+		return DefaultStreamBatchSize
+	}
+	return s.BatchSize
+}
+
+func (s *Stream) GetOverflowPolicy() OverflowPolicy {
+	if s == nil || s.OverflowPolicy == "" {
+		return OverflowDropOldest
+	}
+	return s.OverflowPolicy
+}
+
+func (s *Stream) Validate() error {
+	switch s.GetOverflowPolicy() {
+	case OverflowDropOldest, OverflowDropNotify, OverflowDisconnect:
+	default:
+		return fmt.Errorf("invalid overflow_policy %q", s.OverflowPolicy)
+	}
+	return nil
 }
 
 func (a *APIServer) Validate() error {
@@ -150,16 +221,91 @@ func (a *APIServer) Validate() error {
 		// when we try to bind to it.
 		return fmt.Errorf("invalid IP address")
 	}
+	if a.Stream != nil {
+		if err := a.Stream.Validate(); err != nil {
+			return errors.Wrap(err, "validating stream config")
+		}
+	}
+	for name, tmpl := range a.LineFormats {
+		if _, ok := logging.BuiltinFormats[name]; ok {
+			return fmt.Errorf("line format %q overrides a built-in format", name)
+		}
+		if _, err := logging.ParseLineFormat(tmpl); err != nil {
+			return errors.Wrapf(err, "parsing line format %q", name)
+		}
+	}
 	return nil
 }
 
 type Syslog struct {
-	Listener    ListenerType
-	Address     string
-	Format      string
-	LogToStdout bool `toml:"log_to_stdout"`
-	DataStore   DatastoreType
-	InfluxDB    *InfluxDB `toml:"influxdb"`
+	Listener ListenerType
+	// ListenerName names the listener in the listener tag added by
+	// the enrichment stage. Defaults to the listener type.
+	ListenerName string `toml:"listener_name"`
+	Address      string
+	Format       string
+	LogToStdout  bool `toml:"log_to_stdout"`
+	DataStore    DatastoreType
+	InfluxDB     *InfluxDB    `toml:"influxdb"`
+	Retention    *Retention   `toml:"retention"`
+	Archive      *Archive     `toml:"archive"`
+	Quota        *Quota       `toml:"quota"`
+	Pipeline     *Pipeline    `toml:"pipeline"`
+	Routing      *Routing     `toml:"routing"`
+	Redaction    *Redaction   `toml:"redaction"`
+	RateLimit    *RateLimit   `toml:"rate_limit"`
+	Dedup        *Dedup       `toml:"dedup"`
+	Multiline    *Multiline   `toml:"multiline"`
+	Parser       *Parser      `toml:"parser"`
+	Correlation  *Correlation `toml:"correlation"`
+	Enrichment   *Enrichment  `toml:"enrichment"`
+	Timestamps   *Timestamps  `toml:"timestamps"`
+}
+
+// GetListenerName returns the name of the syslog listener
+func (s *Syslog) GetListenerName() string {
+	if s.ListenerName != "" {
+		return s.ListenerName
+	}
+	return string(s.Listener)
+}
+
+// GetTagFields returns the keys of the structured message fields that
+// are stored as indexed tags.
+func (s *Syslog) GetTagFields() []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	add := func(keys []string) {
+		for _, key := range keys {
+			if !seen[key] {
+				seen[key] = true
+				tags = append(tags, key)
+			}
+		}
+	}
+	if s.Parser != nil {
+		add(s.Parser.Tags)
+	}
+	add(s.Correlation.GetTags())
+	add(s.Enrichment.GetTags())
+	return tags
+}
+
+// DefaultRetention returns the retention period applied to logs
+// that do not match any retention rule. For backwards compatibility,
+// the influxdb log_retention_period is used if no default period
+// is set in the retention section.
+func (s *Syslog) DefaultRetention() time.Duration {
+	if s.Retention != nil && s.Retention.DefaultPeriod != "" {
+		// Validated when loading the config.
+		period, _ := ParseRetentionPeriod(s.Retention.DefaultPeriod)
+		return period
+	}
+	days := DefaultLogRetentionPeriod
+	if s.InfluxDB != nil {
+		days = s.InfluxDB.GetLogRetention()
+	}
+	return time.Duration(days) * 24 * time.Hour
 }
 
 func (s *Syslog) LogFormat() (format.Format, error) {
@@ -212,6 +358,1148 @@ func (s *Syslog) Validate() error {
 	default:
 		return fmt.Errorf("invalid listener type %q", s.Listener)
 	}
+
+	if s.Retention != nil {
+		if err := s.Retention.Validate(); err != nil {
+			return errors.Wrap(err, "validating retention")
+		}
+	}
+
+	if s.Archive != nil {
+		if err := s.Archive.Validate(); err != nil {
+			return errors.Wrap(err, "validating archive")
+		}
+	}
+
+	if s.Quota != nil {
+		if err := s.Quota.Validate(); err != nil {
+			return errors.Wrap(err, "validating quota")
+		}
+	}
+
+	if s.Pipeline != nil {
+		if err := s.Pipeline.Validate(); err != nil {
+			return errors.Wrap(err, "validating pipeline")
+		}
+	}
+
+	if s.Routing != nil {
+		if err := s.Routing.Validate(); err != nil {
+			return errors.Wrap(err, "validating routing")
+		}
+		if !s.LogToStdout && s.Routing.UsesWriter(StdOutWriter) {
+			return fmt.Errorf("routing to the %s writer requires log_to_stdout", StdOutWriter)
+		}
+	}
+
+	if s.Redaction != nil {
+		if err := s.Redaction.Validate(); err != nil {
+			return errors.Wrap(err, "validating redaction")
+		}
+	}
+
+	if s.RateLimit != nil {
+		if err := s.RateLimit.Validate(); err != nil {
+			return errors.Wrap(err, "validating rate_limit")
+		}
+	}
+
+	if s.Dedup != nil {
+		if err := s.Dedup.Validate(); err != nil {
+			return errors.Wrap(err, "validating dedup")
+		}
+	}
+
+	if s.Multiline != nil {
+		if err := s.Multiline.Validate(); err != nil {
+			return errors.Wrap(err, "validating multiline")
+		}
+	}
+
+	if s.Parser != nil {
+		if err := s.Parser.Validate(); err != nil {
+			return errors.Wrap(err, "validating parser")
+		}
+	}
+
+	if s.Correlation != nil {
+		if err := s.Correlation.Validate(); err != nil {
+			return errors.Wrap(err, "validating correlation")
+		}
+	}
+
+	if s.Enrichment != nil {
+		if err := s.Enrichment.Validate(); err != nil {
+			return errors.Wrap(err, "validating enrichment")
+		}
+	}
+
+	if s.Timestamps != nil {
+		if err := s.Timestamps.Validate(); err != nil {
+			return errors.Wrap(err, "validating timestamps")
+		}
+	}
+	return nil
+}
+
+// TimezoneOverride sets the timezone of the RFC 3164 messages received
+// by the listeners matching Listener, from the hosts matching
+// Hostname. Both are globs, and empty values match everything.
+type TimezoneOverride struct {
+	Listener string `toml:"listener"`
+	Hostname string `toml:"hostname"`
+	Timezone string `toml:"timezone"`
+}
+
+func (t *TimezoneOverride) Validate() error {
+	if t.Listener == "" && t.Hostname == "" {
+		return fmt.Errorf("either listener or hostname must be set")
+	}
+	if _, err := path.Match(t.Listener, ""); err != nil {
+		return errors.Wrapf(err, "invalid listener %q", t.Listener)
+	}
+	if _, err := path.Match(t.Hostname, ""); err != nil {
+		return errors.Wrapf(err, "invalid hostname %q", t.Hostname)
+	}
+	if _, err := time.LoadLocation(t.Timezone); err != nil {
+		return errors.Wrapf(err, "invalid timezone %q", t.Timezone)
+	}
+	return nil
+}
+
+// Timestamps holds the timestamp policy of received messages
+type Timestamps struct {
+	// Source selects the timestamp messages are stored with.
+	Source logging.TimestampSource `toml:"source"`
+	// Timezone is the timezone of RFC 3164 timestamps, which do not
+	// hold one. Defaults to UTC.
+	Timezone string `toml:"timezone"`
+	// MaxSkew is the maximum difference in seconds between the sender
+	// timestamp and the receive time. Messages with a larger skew are
+	// stored with their receive time. 0 means no limit.
+	MaxSkew int `toml:"max_skew"`
+	// Overrides are evaluated in order, and the first match wins.
+	Overrides []TimezoneOverride `toml:"overrides"`
+}
+
+// Policy returns the timestamp policy. t may be nil, in which case
+// the default policy is returned.
+func (t *Timestamps) Policy() (*logging.TimestampPolicy, error) {
+	if t == nil {
+		return logging.NewTimestampPolicy(logging.TimestampAuto, time.UTC, 0, nil), nil
+	}
+	location, err := time.LoadLocation(t.Timezone)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid timezone %q", t.Timezone)
+	}
+	overrides := []logging.TimezoneOverride{}
+	for _, override := range t.Overrides {
+		overrideLocation, err := time.LoadLocation(override.Timezone)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid timezone %q", override.Timezone)
+		}
+		overrides = append(overrides, logging.TimezoneOverride{
+			Listener: override.Listener,
+			Hostname: override.Hostname,
+			Location: overrideLocation,
+		})
+	}
+	maxSkew := time.Duration(t.MaxSkew) * time.Second
+	return logging.NewTimestampPolicy(t.Source, location, maxSkew, overrides), nil
+}
+
+func (t *Timestamps) Validate() error {
+	switch t.Source {
+	case "", logging.TimestampAuto, logging.TimestampSender, logging.TimestampReceiver:
+	default:
+		return fmt.Errorf("invalid source %q", t.Source)
+	}
+	if _, err := time.LoadLocation(t.Timezone); err != nil {
+		return errors.Wrapf(err, "invalid timezone %q", t.Timezone)
+	}
+	if t.MaxSkew < 0 {
+		return fmt.Errorf("invalid max_skew %d", t.MaxSkew)
+	}
+	for idx := range t.Overrides {
+		if err := t.Overrides[idx].Validate(); err != nil {
+			return errors.Wrapf(err, "validating timezone override %d", idx)
+		}
+	}
+	return nil
+}
+
+type LookupFormat string
+
+const (
+	LookupCSV  LookupFormat = "csv"
+	LookupJSON LookupFormat = "json"
+)
+
+const (
+	// ListenerTag is the tag holding the name of the listener that
+	// received a message.
+	ListenerTag = "listener"
+	// PeerAddressTag is the tag holding the address of the sender of
+	// a message.
+	PeerAddressTag = "peer_address"
+)
+
+// EnrichmentLookup holds the settings of a file mapping hostnames to
+// tags. CSV files have a header row; the column named "hostname"
+// holds the hostnames, and the other columns hold tag values. JSON
+// files hold an object mapping each hostname to an object of tags.
+type EnrichmentLookup struct {
+	Path string `toml:"path"`
+	// Format defaults to the file extension.
+	Format LookupFormat `toml:"format"`
+	// Tags are the tags read from the file. Other tags in the file
+	// are ignored.
+	Tags []string `toml:"tags"`
+}
+
+func (e *EnrichmentLookup) GetFormat() LookupFormat {
+	if e.Format != "" {
+		return e.Format
+	}
+	if strings.ToLower(filepath.Ext(e.Path)) == ".json" {
+		return LookupJSON
+	}
+	return LookupCSV
+}
+
+func (e *EnrichmentLookup) Validate() error {
+	if e.Path == "" {
+		return fmt.Errorf("missing path")
+	}
+	switch e.GetFormat() {
+	case LookupCSV, LookupJSON:
+	default:
+		return fmt.Errorf("invalid format %q", e.Format)
+	}
+	if len(e.Tags) == 0 {
+		return fmt.Errorf("missing tags")
+	}
+	for _, tag := range e.Tags {
+		if err := validateTagName(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Enrichment holds the tags attached to every message
+type Enrichment struct {
+	// Tags holds static tag values, such as the region or the
+	// deployment name, by tag name.
+	Tags map[string]string `toml:"tags"`
+	// Lookup maps the hostname of messages to tags.
+	Lookup *EnrichmentLookup `toml:"lookup"`
+	// AddListener adds the listener tag.
+	AddListener bool `toml:"add_listener"`
+	// AddPeerAddress adds the peer_address tag.
+	AddPeerAddress bool `toml:"add_peer_address"`
+}
+
+// GetTags returns the names of the tags that may be attached
+func (e *Enrichment) GetTags() []string {
+	if e == nil {
+		return nil
+	}
+	tags := []string{}
+	for tag := range e.Tags {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	if e.Lookup != nil {
+		tags = append(tags, e.Lookup.Tags...)
+	}
+	if e.AddListener {
+		tags = append(tags, ListenerTag)
+	}
+	if e.AddPeerAddress {
+		tags = append(tags, PeerAddressTag)
+	}
+	return tags
+}
+
+func (e *Enrichment) Validate() error {
+	for tag, val := range e.Tags {
+		if err := validateTagName(tag); err != nil {
+			return err
+		}
+		if val == "" {
+			return fmt.Errorf("missing value for tag %q", tag)
+		}
+	}
+	if e.Lookup != nil {
+		if err := e.Lookup.Validate(); err != nil {
+			return errors.Wrap(err, "validating lookup")
+		}
+	}
+	return nil
+}
+
+// CorrelationRule extracts a correlation ID, such as a task or
+// migration ID, from the messages of the apps matched by AppName.
+// Exactly one of StructuredData, Pattern and Field must be set.
+type CorrelationRule struct {
+	// Tag is the name of the tag the ID is stored in.
+	Tag string `toml:"tag"`
+	// AppName is a glob. An empty value matches all apps.
+	AppName string `toml:"app_name"`
+	// StructuredData is the name of an RFC 5424 structured data
+	// parameter holding the ID.
+	StructuredData string `toml:"structured_data"`
+	// Pattern is a regular expression matching the ID. If it has a
+	// group named "id", only that group is used.
+	Pattern string `toml:"pattern"`
+	// Field is the key of the JSON message field holding the ID.
+	Field string `toml:"field"`
+}
+
+func (c *CorrelationRule) Validate() error {
+	if err := validateTagName(c.Tag); err != nil {
+		return err
+	}
+	if _, err := path.Match(c.AppName, ""); err != nil {
+		return errors.Wrapf(err, "invalid app_name %q", c.AppName)
+	}
+	sources := 0
+	for _, val := range []string{c.StructuredData, c.Pattern, c.Field} {
+		if val != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("exactly one of structured_data, pattern and field must be set")
+	}
+	if _, err := regexp.Compile(c.Pattern); err != nil {
+		return errors.Wrapf(err, "invalid pattern %q", c.Pattern)
+	}
+	return nil
+}
+
+// Correlation holds the rules extracting correlation IDs from log
+// messages. For each tag, the first rule that finds an ID wins.
+type Correlation struct {
+	Rules []CorrelationRule `toml:"rules"`
+}
+
+// GetTags returns the distinct tags set by the rules, in order
+func (c *Correlation) GetTags() []string {
+	if c == nil {
+		return nil
+	}
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, rule := range c.Rules {
+		if !seen[rule.Tag] {
+			seen[rule.Tag] = true
+			tags = append(tags, rule.Tag)
+		}
+	}
+	return tags
+}
+
+func (c *Correlation) Validate() error {
+	for idx := range c.Rules {
+		if err := c.Rules[idx].Validate(); err != nil {
+			return errors.Wrapf(err, "validating correlation rule %d", idx)
+		}
+	}
+	return nil
+}
+
+type ParserFormat string
+
+const (
+	ParserJSON   ParserFormat = "json"
+	ParserLogfmt ParserFormat = "logfmt"
+)
+
+// tagNameRegex matches the keys that may be promoted to tags
+var tagNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// reservedTagNames are the names of the columns of stored messages,
+// which may not be used as tag names.
+var reservedTagNames = []string{
+	"time", "hostname", "severity", "facility", "message", "fields",
+	"sender_time", "received_time",
+}
+
+func validateTagName(name string) error {
+	if !tagNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid tag name %q", name)
+	}
+	for _, val := range reservedTagNames {
+		if name == val {
+			return fmt.Errorf("tag name %q is reserved", name)
+		}
+	}
+	return nil
+}
+
+// Parser holds the settings of the extraction of structured fields
+// from message bodies.
+type Parser struct {
+	// Formats are the formats tried, in order. Defaults to json and
+	// logfmt.
+	Formats []ParserFormat `toml:"formats"`
+	// Apps are globs selecting the apps whose messages are parsed.
+	// An empty list selects all apps.
+	Apps []string `toml:"apps"`
+	// Tags are the field keys stored as indexed tags.
+	Tags []string `toml:"tags"`
+}
+
+func (p *Parser) GetFormats() []ParserFormat {
+	if len(p.Formats) == 0 {
+		return []ParserFormat{ParserJSON, ParserLogfmt}
+	}
+	return p.Formats
+}
+
+func (p *Parser) Validate() error {
+	for _, format := range p.Formats {
+		switch format {
+		case ParserJSON, ParserLogfmt:
+		default:
+			return fmt.Errorf("invalid format %q", format)
+		}
+	}
+	for _, app := range p.Apps {
+		if _, err := path.Match(app, ""); err != nil {
+			return errors.Wrapf(err, "invalid app glob %q", app)
+		}
+	}
+	for _, tag := range p.Tags {
+		if err := validateTagName(tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	DefaultMultilineTimeout  = 2
+	DefaultMultilineMaxLines = 1000
+)
+
+// MultilineRule sets how the lines of multi-line messages are told
+// apart, for the apps matched by AppName. If Continuation is set,
+// lines matching it are joined to the previous lines, and Start may
+// restrict the lines that begin a multi-line message. Otherwise, each
+// line matching Start begins a new message, and all other lines are
+// joined to it.
+type MultilineRule struct {
+	// AppName is a glob. An empty value matches all apps.
+	AppName      string `toml:"app_name"`
+	Start        string `toml:"start"`
+	Continuation string `toml:"continuation"`
+}
+
+func (m *MultilineRule) Validate() error {
+	if _, err := path.Match(m.AppName, ""); err != nil {
+		return errors.Wrapf(err, "invalid app_name %q", m.AppName)
+	}
+	if m.Start == "" && m.Continuation == "" {
+		return fmt.Errorf("either start or continuation must be set")
+	}
+	if _, err := regexp.Compile(m.Start); err != nil {
+		return errors.Wrapf(err, "invalid start pattern %q", m.Start)
+	}
+	if _, err := regexp.Compile(m.Continuation); err != nil {
+		return errors.Wrapf(err, "invalid continuation pattern %q", m.Continuation)
+	}
+	return nil
+}
+
+// Multiline holds the settings of the reassembly of messages split
+// over several syslog messages. The first rule matching the app name
+// of a message applies.
+type Multiline struct {
+	// Timeout is the time in seconds after which a multi-line
+	// message that received no new line is logged.
+	Timeout int `toml:"timeout"`
+	// MaxLines is the maximum number of lines joined in a message.
+	MaxLines int             `toml:"max_lines"`
+	Rules    []MultilineRule `toml:"rules"`
+}
+
+func (m *Multiline) GetTimeout() time.Duration {
+	if m.Timeout <= 0 {
+		return DefaultMultilineTimeout * time.Second
+	}
+	return time.Duration(m.Timeout) * time.Second
+}
+
+func (m *Multiline) GetMaxLines() int {
+	if m.MaxLines <= 0 {
+		return DefaultMultilineMaxLines
+	}
+	return m.MaxLines
+}
+
+func (m *Multiline) Validate() error {
+	for idx := range m.Rules {
+		if err := m.Rules[idx].Validate(); err != nil {
+			return errors.Wrapf(err, "validating multiline rule %d", idx)
+		}
+	}
+	return nil
+}
+
+const DefaultDedupWindow = 30
+
+// DedupKeys are the message fields that may be used to tell apart the
+// streams in which repeated messages are collapsed.
+var DedupKeys = []string{"app_name", "hostname", "severity", "facility", "proc_id"}
+
+// Dedup holds the settings of the collapsing of repeated messages
+type Dedup struct {
+	// Window is the time in seconds during which repeated messages
+	// are collapsed.
+	Window int `toml:"window"`
+	// Keys are the fields of the stream of a message. Defaults to
+	// app_name, hostname and severity.
+	Keys []string `toml:"keys"`
+}
+
+func (d *Dedup) GetWindow() time.Duration {
+	if d.Window <= 0 {
+		return DefaultDedupWindow * time.Second
+	}
+	return time.Duration(d.Window) * time.Second
+}
+
+func (d *Dedup) GetKeys() []string {
+	if len(d.Keys) == 0 {
+		return []string{"app_name", "hostname", "severity"}
+	}
+	return d.Keys
+}
+
+func (d *Dedup) Validate() error {
+	for _, key := range d.Keys {
+		valid := false
+		for _, val := range DedupKeys {
+			if key == val {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("invalid key %q", key)
+		}
+	}
+	return nil
+}
+
+const DefaultRateLimitSummaryInterval = 60
+
+// RateLimitOverride sets the rate limit of the apps or hosts matched
+// by AppName or Hostname. Exactly one of them must be set.
+type RateLimitOverride struct {
+	AppName  string  `toml:"app_name"`
+	Hostname string  `toml:"hostname"`
+	Rate     float64 `toml:"rate"`
+	Burst    int     `toml:"burst"`
+}
+
+func (r *RateLimitOverride) Validate() error {
+	if (r.AppName == "") == (r.Hostname == "") {
+		return fmt.Errorf("overrides must set either app_name or hostname")
+	}
+	if _, err := path.Match(r.AppName, ""); err != nil {
+		return errors.Wrapf(err, "invalid app_name %q", r.AppName)
+	}
+	if _, err := path.Match(r.Hostname, ""); err != nil {
+		return errors.Wrapf(err, "invalid hostname %q", r.Hostname)
+	}
+	if r.Rate < 0 || r.Burst < 0 {
+		return fmt.Errorf("invalid rate limit")
+	}
+	return nil
+}
+
+// RateLimit holds the token bucket rate limits applied to each app
+// and each host. Rates are in messages per second, and a rate of 0
+// means no limit. Burst defaults to the rate.
+type RateLimit struct {
+	AppRate   float64 `toml:"app_rate"`
+	AppBurst  int     `toml:"app_burst"`
+	HostRate  float64 `toml:"host_rate"`
+	HostBurst int     `toml:"host_burst"`
+	// SummaryInterval is the interval in seconds at which summaries
+	// of suppressed messages are logged.
+	SummaryInterval int                 `toml:"summary_interval"`
+	Overrides       []RateLimitOverride `toml:"overrides"`
+}
+
+func (r *RateLimit) GetSummaryInterval() time.Duration {
+	if r.SummaryInterval <= 0 {
+		return DefaultRateLimitSummaryInterval * time.Second
+	}
+	return time.Duration(r.SummaryInterval) * time.Second
+}
+
+func (r *RateLimit) Validate() error {
+	if r.AppRate < 0 || r.AppBurst < 0 || r.HostRate < 0 || r.HostBurst < 0 {
+		return fmt.Errorf("invalid rate limit")
+	}
+	for idx := range r.Overrides {
+		if err := r.Overrides[idx].Validate(); err != nil {
+			return errors.Wrapf(err, "validating override %d", idx)
+		}
+	}
+	return nil
+}
+
+// RedactionMode is how secrets found in log messages are replaced
+type RedactionMode string
+
+const (
+	// RedactMask replaces secrets with a fixed mask.
+	RedactMask RedactionMode = "mask"
+	// RedactHash replaces secrets with a keyed hash, so that
+	// messages holding the same secret can still be correlated.
+	RedactHash RedactionMode = "hash"
+
+	DefaultRedactionMask = "[REDACTED]"
+)
+
+// RedactionRule is a custom pattern of secrets to redact
+type RedactionRule struct {
+	Name string `toml:"name"`
+	// Pattern is a regular expression. If it has a group named
+	// "secret", only that group is replaced.
+	Pattern string `toml:"pattern"`
+}
+
+func (r *RedactionRule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("missing name")
+	}
+	if r.Pattern == "" {
+		return fmt.Errorf("missing pattern")
+	}
+	if _, err := regexp.Compile(r.Pattern); err != nil {
+		return errors.Wrapf(err, "invalid pattern %q", r.Pattern)
+	}
+	return nil
+}
+
+// Redaction holds the settings of the redaction of secrets from log
+// messages, before they are handed to any writer. Built-in rules are
+// enabled unless listed in DisableBuiltins.
+type Redaction struct {
+	Disabled        bool            `toml:"disabled"`
+	DisableBuiltins []string        `toml:"disable_builtins"`
+	Mode            RedactionMode   `toml:"mode"`
+	Mask            string          `toml:"mask"`
+	HashKey         string          `toml:"hash_key"`
+	Rules           []RedactionRule `toml:"rules"`
+}
+
+// GetMode returns the redaction mode. It is safe to call on a nil
+// Redaction.
+func (r *Redaction) GetMode() RedactionMode {
+	if r == nil || r.Mode == "" {
+		return RedactMask
+	}
+	return r.Mode
+}
+
+// GetMask returns the mask that replaces secrets. It is safe to call
+// on a nil Redaction.
+func (r *Redaction) GetMask() string {
+	if r == nil || r.Mask == "" {
+		return DefaultRedactionMask
+	}
+	return r.Mask
+}
+
+func (r *Redaction) Validate() error {
+	switch r.GetMode() {
+	case RedactMask:
+	case RedactHash:
+		if r.HashKey == "" {
+			return fmt.Errorf("missing hash_key")
+		}
+	default:
+		return fmt.Errorf("invalid mode %q", r.Mode)
+	}
+	names := map[string]bool{}
+	for idx := range r.Rules {
+		if err := r.Rules[idx].Validate(); err != nil {
+			return errors.Wrapf(err, "validating redaction rule %d", idx)
+		}
+		if names[r.Rules[idx].Name] {
+			return fmt.Errorf("duplicate redaction rule %q", r.Rules[idx].Name)
+		}
+		names[r.Rules[idx].Name] = true
+	}
+	return nil
+}
+
+// WriterOverflowPolicy is the action taken when the queue of a log
+// writer is full.
+type WriterOverflowPolicy string
+
+const (
+	// WriterOverflowBlock blocks ingestion until the writer catches up.
+	WriterOverflowBlock WriterOverflowPolicy = "block"
+	// WriterOverflowDrop drops new messages.
+	WriterOverflowDrop WriterOverflowPolicy = "drop"
+	// WriterOverflowSpill appends new messages to a file on disk, and
+	// replays them once the writer catches up.
+	WriterOverflowSpill WriterOverflowPolicy = "spill"
+
+	// Names of the log writers, used as keys of Pipeline.Writers.
+	DatastoreWriter = "datastore"
+	StdOutWriter    = "stdout"
+	WebsocketWriter = "websocket"
+
+	DefaultWriterQueueSize = 10000
+)
+
+// WriterQueue holds the queue settings of a log writer. Zero values
+// are inherited from the pipeline defaults.
+type WriterQueue struct {
+	// QueueSize is the number of messages queued in memory.
+	QueueSize      int                  `toml:"queue_size"`
+	OverflowPolicy WriterOverflowPolicy `toml:"overflow_policy"`
+	// SpillDir is the directory holding spill files, if the
+	// overflow policy is spill.
+	SpillDir string `toml:"spill_dir"`
+	// MaxSpillSize limits the size of the spill file. Messages
+	// that do not fit are dropped. An empty value means no limit.
+	MaxSpillSize string `toml:"max_spill_size"`
+}
+
+func (w *WriterQueue) GetQueueSize() int {
+	if w.QueueSize <= 0 {
+		return DefaultWriterQueueSize
+	}
+	return w.QueueSize
+}
+
+func (w *WriterQueue) GetOverflowPolicy() WriterOverflowPolicy {
+	if w.OverflowPolicy == "" {
+		return WriterOverflowBlock
+	}
+	return w.OverflowPolicy
+}
+
+// GetMaxSpillSize returns the spill file size limit in bytes, or 0
+// if there is no limit.
+func (w *WriterQueue) GetMaxSpillSize() int64 {
+	// Validated when loading the config.
+	size, _ := ParseSize(w.MaxSpillSize)
+	return size
+}
+
+func (w *WriterQueue) Validate() error {
+	if w.QueueSize < 0 {
+		return fmt.Errorf("invalid queue_size %d", w.QueueSize)
+	}
+	switch w.GetOverflowPolicy() {
+	case WriterOverflowBlock, WriterOverflowDrop:
+	case WriterOverflowSpill:
+		if w.SpillDir == "" {
+			return fmt.Errorf("missing spill_dir")
+		}
+		if !filepath.IsAbs(w.SpillDir) {
+			return fmt.Errorf("spill_dir must be absolute")
+		}
+	default:
+		return fmt.Errorf("invalid overflow_policy %q", w.OverflowPolicy)
+	}
+	if _, err := ParseSize(w.MaxSpillSize); err != nil {
+		return errors.Wrap(err, "validating max_spill_size")
+	}
+	return nil
+}
+
+// Pipeline holds the settings of the queues that decouple log writers
+// from ingestion. Each writer gets its own queue, using the settings
+// in Writers, or the defaults set in the pipeline section.
+type Pipeline struct {
+	WriterQueue
+	Writers map[string]WriterQueue `toml:"writers"`
+}
+
+// WriterConfig returns the queue settings of the named writer. It
+// is safe to call on a nil Pipeline.
+func (p *Pipeline) WriterConfig(name string) WriterQueue {
+	if p == nil {
+		return WriterQueue{}
+	}
+	cfg := p.WriterQueue
+	override, ok := p.Writers[name]
+	if !ok {
+		return cfg
+	}
+	if override.QueueSize != 0 {
+		cfg.QueueSize = override.QueueSize
+	}
+	if override.OverflowPolicy != "" {
+		cfg.OverflowPolicy = override.OverflowPolicy
+	}
+	if override.SpillDir != "" {
+		cfg.SpillDir = override.SpillDir
+	}
+	if override.MaxSpillSize != "" {
+		cfg.MaxSpillSize = override.MaxSpillSize
+	}
+	return cfg
+}
+
+func validateWriterName(name string) error {
+	switch name {
+	case DatastoreWriter, StdOutWriter, WebsocketWriter:
+		return nil
+	default:
+		return fmt.Errorf("unknown writer %q", name)
+	}
+}
+
+func (p *Pipeline) Validate() error {
+	for name := range p.Writers {
+		if err := validateWriterName(name); err != nil {
+			return err
+		}
+	}
+	for _, name := range []string{DatastoreWriter, StdOutWriter, WebsocketWriter} {
+		cfg := p.WriterConfig(name)
+		if err := cfg.Validate(); err != nil {
+			return errors.Wrapf(err, "validating %s writer queue", name)
+		}
+	}
+	return nil
+}
+
+// RoutingRule sends the messages it matches to a set of writers, or
+// drops them. Empty match fields match all messages.
+type RoutingRule struct {
+	// AppName and Hostname are globs.
+	AppName    string `toml:"app_name"`
+	Hostname   string `toml:"hostname"`
+	Facilities []int  `toml:"facilities"`
+	Severities []int  `toml:"severities"`
+	// Message is a regular expression.
+	Message string   `toml:"message"`
+	Writers []string `toml:"writers"`
+	Drop    bool     `toml:"drop"`
+}
+
+func (r *RoutingRule) Validate() error {
+	if _, err := path.Match(r.AppName, ""); err != nil {
+		return errors.Wrapf(err, "invalid app_name %q", r.AppName)
+	}
+	if _, err := path.Match(r.Hostname, ""); err != nil {
+		return errors.Wrapf(err, "invalid hostname %q", r.Hostname)
+	}
+	for _, val := range r.Facilities {
+		if val < 0 || val > int(logging.LocalUse7) {
+			return fmt.Errorf("invalid facility %d", val)
+		}
+	}
+	for _, val := range r.Severities {
+		if val < 0 || val > 7 {
+			return fmt.Errorf("invalid severity %d", val)
+		}
+	}
+	if _, err := regexp.Compile(r.Message); err != nil {
+		return errors.Wrapf(err, "invalid message pattern %q", r.Message)
+	}
+	if r.Drop == (len(r.Writers) > 0) {
+		return fmt.Errorf("rules must either set writers or drop")
+	}
+	for _, name := range r.Writers {
+		if err := validateWriterName(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Routing decides which writers get each message. Rules are evaluated
+// in order, and the first rule that matches a message wins. Messages
+// that match no rule are sent to DefaultWriters, or to all writers if
+// it is empty.
+type Routing struct {
+	Rules          []RoutingRule `toml:"rules"`
+	DefaultWriters []string      `toml:"default_writers"`
+}
+
+func (r *Routing) Validate() error {
+	for _, name := range r.DefaultWriters {
+		if err := validateWriterName(name); err != nil {
+			return errors.Wrap(err, "validating default_writers")
+		}
+	}
+	for idx := range r.Rules {
+		if err := r.Rules[idx].Validate(); err != nil {
+			return errors.Wrapf(err, "validating routing rule %d", idx)
+		}
+	}
+	return nil
+}
+
+// UsesWriter returns true if any rule, or the default writers, name
+// the supplied writer.
+func (r *Routing) UsesWriter(name string) bool {
+	if r == nil {
+		return false
+	}
+	for _, val := range r.DefaultWriters {
+		if val == name {
+			return true
+		}
+	}
+	for _, rule := range r.Rules {
+		for _, val := range rule.Writers {
+			if val == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParseRetentionPeriod parses a retention period expressed as a
+// number of hours ("36h") or days ("90d").
+func ParseRetentionPeriod(period string) (time.Duration, error) {
+	if len(period) < 2 {
+		return 0, fmt.Errorf("invalid retention period %q", period)
+	}
+	var unit time.Duration
+	switch period[len(period)-1] {
+	case 'h':
+		unit = time.Hour
+	case 'd':
+		unit = 24 * time.Hour
+	default:
+		return 0, fmt.Errorf("invalid retention period %q", period)
+	}
+	val, err := strconv.Atoi(period[:len(period)-1])
+	if err != nil || val < 1 {
+		return 0, fmt.Errorf("invalid retention period %q", period)
+	}
+	return time.Duration(val) * unit, nil
+}
+
+// RetentionRule sets the retention period for logs whose name matches
+// AppName. If Severities is set, the rule only applies to messages
+// with those severity levels.
+type RetentionRule struct {
+	AppName    string `toml:"app_name"`
+	Severities []int  `toml:"severities"`
+	Period     string `toml:"period"`
+}
+
+func (r *RetentionRule) Validate() error {
+	if r.AppName == "" {
+		return fmt.Errorf("missing app_name")
+	}
+	if _, err := path.Match(r.AppName, ""); err != nil {
+		return errors.Wrapf(err, "invalid app_name %q", r.AppName)
+	}
+	for _, val := range r.Severities {
+		if val < 0 || val > 7 {
+			return fmt.Errorf("invalid severity %d", val)
+		}
+	}
+	if _, err := ParseRetentionPeriod(r.Period); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Retention holds the log retention policy. Rules are evaluated in
+// order, and the first rule that matches a log and severity wins.
+type Retention struct {
+	DefaultPeriod string          `toml:"default_period"`
+	DryRun        bool            `toml:"dry_run"`
+	Rules         []RetentionRule `toml:"rules"`
+}
+
+func (r *Retention) Validate() error {
+	if r.DefaultPeriod != "" {
+		if _, err := ParseRetentionPeriod(r.DefaultPeriod); err != nil {
+			return errors.Wrap(err, "validating default_period")
+		}
+	}
+	for idx := range r.Rules {
+		if err := r.Rules[idx].Validate(); err != nil {
+			return errors.Wrapf(err, "validating retention rule %d", idx)
+		}
+	}
+	return nil
+}
+
+var sizeUnits = map[string]int64{
+	"B":  1,
+	"KB": 1 << 10,
+	"MB": 1 << 20,
+	"GB": 1 << 30,
+	"TB": 1 << 40,
+}
+
+// ParseSize parses a size in bytes, optionally followed by one of
+// the B, KB, MB, GB or TB units ("500MB"). Units are powers of 1024.
+// An empty string is parsed as 0.
+func ParseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	if size == "" {
+		return 0, nil
+	}
+	idx := strings.IndexFunc(size, func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+	unit := int64(1)
+	if idx >= 0 {
+		var ok bool
+		unit, ok = sizeUnits[strings.TrimSpace(size[idx:])]
+		if !ok {
+			return 0, fmt.Errorf("invalid size %q", size)
+		}
+		size = size[:idx]
+	}
+	val, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || val < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return val * unit, nil
+}
+
+// QuotaRule overrides the per log quota for logs whose name
+// matches AppName. A zero value means no limit.
+type QuotaRule struct {
+	AppName     string `toml:"app_name"`
+	MaxMessages int64  `toml:"max_messages"`
+	MaxSize     string `toml:"max_size"`
+}
+
+func (q *QuotaRule) Validate() error {
+	if q.AppName == "" {
+		return fmt.Errorf("missing app_name")
+	}
+	if _, err := path.Match(q.AppName, ""); err != nil {
+		return errors.Wrapf(err, "invalid app_name %q", q.AppName)
+	}
+	if q.MaxMessages < 0 {
+		return fmt.Errorf("invalid max_messages %d", q.MaxMessages)
+	}
+	if _, err := ParseSize(q.MaxSize); err != nil {
+		return errors.Wrap(err, "validating max_size")
+	}
+	return nil
+}
+
+// Quota limits the storage used by logs. When a quota is exceeded,
+// the oldest messages are deleted first. A zero value means no limit.
+type Quota struct {
+	// MaxMessages and MaxSize limit the storage used by all logs.
+	MaxMessages int64  `toml:"max_messages"`
+	MaxSize     string `toml:"max_size"`
+	// LogMaxMessages and LogMaxSize limit the storage used by any
+	// single log not matched by a rule.
+	LogMaxMessages int64       `toml:"log_max_messages"`
+	LogMaxSize     string      `toml:"log_max_size"`
+	Rules          []QuotaRule `toml:"rules"`
+}
+
+func (q *Quota) Validate() error {
+	if q.MaxMessages < 0 || q.LogMaxMessages < 0 {
+		return fmt.Errorf("invalid message limit")
+	}
+	if _, err := ParseSize(q.MaxSize); err != nil {
+		return errors.Wrap(err, "validating max_size")
+	}
+	if _, err := ParseSize(q.LogMaxSize); err != nil {
+		return errors.Wrap(err, "validating log_max_size")
+	}
+	for idx := range q.Rules {
+		if err := q.Rules[idx].Validate(); err != nil {
+			return errors.Wrapf(err, "validating quota rule %d", idx)
+		}
+	}
+	return nil
+}
+
+// ArchiveBackendType represents the storage used for log archives
+type ArchiveBackendType string
+
+const (
+	LocalArchiveBackend ArchiveBackendType = "local"
+	S3ArchiveBackend    ArchiveBackendType = "s3"
+
+	DefaultArchiveChunkSize = 100000
+)
+
+// S3Archive holds the settings for an S3 compatible archive bucket
+type S3Archive struct {
+	Endpoint  string `toml:"endpoint"`
+	Region    string `toml:"region"`
+	Bucket    string `toml:"bucket"`
+	Prefix    string `toml:"prefix"`
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+}
+
+func (s *S3Archive) Validate() error {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("invalid s3 endpoint %q", s.Endpoint)
+	}
+	if s.Bucket == "" {
+		return fmt.Errorf("missing s3 bucket")
+	}
+	if s.AccessKey == "" || s.SecretKey == "" {
+		return fmt.Errorf("missing s3 credentials")
+	}
+	return nil
+}
+
+// Archive holds the settings for archiving logs before they are
+// deleted by the retention policy
+type Archive struct {
+	Backend ArchiveBackendType `toml:"backend"`
+	// Path is the archive directory used by the local backend
+	Path string `toml:"path"`
+	// ChunkSize is the maximum number of messages in an archive file
+	ChunkSize int        `toml:"chunk_size"`
+	S3        *S3Archive `toml:"s3"`
+}
+
+func (a *Archive) GetChunkSize() int {
+	if a.ChunkSize <= 0 {
+		return DefaultArchiveChunkSize
+	}
+	return a.ChunkSize
+}
+
+func (a *Archive) Validate() error {
+	switch a.Backend {
+	case LocalArchiveBackend:
+		if a.Path == "" {
+			return fmt.Errorf("missing archive path")
+		}
+		if !filepath.IsAbs(a.Path) {
+			return fmt.Errorf("archive path must be absolute")
+		}
+	case S3ArchiveBackend:
+		if a.S3 == nil {
+			return fmt.Errorf("no s3 config found")
+		}
+		if err := a.S3.Validate(); err != nil {
+			return errors.Wrap(err, "validating s3 config")
+		}
+	default:
+		return fmt.Errorf("invalid archive backend %q", a.Backend)
+	}
 	return nil
 }
 
@@ -237,6 +1525,13 @@ func (i InfluxURL) IsValid() bool {
 	return true
 }
 
+// Redacted returns the URL with any password it embeds, either in
+// the user info or in the "p" query parameter, replaced by a
+// placeholder.
+func (i InfluxURL) Redacted() InfluxURL {
+	return InfluxURL(redactURL(string(i)))
+}
+
 func (i InfluxURL) IsSSL() bool {
 	url, err := url.Parse(string(i))
 	if err != nil {
@@ -319,6 +1614,68 @@ type Config struct {
 	Syslog    Syslog
 }
 
+// redactedValue replaces secrets in redacted configs
+const redactedValue = "********"
+
+func redact(val string) string {
+	if val == "" {
+		return ""
+	}
+	return redactedValue
+}
+
+// redactURL replaces the password embedded in a URL, if any. URLs
+// that cannot be parsed are redacted entirely.
+func redactURL(val string) string {
+	parsed, err := url.Parse(val)
+	if err != nil {
+		return redact(val)
+	}
+	if parsed.User != nil {
+		if _, ok := parsed.User.Password(); ok {
+			parsed.User = url.UserPassword(parsed.User.Username(), redactedValue)
+		}
+	}
+	if query := parsed.Query(); query.Get("p") != "" {
+		query.Set("p", redactedValue)
+		parsed.RawQuery = query.Encode()
+	}
+	return parsed.String()
+}
+
+// Redacted returns a copy of the config with all credentials
+// replaced by a placeholder, suitable for inclusion in reports.
+func (c *Config) Redacted() *Config {
+	ret := *c
+	if c.APIServer.KeystoneAuth != nil {
+		keystone := *c.APIServer.KeystoneAuth
+		keystone.AuthURI = redactURL(keystone.AuthURI)
+		ret.APIServer.KeystoneAuth = &keystone
+	}
+	if c.Syslog.InfluxDB != nil {
+		influx := *c.Syslog.InfluxDB
+		influx.URL = influx.URL.Redacted()
+		influx.Password = redact(influx.Password)
+		ret.Syslog.InfluxDB = &influx
+	}
+	if c.Syslog.Archive != nil {
+		archive := *c.Syslog.Archive
+		if archive.S3 != nil {
+			s3 := *archive.S3
+			s3.AccessKey = redact(s3.AccessKey)
+			s3.SecretKey = redact(s3.SecretKey)
+			archive.S3 = &s3
+		}
+		ret.Syslog.Archive = &archive
+	}
+	if c.Syslog.Redaction != nil {
+		redaction := *c.Syslog.Redaction
+		redaction.HashKey = redact(redaction.HashKey)
+		ret.Syslog.Redaction = &redaction
+	}
+	return &ret
+}
+
 func (c *Config) Validate() error {
 	if err := c.APIServer.Validate(); err != nil {
 		return err
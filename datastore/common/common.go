@@ -15,22 +15,72 @@
 package common
 
 import (
+	"errors"
 	"time"
 
 	"coriolis-logger/logging"
 	"coriolis-logger/params"
 	"coriolis-logger/worker"
-	client "github.com/influxdata/influxdb1-client/v2"
 )
 
+// ErrInvalidFilter is returned, wrapped, by datastores when the filter
+// of a query cannot be applied.
+var ErrInvalidFilter = errors.New("invalid filter")
+
 type DataStore interface {
 	worker.SimpleWorker
 
 	Write(logMsg logging.LogMessage) error
-	Rotate(olderThan time.Time) error
-	ResultReader(p params.QueryParams) Reader
-	List() ([]map[string]string, error)
-	Query(q client.Query) (*client.ChunkedResponse, error)
+	// Delete removes all log messages matching the supplied
+	// parameters. Datastores may refuse filters they cannot
+	// apply efficiently to deletes.
+	Delete(p params.QueryParams) error
+	// Count returns the number of log messages matching the
+	// supplied parameters.
+	Count(p params.QueryParams) (int64, error)
+	// List returns the logs in the datastore, along with their
+	// storage usage and a summary of their contents.
+	List(p params.ListParams) ([]LogInfo, error)
+	// Histogram returns the number of messages matching the supplied
+	// parameters, grouped by time interval. Both the start and end
+	// dates must be set.
+	Histogram(p params.QueryParams, interval time.Duration) ([]HistogramBucket, error)
+	// Query returns an iterator over all log messages matching
+	// the supplied parameters, in ascending time order.
+	Query(p params.QueryParams) (Iterator, error)
+}
+
+// LogInfo describes a log held by a datastore
+type LogInfo struct {
+	Name string `json:"log_name"`
+	// Messages is the number of messages in the log.
+	Messages int64 `json:"messages"`
+	// Size is the storage used by the log, in bytes. Datastores that
+	// cannot measure it directly may return an estimate.
+	Size int64 `json:"size_bytes"`
+	// FirstTimestamp and LastTimestamp are the timestamps of the
+	// oldest and newest messages in the log.
+	FirstTimestamp time.Time `json:"first_timestamp"`
+	LastTimestamp  time.Time `json:"last_timestamp"`
+	// Hostnames holds the distinct hostnames that sent messages
+	// to this log.
+	Hostnames []string `json:"hostnames"`
+	// Severities holds the number of messages for each severity
+	// level present in the log.
+	Severities map[string]int64 `json:"severities"`
+}
+
+// Iterator streams log messages from a datastore. Callers must
+// call Close once they are done with the iterator.
+type Iterator interface {
+	// Next advances the iterator to the next message. It returns
+	// false when there are no more messages or an error occurred.
+	Next() bool
+	// Message returns the current message.
+	Message() logging.LogMessage
+	// Err returns the error, if any, that stopped the iteration.
+	Err() error
+	Close() error
 }
 
 type Reader interface {
@@ -0,0 +1,143 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"coriolis-logger/params"
+
+	"github.com/pkg/errors"
+)
+
+// MaxHistogramBuckets is the maximum number of buckets a histogram
+// may span.
+const MaxHistogramBuckets = 10000
+
+// HistogramBucket holds message counts for a single time interval
+type HistogramBucket struct {
+	Start      time.Time        `json:"start"`
+	Total      int64            `json:"total"`
+	Severities map[string]int64 `json:"severities"`
+	Hostnames  map[string]int64 `json:"hostnames"`
+}
+
+// NewHistogramBucket returns an empty bucket starting at start
+func NewHistogramBucket(start time.Time) *HistogramBucket {
+	return &HistogramBucket{
+		Start:      start,
+		Severities: map[string]int64{},
+		Hostnames:  map[string]int64{},
+	}
+}
+
+// Add adds count messages with the supplied severity and hostname to
+// the bucket.
+func (h *HistogramBucket) Add(severity, hostname string, count int64) {
+	h.Total += count
+	h.Severities[severity] += count
+	h.Hostnames[hostname] += count
+}
+
+// BucketStart returns the start of the bucket holding stamp. Buckets
+// are aligned to the unix epoch.
+func BucketStart(stamp time.Time, interval time.Duration) time.Time {
+	nanos := stamp.UnixNano()
+	offset := nanos % int64(interval)
+	if offset < 0 {
+		offset += int64(interval)
+	}
+	return time.Unix(0, nanos-offset).UTC()
+}
+
+// ValidateHistogramParams checks that a histogram over the time range
+// in p, using the supplied interval, is bounded and not too large.
+func ValidateHistogramParams(p params.QueryParams, interval time.Duration) error {
+	if interval < time.Second || interval%time.Second != 0 {
+		return fmt.Errorf("interval must be a whole number of seconds")
+	}
+	if p.StartDate.IsZero() || p.EndDate.IsZero() {
+		return fmt.Errorf("histograms require a start and end date")
+	}
+	if p.EndDate.Before(p.StartDate) {
+		return fmt.Errorf("end date is before start date")
+	}
+	if p.EndDate.Sub(p.StartDate)/interval >= MaxHistogramBuckets {
+		return fmt.Errorf("histogram exceeds %d buckets", MaxHistogramBuckets)
+	}
+	return nil
+}
+
+// FillHistogram returns one bucket for every interval between the
+// start and end dates in p, using the counts in buckets.
+func FillHistogram(buckets map[int64]*HistogramBucket, p params.QueryParams, interval time.Duration) []HistogramBucket {
+	ret := []HistogramBucket{}
+	for start := BucketStart(p.StartDate, interval); !start.After(p.EndDate); start = start.Add(interval) {
+		if bucket, ok := buckets[start.UnixNano()]; ok {
+			ret = append(ret, *bucket)
+			continue
+		}
+		ret = append(ret, *NewHistogramBucket(start))
+	}
+	// Buckets outside of the time range should not happen, but we
+	// keep them rather than silently dropping counts.
+	if len(ret) > 0 {
+		first, last := ret[0].Start, ret[len(ret)-1].Start
+		for _, bucket := range buckets {
+			if bucket.Start.Before(first) || bucket.Start.After(last) {
+				ret = append(ret, *bucket)
+			}
+		}
+		sort.Slice(ret, func(i, j int) bool {
+			return ret[i].Start.Before(ret[j].Start)
+		})
+	}
+	return ret
+}
+
+// ComputeHistogram builds a histogram by reading every message from
+// store. Datastores that cannot aggregate messages natively may use
+// it to implement Histogram.
+func ComputeHistogram(store DataStore, p params.QueryParams, interval time.Duration) ([]HistogramBucket, error) {
+	if err := ValidateHistogramParams(p, interval); err != nil {
+		return nil, err
+	}
+	iterator, err := store.Query(p)
+	if err != nil {
+		return nil, errors.Wrap(err, "querying logs")
+	}
+	defer iterator.Close()
+
+	buckets := map[int64]*HistogramBucket{}
+	for iterator.Next() {
+		msg := iterator.Message()
+		start := BucketStart(msg.Timestamp, interval)
+		bucket, ok := buckets[start.UnixNano()]
+		if !ok {
+			bucket = NewHistogramBucket(start)
+			buckets[start.UnixNano()] = bucket
+		}
+		// Severities are keyed by number, like in the datastores
+		// that aggregate natively.
+		bucket.Add(strconv.Itoa(int(msg.Severity)), msg.Hostname, 1)
+	}
+	if err := iterator.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading logs")
+	}
+	return FillHistogram(buckets, p, interval), nil
+}
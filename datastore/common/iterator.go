@@ -0,0 +1,95 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package common
+
+import (
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+// NewSliceIterator returns an iterator over a slice of messages
+func NewSliceIterator(msgs []logging.LogMessage) Iterator {
+	return &sliceIterator{
+		msgs: msgs,
+		idx:  -1,
+	}
+}
+
+type sliceIterator struct {
+	msgs []logging.LogMessage
+	idx  int
+}
+
+func (s *sliceIterator) Next() bool {
+	if s.idx+1 >= len(s.msgs) {
+		s.idx = len(s.msgs)
+		return false
+	}
+	s.idx++
+	return true
+}
+
+func (s *sliceIterator) Message() logging.LogMessage {
+	return s.msgs[s.idx]
+}
+
+func (s *sliceIterator) Err() error {
+	return nil
+}
+
+func (s *sliceIterator) Close() error {
+	return nil
+}
+
+// NewPagedIterator applies the cursor and limit in p to an iterator
+// that returns messages in the order requested by p, starting at the
+// cursor timestamp. Messages the cursor marks as read are skipped,
+// and iteration stops once Limit messages have been returned.
+func NewPagedIterator(it Iterator, p params.QueryParams) Iterator {
+	paged := &pagedIterator{
+		Iterator: it,
+		limit:    p.Limit,
+	}
+	if p.Cursor != nil {
+		paged.cursor = *p.Cursor
+		paged.skip = p.Cursor.Skip
+	}
+	return paged
+}
+
+type pagedIterator struct {
+	Iterator
+
+	cursor   params.Cursor
+	skip     int
+	limit    int
+	returned int
+}
+
+func (p *pagedIterator) Next() bool {
+	if p.limit > 0 && p.returned >= p.limit {
+		return false
+	}
+	for p.Iterator.Next() {
+		if p.skip > 0 && p.Iterator.Message().Timestamp.Equal(p.cursor.Timestamp) {
+			p.skip--
+			continue
+		}
+		p.skip = 0
+		p.returned++
+		return true
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package common
+
+import (
+	"testing"
+	"time"
+
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+// queryPage returns a page of msgs, which are sorted in the order
+// requested by p, resuming from the cursor the way datastores do.
+func queryPage(msgs []logging.LogMessage, p params.QueryParams) []logging.LogMessage {
+	matched := []logging.LogMessage{}
+	for _, msg := range msgs {
+		if p.Cursor != nil {
+			if p.Descending && msg.Timestamp.After(p.Cursor.Timestamp) {
+				continue
+			}
+			if !p.Descending && msg.Timestamp.Before(p.Cursor.Timestamp) {
+				continue
+			}
+		}
+		matched = append(matched, msg)
+	}
+	it := NewPagedIterator(NewSliceIterator(matched), p)
+	page := []logging.LogMessage{}
+	for it.Next() {
+		page = append(page, it.Message())
+	}
+	return page
+}
+
+func TestPagedIterator(t *testing.T) {
+	base := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		seconds []int
+	}{
+		{"distinct timestamps", []int{0, 1, 2, 3, 4, 5, 6}},
+		{"shared timestamps across pages", []int{0, 1, 1, 1, 1, 2, 3, 3, 4}},
+		{"pages of a single timestamp", []int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0}},
+		{"empty log", nil},
+	}
+	for _, tt := range tests {
+		for _, descending := range []bool{false, true} {
+			name := tt.name
+			if descending {
+				name += " descending"
+			}
+			t.Run(name, func(t *testing.T) {
+				msgs := []logging.LogMessage{}
+				for idx, s := range tt.seconds {
+					msgs = append(msgs, logging.LogMessage{
+						Timestamp: base.Add(time.Duration(s) * time.Second),
+						ProcID:    idx,
+					})
+				}
+				if descending {
+					for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+						msgs[i], msgs[j] = msgs[j], msgs[i]
+					}
+				}
+
+				var cursor *params.Cursor
+				read := []int{}
+				for pages := 0; ; pages++ {
+					if pages > len(msgs)+1 {
+						t.Fatalf("paging does not end, read %v", read)
+					}
+					page := queryPage(msgs, params.QueryParams{
+						Limit:      3,
+						Descending: descending,
+						Cursor:     cursor,
+					})
+					if len(page) == 0 {
+						break
+					}
+					timestamps := []time.Time{}
+					for _, msg := range page {
+						read = append(read, msg.ProcID)
+						timestamps = append(timestamps, msg.Timestamp)
+					}
+					next := params.Advance(cursor, timestamps, descending)
+					cursor = &next
+				}
+
+				if len(read) != len(msgs) {
+					t.Fatalf("read messages %v, want %d", read, len(msgs))
+				}
+				for idx, msg := range msgs {
+					if read[idx] != msg.ProcID {
+						t.Fatalf("read messages %v out of order", read)
+					}
+				}
+			})
+		}
+	}
+}
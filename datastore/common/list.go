@@ -0,0 +1,87 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package common
+
+import (
+	"fmt"
+	"sort"
+
+	"coriolis-logger/params"
+)
+
+const (
+	SortByName           = "log_name"
+	SortByFirstTimestamp = "first_timestamp"
+	SortByLastTimestamp  = "last_timestamp"
+	SortByMessages       = "messages"
+	SortBySize           = "size_bytes"
+)
+
+var logInfoLess = map[string]func(a, b LogInfo) bool{
+	SortByName: func(a, b LogInfo) bool {
+		return a.Name < b.Name
+	},
+	SortByFirstTimestamp: func(a, b LogInfo) bool {
+		return a.FirstTimestamp.Before(b.FirstTimestamp)
+	},
+	SortByLastTimestamp: func(a, b LogInfo) bool {
+		return a.LastTimestamp.Before(b.LastTimestamp)
+	},
+	SortByMessages: func(a, b LogInfo) bool {
+		return a.Messages < b.Messages
+	},
+	SortBySize: func(a, b LogInfo) bool {
+		return a.Size < b.Size
+	},
+}
+
+// ValidateListParams checks that the list parameters are supported.
+func ValidateListParams(p params.ListParams) error {
+	if p.SortBy == "" {
+		return nil
+	}
+	if _, ok := logInfoLess[p.SortBy]; !ok {
+		return fmt.Errorf("invalid sort key %q", p.SortBy)
+	}
+	return nil
+}
+
+// FilterAndSortLogs applies the since filter and sort order in p to
+// a log listing. Datastores may use it to post-process listings.
+func FilterAndSortLogs(logs []LogInfo, p params.ListParams) ([]LogInfo, error) {
+	if err := ValidateListParams(p); err != nil {
+		return nil, err
+	}
+	ret := []LogInfo{}
+	for _, info := range logs {
+		if !p.Since.IsZero() && info.LastTimestamp.Before(p.Since) {
+			continue
+		}
+		ret = append(ret, info)
+	}
+
+	sortBy := p.SortBy
+	if sortBy == "" {
+		sortBy = SortByName
+	}
+	less := logInfoLess[sortBy]
+	sort.SliceStable(ret, func(i, j int) bool {
+		if p.Descending {
+			return less(ret[j], ret[i])
+		}
+		return less(ret[i], ret[j])
+	})
+	return ret, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package common
+
+import (
+	"container/heap"
+
+	"coriolis-logger/logging"
+)
+
+// NewMergeIterator returns an iterator that merges messages from
+// several iterators, each already in ascending time order, into a
+// single time ordered stream. Only the current message of each
+// iterator is held in memory. Messages with equal timestamps are
+// returned in the order of the iterators in the slice.
+func NewMergeIterator(iterators []Iterator) Iterator {
+	return &mergeIterator{
+		iterators: iterators,
+	}
+}
+
+type mergeEntry struct {
+	msg logging.LogMessage
+	idx int
+}
+
+type mergeHeap []mergeEntry
+
+func (m mergeHeap) Len() int { return len(m) }
+
+func (m mergeHeap) Less(i, j int) bool {
+	if m[i].msg.Timestamp.Equal(m[j].msg.Timestamp) {
+		return m[i].idx < m[j].idx
+	}
+	return m[i].msg.Timestamp.Before(m[j].msg.Timestamp)
+}
+
+func (m mergeHeap) Swap(i, j int) { m[i], m[j] = m[j], m[i] }
+
+func (m *mergeHeap) Push(x interface{}) {
+	*m = append(*m, x.(mergeEntry))
+}
+
+func (m *mergeHeap) Pop() interface{} {
+	old := *m
+	entry := old[len(old)-1]
+	*m = old[:len(old)-1]
+	return entry
+}
+
+type mergeIterator struct {
+	iterators []Iterator
+	heap      mergeHeap
+	started   bool
+	current   logging.LogMessage
+	err       error
+}
+
+// advance pushes the next message of the iterator at idx on the heap.
+func (m *mergeIterator) advance(idx int) bool {
+	it := m.iterators[idx]
+	if it.Next() {
+		heap.Push(&m.heap, mergeEntry{msg: it.Message(), idx: idx})
+		return true
+	}
+	if err := it.Err(); err != nil {
+		m.err = err
+		return false
+	}
+	return true
+}
+
+func (m *mergeIterator) Next() bool {
+	if m.err != nil {
+		return false
+	}
+	if !m.started {
+		m.started = true
+		for idx := range m.iterators {
+			if !m.advance(idx) {
+				return false
+			}
+		}
+	}
+	if m.heap.Len() == 0 {
+		return false
+	}
+	entry := heap.Pop(&m.heap).(mergeEntry)
+	m.current = entry.msg
+	if !m.advance(entry.idx) {
+		return false
+	}
+	return true
+}
+
+func (m *mergeIterator) Message() logging.LogMessage {
+	return m.current
+}
+
+func (m *mergeIterator) Err() error {
+	return m.err
+}
+
+func (m *mergeIterator) Close() error {
+	var ret error
+	for _, it := range m.iterators {
+		if err := it.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
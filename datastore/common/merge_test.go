@@ -0,0 +1,120 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package common
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"coriolis-logger/logging"
+)
+
+// failingIterator returns its messages, then fails.
+type failingIterator struct {
+	Iterator
+	err error
+}
+
+func (f *failingIterator) Err() error {
+	if f.Iterator.Err() != nil {
+		return f.Iterator.Err()
+	}
+	return f.err
+}
+
+func TestMergeIterator(t *testing.T) {
+	base := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	// messages returns an iterator over messages of app, one for
+	// each of the supplied second offsets.
+	messages := func(app string, seconds ...int) Iterator {
+		msgs := []logging.LogMessage{}
+		for _, s := range seconds {
+			msgs = append(msgs, logging.LogMessage{
+				AppName:   app,
+				Timestamp: base.Add(time.Duration(s) * time.Second),
+			})
+		}
+		return NewSliceIterator(msgs)
+	}
+
+	tests := []struct {
+		name      string
+		iterators []Iterator
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name: "interleaved",
+			iterators: []Iterator{
+				messages("a", 0, 3, 4),
+				messages("b", 1, 2, 5),
+				messages("c", 6),
+			},
+			want: []string{"a@0", "b@1", "b@2", "a@3", "a@4", "b@5", "c@6"},
+		},
+		{
+			name: "ties are broken by iterator order",
+			iterators: []Iterator{
+				messages("a", 1, 1),
+				messages("b", 0, 1),
+				messages("c", 1),
+			},
+			want: []string{"b@0", "a@1", "a@1", "b@1", "c@1"},
+		},
+		{
+			name: "empty iterators",
+			iterators: []Iterator{
+				messages("a"),
+				messages("b", 0),
+				messages("c"),
+			},
+			want: []string{"b@0"},
+		},
+		{
+			name: "no iterators",
+			want: []string{},
+		},
+		{
+			name: "failing iterator",
+			iterators: []Iterator{
+				messages("a", 0, 1, 2),
+				&failingIterator{Iterator: messages("b", 0), err: fmt.Errorf("query failed")},
+			},
+			want:    []string{"a@0"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			it := NewMergeIterator(tt.iterators)
+			got := []string{}
+			for it.Next() {
+				msg := it.Message()
+				got = append(got, fmt.Sprintf("%s@%d", msg.AppName, msg.Timestamp.Sub(base)/time.Second))
+			}
+			if (it.Err() != nil) != tt.wantErr {
+				t.Errorf("got error %v", it.Err())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if err := it.Close(); err != nil {
+				t.Errorf("closing: %v", err)
+			}
+		})
+	}
+}
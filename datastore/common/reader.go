@@ -0,0 +1,82 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package common
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"coriolis-logger/logging"
+
+	"github.com/pkg/errors"
+)
+
+// maxLinesPerRead is the maximum number of log lines a text reader
+// returns in one call to ReadNext.
+const maxLinesPerRead = 20000
+
+// NewTextReader returns a Reader that renders the messages of an
+// iterator as newline terminated plain text.
+func NewTextReader(it Iterator) Reader {
+	return &textReader{
+		it: it,
+	}
+}
+
+// NewFormattedTextReader returns a Reader that renders each message
+// of an iterator as a line of text, using the supplied format.
+func NewFormattedTextReader(it Iterator, format *logging.LineFormat) Reader {
+	return &textReader{
+		it:     it,
+		format: format,
+	}
+}
+
+// AppendText renders msg as a line of text using format, or as its
+// newline terminated message if format is nil, and appends it to buf.
+func AppendText(buf *bytes.Buffer, msg logging.LogMessage, format *logging.LineFormat) {
+	if format != nil {
+		format.Append(buf, msg)
+		return
+	}
+	buf.WriteString(msg.Message)
+	if len(msg.Message) > 0 && !strings.HasSuffix(msg.Message, "\n") {
+		buf.WriteByte('\n')
+	}
+}
+
+type textReader struct {
+	it     Iterator
+	format *logging.LineFormat
+}
+
+func (t *textReader) ReadNext() ([]byte, error) {
+	buf := bytes.NewBuffer([]byte{})
+	lines := 0
+	for ; lines < maxLinesPerRead; lines++ {
+		if !t.it.Next() {
+			break
+		}
+		AppendText(buf, t.it.Message(), t.format)
+	}
+	if err := t.it.Err(); err != nil {
+		return nil, errors.Wrap(err, "reading results")
+	}
+	if lines == 0 {
+		return nil, io.EOF
+	}
+	return buf.Bytes(), nil
+}
@@ -35,7 +35,7 @@ func GetDatastore(ctx context.Context, cfg config.Syslog) (common.DataStore, err
 		if cfg.InfluxDB == nil {
 			return nil, fmt.Errorf("invalid influxdb datastore config")
 		}
-		return influxdb.NewInfluxDBDatastore(ctx, cfg.InfluxDB)
+		return influxdb.NewInfluxDBDatastore(ctx, cfg.InfluxDB, cfg.GetTagFields())
 	default:
 		return nil, fmt.Errorf("invalid datastore type")
 	}
@@ -15,16 +15,19 @@
 package influxdb
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	// this is important because of the bug in go mod
 	_ "github.com/influxdata/influxdb1-client"
+	"github.com/influxdata/influxdb1-client/models"
 	client "github.com/influxdata/influxdb1-client/v2"
 	"github.com/juju/loggo"
 	"github.com/pkg/errors"
@@ -37,13 +40,37 @@ import (
 
 var log = loggo.GetLogger("coriolis.logger.datastore.influxdb")
 
-func NewInfluxDBDatastore(ctx context.Context, cfg *config.InfluxDB) (common.DataStore, error) {
+// summaryCacheTTL is how long the log summaries returned by List are
+// reused before being computed again.
+const summaryCacheTTL = time.Minute
+
+// sequenceTTL is how long the number of points written in a series
+// within a second is kept after the last of them.
+const sequenceTTL = 10 * time.Minute
+
+// sequenceKey identifies the points of a series with the same whole
+// second timestamp.
+type sequenceKey struct {
+	series string
+	second int64
+}
+
+type sequence struct {
+	next int64
+	used time.Time
+}
+
+// NewInfluxDBDatastore returns a new influx datastore. The structured
+// message fields in tagFields are stored as tags, so they can be used
+// in queries.
+func NewInfluxDBDatastore(ctx context.Context, cfg *config.InfluxDB, tagFields []string) (common.DataStore, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, errors.Wrap(err, "validating influx config")
 	}
 
 	store := &InfluxDBDataStore{
 		cfg:    cfg,
+		tags:   newTagSet(tagFields),
 		points: []*client.Point{},
 		ctx:    ctx,
 		closed: make(chan struct{}),
@@ -60,12 +87,23 @@ var _ common.DataStore = (*InfluxDBDataStore)(nil)
 
 type InfluxDBDataStore struct {
 	cfg    *config.InfluxDB
+	tags   tagSet
 	con    client.Client
 	mut    sync.Mutex
 	points []*client.Point
 	ctx    context.Context
 	closed chan struct{}
 	quit   chan struct{}
+
+	// sequences holds the number of points written in each series
+	// within a whole second, see pointTime. It is guarded by mut.
+	sequences map[sequenceKey]*sequence
+	pruned    time.Time
+
+	// summaryMut guards the log summaries cached by List.
+	summaryMut sync.Mutex
+	summaries  map[string]common.LogInfo
+	summarized time.Time
 }
 
 func (i *InfluxDBDataStore) doWork() {
@@ -76,10 +114,11 @@ func (i *InfluxDBDataStore) doWork() {
 		interval = i.cfg.WriteInterval
 	}
 	ticker := time.NewTicker(time.Duration(interval) * time.Second)
-	rotationTicker := time.NewTicker(1 * time.Hour)
 	defer func() {
 		ticker.Stop()
-		rotationTicker.Stop()
+		if err := i.flush(); err != nil {
+			log.Errorf("failed to flush logs to backend: %v", err)
+		}
 		close(i.closed)
 	}()
 	for {
@@ -90,15 +129,6 @@ func (i *InfluxDBDataStore) doWork() {
 			if err := i.flush(); err != nil {
 				log.Errorf("failed to flush logs to backend: %v", err)
 			}
-		case <-rotationTicker.C:
-			retentionPeriod := i.cfg.GetLogRetention()
-			log.Infof("deleting logs older than %d days", retentionPeriod)
-			now := time.Now()
-			day := 24 * time.Hour
-			olderThan := now.Add(time.Duration(-retentionPeriod) * day)
-			if err := i.Rotate(olderThan); err != nil {
-				log.Errorf("failed to rotate logs: %v", err)
-			}
 		case <-i.quit:
 			return
 		}
@@ -180,12 +210,27 @@ func (i *InfluxDBDataStore) Write(logMsg logging.LogMessage) (err error) {
 	fields := map[string]interface{}{
 		"message": logMsg.Message,
 	}
+	if len(logMsg.Fields) > 0 {
+		for key := range i.tags {
+			if val := logging.FieldString(logMsg.Fields[key]); val != "" {
+				tags[key] = val
+			}
+		}
+		data, err := json.Marshal(logMsg.Fields)
+		if err != nil {
+			return errors.Wrap(err, "encoding message fields")
+		}
+		fields["fields"] = string(data)
+	}
 
-	var tm time.Time = logMsg.Timestamp
-	if logMsg.RFC == logging.RFC3164 {
-		tm = time.Now()
+	if !logMsg.SenderTimestamp.IsZero() {
+		fields["sender_time"] = logMsg.SenderTimestamp.UnixNano()
+	}
+	if !logMsg.ReceivedAt.IsZero() {
+		fields["received_time"] = logMsg.ReceivedAt.UnixNano()
 	}
-	pt, err := client.NewPoint(logMsg.AppName, tags, fields, tm)
+
+	pt, err := client.NewPoint(logMsg.AppName, tags, fields, i.pointTime(logMsg.AppName, tags, logMsg.Timestamp))
 	if err != nil {
 		return errors.Wrap(err, "adding new log message point")
 	}
@@ -194,41 +239,451 @@ func (i *InfluxDBDataStore) Write(logMsg logging.LogMessage) (err error) {
 	return nil
 }
 
-func (i *InfluxDBDataStore) Rotate(olderThan time.Time) error {
-	logList, err := i.List()
-	if err != nil {
-		return errors.Wrap(err, "listing logs")
+// seriesKey returns a key identifying the series of a point
+func seriesKey(measurement string, tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
 	}
-	for _, val := range logList {
-		for _, logName := range val {
-			q := fmt.Sprintf(`delete from "%s" where time < %d`, logName, olderThan.UnixNano())
-			influxQ := client.NewQuery(q, i.cfg.Database, "ns")
-			resp, err := i.con.Query(influxQ)
-			if err != nil {
-				return errors.Wrap(err, "executing query")
-			}
-			if resp.Err != "" {
-				return fmt.Errorf("error executing query: %s", resp.Err)
+	sort.Strings(keys)
+	var buf strings.Builder
+	buf.WriteString(measurement)
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "\x00%s=%s", key, tags[key])
+	}
+	return buf.String()
+}
+
+// pointTime returns the time a point of the series is stored at. Points
+// with the same series and time overwrite each other, and senders with
+// second precision timestamps often send several messages within the
+// same second. Those are stored a nanosecond apart, in the order they
+// are written, so they are all kept and read back in order. The
+// sequences are kept in memory for sequenceTTL.
+func (i *InfluxDBDataStore) pointTime(measurement string, tags map[string]string, timestamp time.Time) time.Time {
+	if timestamp.Nanosecond() != 0 {
+		return timestamp
+	}
+	now := time.Now()
+	if i.sequences == nil {
+		i.sequences = map[sequenceKey]*sequence{}
+	}
+	if now.Sub(i.pruned) > sequenceTTL {
+		for key, seq := range i.sequences {
+			if now.Sub(seq.used) > sequenceTTL {
+				delete(i.sequences, key)
 			}
 		}
+		i.pruned = now
+	}
+	key := sequenceKey{series: seriesKey(measurement, tags), second: timestamp.Unix()}
+	seq, ok := i.sequences[key]
+	if !ok {
+		seq = &sequence{}
+		i.sequences[key] = seq
+	}
+	offset := seq.next
+	seq.next++
+	seq.used = now
+	return timestamp.Add(time.Duration(offset))
+}
+
+// timeConditions returns the InfluxQL conditions for the time range
+// in the supplied parameters.
+func timeConditions(p params.QueryParams) []string {
+	options := []string{}
+	if !p.StartDate.IsZero() {
+		options = append(
+			options,
+			fmt.Sprintf(`time >= %d`, p.StartDate.UnixNano()))
+	}
+	if !p.EndDate.IsZero() {
+		options = append(
+			options,
+			fmt.Sprintf(`time <= %d`, p.EndDate.UnixNano()))
+	}
+	return options
+}
+
+// whereClause returns the InfluxQL where clause for the supplied
+// parameters, or an empty string if they match everything.
+func (i *InfluxDBDataStore) whereClause(p params.QueryParams) (string, error) {
+	options := timeConditions(p)
+	filter, err := filterToInfluxQL(p.Filter, false, i.tags)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", common.ErrInvalidFilter, err)
+	}
+	if filter != "" {
+		options = append(options, filter)
+	}
+	if len(options) == 0 {
+		return "", nil
+	}
+	return ` where ` + strings.Join(options, ` and `), nil
+}
+
+func (i *InfluxDBDataStore) Delete(p params.QueryParams) error {
+	if err := p.Validate(); err != nil {
+		return errors.Wrap(err, "validating query")
+	}
+	if usesField(p.Filter, params.FieldMessage) {
+		// influx only allows tags and time in delete statements
+		return fmt.Errorf("cannot delete logs by message")
+	}
+	if usesUnindexedField(p.Filter, i.tags) {
+		return fmt.Errorf("cannot delete logs by fields that are not indexed")
+	}
+	where, err := i.whereClause(p)
+	if err != nil {
+		return err
+	}
+	if err := i.flush(); err != nil {
+		return errors.Wrap(err, "flushing logs")
+	}
+	q := fmt.Sprintf(`delete from %s%s`, quoteIdent(p.AppName), where)
+	if _, err := i.query(q); err != nil {
+		return errors.Wrapf(err, "deleting logs from %q", p.AppName)
 	}
+	i.summaryMut.Lock()
+	i.summaries = nil
+	i.summaryMut.Unlock()
 	return nil
 }
 
-func (i *InfluxDBDataStore) ResultReader(p params.QueryParams) common.Reader {
-	return &influxDBReader{
+func (i *InfluxDBDataStore) Count(p params.QueryParams) (int64, error) {
+	if err := p.Validate(); err != nil {
+		return 0, errors.Wrap(err, "validating query")
+	}
+	if usesUnindexedField(p.Filter, i.tags) {
+		return i.countInGo(p)
+	}
+	where, err := i.whereClause(p)
+	if err != nil {
+		return 0, err
+	}
+	if err := i.flush(); err != nil {
+		return 0, errors.Wrap(err, "flushing logs")
+	}
+	q := fmt.Sprintf(`select count(message) from %s%s`, quoteIdent(p.AppName), where)
+	results, err := i.query(q)
+	if err != nil {
+		return 0, err
+	}
+	var count int64
+	for _, result := range results {
+		for _, serie := range result.Series {
+			for _, val := range serie.Values {
+				if len(val) < 2 {
+					continue
+				}
+				n, err := toInt64(val[1])
+				if err != nil {
+					return 0, errors.Wrap(err, "parsing count")
+				}
+				count += n
+			}
+		}
+	}
+	return count, nil
+}
+
+// countInGo counts the messages matching a filter that uses fields
+// which are not indexed, by reading them all.
+func (i *InfluxDBDataStore) countInGo(p params.QueryParams) (int64, error) {
+	p.Limit = 0
+	p.Cursor = nil
+	iterator, err := i.Query(p)
+	if err != nil {
+		return 0, err
+	}
+	defer iterator.Close()
+	var count int64
+	for iterator.Next() {
+		count++
+	}
+	if err := iterator.Err(); err != nil {
+		return 0, errors.Wrap(err, "reading logs")
+	}
+	return count, nil
+}
+
+func (i *InfluxDBDataStore) Query(p params.QueryParams) (common.Iterator, error) {
+	if err := p.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating query")
+	}
+	return common.NewPagedIterator(&influxDBIterator{
 		datastore: i,
 		params:    p,
+		matchInGo: usesUnindexedField(p.Filter, i.tags),
+	}, p), nil
+}
+
+func (i *InfluxDBDataStore) Histogram(p params.QueryParams, interval time.Duration) ([]common.HistogramBucket, error) {
+	if err := p.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating query")
+	}
+	if err := common.ValidateHistogramParams(p, interval); err != nil {
+		return nil, errors.Wrap(err, "validating histogram")
+	}
+	if usesUnindexedField(p.Filter, i.tags) {
+		// Filters on fields that are not indexed can not be
+		// translated to InfluxQL, so messages are counted as they
+		// are read instead.
+		p.Limit = 0
+		return common.ComputeHistogram(i, p, interval)
+	}
+	where, err := i.whereClause(p)
+	if err != nil {
+		return nil, err
+	}
+	if err := i.flush(); err != nil {
+		return nil, errors.Wrap(err, "flushing logs")
+	}
+	q := fmt.Sprintf(
+		`select count(message) from %s%s group by time(%ds),severity,hostname fill(none)`,
+		quoteIdent(p.AppName), where, int64(interval/time.Second))
+	results, err := i.query(q)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := map[int64]*common.HistogramBucket{}
+	for _, result := range results {
+		for _, serie := range result.Series {
+			for _, val := range serie.Values {
+				if len(val) < 2 || val[1] == nil {
+					continue
+				}
+				stamp, err := toInt64(val[0])
+				if err != nil {
+					return nil, errors.Wrap(err, "parsing timestamp")
+				}
+				count, err := toInt64(val[1])
+				if err != nil {
+					return nil, errors.Wrap(err, "parsing count")
+				}
+				bucket, ok := buckets[stamp]
+				if !ok {
+					bucket = common.NewHistogramBucket(time.Unix(0, stamp).UTC())
+					buckets[stamp] = bucket
+				}
+				bucket.Add(serie.Tags["severity"], serie.Tags["hostname"], count)
+			}
+		}
+	}
+	return common.FillHistogram(buckets, p, interval), nil
+}
+
+// query runs q and returns its results.
+func (i *InfluxDBDataStore) query(q string) ([]client.Result, error) {
+	resp, err := i.con.Query(client.NewQuery(q, i.cfg.Database, "ns"))
+	if err != nil {
+		return nil, errors.Wrap(err, "executing query")
 	}
+	if err := resp.Error(); err != nil {
+		return nil, errors.Wrap(err, "executing query")
+	}
+	return resp.Results, nil
+}
+
+// severityCounts returns the number of messages for each severity
+// level present in each log.
+func (i *InfluxDBDataStore) severityCounts() (map[string]map[string]int64, error) {
+	results, err := i.query(`select count(message) from /.*/ group by severity`)
+	if err != nil {
+		return nil, errors.Wrap(err, "counting messages")
+	}
+	ret := map[string]map[string]int64{}
+	for _, result := range results {
+		for _, serie := range result.Series {
+			for _, val := range serie.Values {
+				if len(val) < 2 {
+					continue
+				}
+				count, err := toInt64(val[1])
+				if err != nil {
+					return nil, errors.Wrap(err, "parsing count")
+				}
+				if _, ok := ret[serie.Name]; !ok {
+					ret[serie.Name] = map[string]int64{}
+				}
+				ret[serie.Name][serie.Tags["severity"]] += count
+			}
+		}
+	}
+	return ret, nil
+}
+
+// selectorTimes runs a selector function, like first() or last(),
+// over all logs and returns the timestamp of the selected message
+// in each log.
+func (i *InfluxDBDataStore) selectorTimes(selector string) (map[string]time.Time, error) {
+	results, err := i.query(fmt.Sprintf(`select %s(message) from /.*/`, selector))
+	if err != nil {
+		return nil, errors.Wrapf(err, "fetching %s message", selector)
+	}
+	ret := map[string]time.Time{}
+	for _, result := range results {
+		for _, serie := range result.Series {
+			for _, val := range serie.Values {
+				if len(val) < 1 {
+					continue
+				}
+				stamp, err := toInt64(val[0])
+				if err != nil {
+					return nil, errors.Wrap(err, "parsing timestamp")
+				}
+				ret[serie.Name] = time.Unix(0, stamp).UTC()
+			}
+		}
+	}
+	return ret, nil
 }
 
-func (i *InfluxDBDataStore) List() ([]map[string]string, error) {
+// hostnames returns the distinct hostnames in each log.
+func (i *InfluxDBDataStore) hostnames() (map[string][]string, error) {
+	results, err := i.query(`SHOW TAG VALUES FROM /.*/ WITH KEY = "hostname"`)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching hostnames")
+	}
+	ret := map[string][]string{}
+	for _, result := range results {
+		for _, serie := range result.Series {
+			for _, val := range serie.Values {
+				if len(val) < 2 {
+					continue
+				}
+				if hostname, ok := val[1].(string); ok {
+					ret[serie.Name] = append(ret[serie.Name], hostname)
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+// diskUsage returns the disk space used by the shards of our
+// database. Influx does not track disk usage per measurement.
+func (i *InfluxDBDataStore) diskUsage() (int64, error) {
+	results, err := i.query(`SHOW STATS FOR 'shard'`)
+	if err != nil {
+		return 0, errors.Wrap(err, "fetching shard stats")
+	}
+	var total int64
+	for _, result := range results {
+		for _, serie := range result.Series {
+			if serie.Tags["database"] != i.cfg.Database {
+				continue
+			}
+			for idx, col := range serie.Columns {
+				if col != "diskBytes" {
+					continue
+				}
+				for _, val := range serie.Values {
+					if idx >= len(val) || val[idx] == nil {
+						continue
+					}
+					size, err := toInt64(val[idx])
+					if err != nil {
+						return 0, errors.Wrap(err, "parsing disk usage")
+					}
+					total += size
+				}
+			}
+		}
+	}
+	return total, nil
+}
+
+// logSummaries returns the usage and content summary of each log.
+// Computing them scans all logs, so they are cached for
+// summaryCacheTTL, or until logs are added or deleted.
+func (i *InfluxDBDataStore) logSummaries(names []string) (map[string]common.LogInfo, error) {
+	i.summaryMut.Lock()
+	defer i.summaryMut.Unlock()
+
+	if i.summaries != nil && time.Since(i.summarized) < summaryCacheTTL {
+		cached := true
+		for _, name := range names {
+			if _, ok := i.summaries[name]; !ok {
+				cached = false
+				break
+			}
+		}
+		if cached {
+			return i.summaries, nil
+		}
+	}
+
+	severities, err := i.severityCounts()
+	if err != nil {
+		return nil, err
+	}
+	first, err := i.selectorTimes("first")
+	if err != nil {
+		return nil, err
+	}
+	last, err := i.selectorTimes("last")
+	if err != nil {
+		return nil, err
+	}
+	hostnames, err := i.hostnames()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[string]int64{}
+	var totalMessages int64
+	for name, bySeverity := range severities {
+		for _, count := range bySeverity {
+			counts[name] += count
+			totalMessages += count
+		}
+	}
+	// Size is estimated by splitting the disk usage of the database
+	// between logs, proportionally to their message count.
+	diskBytes, err := i.diskUsage()
+	if err != nil {
+		log.Warningf("cannot estimate log sizes: %v", err)
+	}
+
+	summaries := map[string]common.LogInfo{}
+	for _, name := range names {
+		info := common.LogInfo{
+			Name:           name,
+			Messages:       counts[name],
+			FirstTimestamp: first[name],
+			LastTimestamp:  last[name],
+			Hostnames:      hostnames[name],
+			Severities:     severities[name],
+		}
+		if info.Hostnames == nil {
+			info.Hostnames = []string{}
+		}
+		if info.Severities == nil {
+			info.Severities = map[string]int64{}
+		}
+		if totalMessages > 0 {
+			info.Size = int64(float64(diskBytes) * float64(info.Messages) / float64(totalMessages))
+		}
+		summaries[name] = info
+	}
+	i.summaries = summaries
+	i.summarized = time.Now()
+	return summaries, nil
+}
+
+func (i *InfluxDBDataStore) List(p params.ListParams) ([]common.LogInfo, error) {
+	if err := common.ValidateListParams(p); err != nil {
+		return nil, errors.Wrap(err, "validating list params")
+	}
 	query := client.NewQuery("SHOW MEASUREMENTS", i.cfg.Database, "ns")
 	resp, err := i.con.QueryAsChunk(query)
 	if err != nil {
 		return nil, errors.Wrap(err, "listing logs")
 	}
-	ret := []map[string]string{}
+	defer resp.Close()
+	names := []string{}
 	for {
 		r, err := resp.NextResponse()
 		if err != nil {
@@ -246,107 +701,259 @@ func (i *InfluxDBDataStore) List() ([]map[string]string, error) {
 					if len(val) == 0 {
 						continue
 					}
-					ret = append(ret, map[string]string{"log_name": val[0].(string)})
+					names = append(names, val[0].(string))
 				}
 			}
 		}
 	}
-	return ret, nil
-}
 
-func (i *InfluxDBDataStore) Query(q client.Query) (*client.ChunkedResponse, error) {
-	resp, err := i.con.QueryAsChunk(q)
+	if p.NamesOnly {
+		ret := []common.LogInfo{}
+		for _, name := range names {
+			ret = append(ret, common.LogInfo{Name: name})
+		}
+		return common.FilterAndSortLogs(ret, params.ListParams{})
+	}
+
+	summaries, err := i.logSummaries(names)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrap(err, "listing logs")
 	}
-	return resp, nil
+	ret := []common.LogInfo{}
+	for _, name := range names {
+		info, ok := summaries[name]
+		if !ok {
+			info = common.LogInfo{
+				Name:       name,
+				Hostnames:  []string{},
+				Severities: map[string]int64{},
+			}
+		}
+		ret = append(ret, info)
+	}
+	return common.FilterAndSortLogs(ret, p)
 }
 
-type influxDBReader struct {
+type influxDBIterator struct {
 	datastore *InfluxDBDataStore
 	params    params.QueryParams
-
-	result *client.ChunkedResponse
-	done   bool
+	// matchInGo is set if the filter uses fields that are not
+	// indexed, and cannot be translated to InfluxQL.
+	matchInGo bool
+
+	result  *client.ChunkedResponse
+	series  []models.Row
+	rowIdx  int
+	current logging.LogMessage
+	err     error
+	done    bool
 }
 
-func (i *influxDBReader) prepareQuery() (string, error) {
+func (i *influxDBIterator) prepareQuery() (string, error) {
 	if i.params.AppName == "" {
 		return "", fmt.Errorf("missing application name")
 	}
-	undefinedDate := time.Time{}
-	q := fmt.Sprintf(`select time,severity,message from "%s"`, i.params.AppName)
-	if !i.params.StartDate.Equal(undefinedDate) || !i.params.EndDate.Equal(undefinedDate) || i.params.Hostname != "" {
-		q += ` where `
+	q := fmt.Sprintf(`select time,hostname,severity,facility,message,fields,sender_time,received_time from %s`, quoteIdent(i.params.AppName))
+	p := i.params
+	if i.matchInGo {
+		// The filter and limit are applied to the results instead.
+		p.Filter = nil
+		p.Limit = 0
 	}
+	if p.Cursor != nil {
+		// Resume from the cursor timestamp. Messages sharing that
+		// timestamp that were already read are skipped by the paged
+		// iterator wrapping this one.
+		if p.Descending {
+			if p.EndDate.IsZero() || p.Cursor.Timestamp.Before(p.EndDate) {
+				p.EndDate = p.Cursor.Timestamp
+			}
+		} else if p.Cursor.Timestamp.After(p.StartDate) {
+			p.StartDate = p.Cursor.Timestamp
+		}
+	}
+	where, err := i.datastore.whereClause(p)
+	if err != nil {
+		return "", err
+	}
+	q += where
+	if p.Descending {
+		q += ` order by time desc`
+	}
+	if p.Limit > 0 {
+		limit := p.Limit
+		if p.Cursor != nil {
+			limit += p.Cursor.Skip
+		}
+		q += fmt.Sprintf(` limit %d`, limit)
+	}
+	return q, nil
+}
 
-	options := []string{}
+var _ common.Iterator = (*influxDBIterator)(nil)
 
-	if !i.params.StartDate.Equal(undefinedDate) {
-		options = append(
-			options,
-			fmt.Sprintf(`time >= %d`, i.params.StartDate.UnixNano()))
+func (i *influxDBIterator) execute() error {
+	i.datastore.flush()
+	query, err := i.prepareQuery()
+	if err != nil {
+		return errors.Wrap(err, "preparing query")
+	}
+	influxQ := client.NewQuery(query, i.datastore.cfg.Database, "ns")
+	influxQ.ChunkSize = 20000
+	resp, err := i.datastore.con.QueryAsChunk(influxQ)
+	if err != nil {
+		return errors.Wrap(err, "executing query")
 	}
+	i.result = resp
+	return nil
+}
 
-	if !i.params.EndDate.Equal(undefinedDate) {
-		options = append(
-			options,
-			fmt.Sprintf(`time <= %d`, i.params.EndDate.UnixNano()))
+// nextChunk fetches the next chunk of results from influx. It returns
+// io.EOF once all chunks have been consumed.
+func (i *influxDBIterator) nextChunk() error {
+	res, err := i.result.NextResponse()
+	if err != nil {
+		if err == io.EOF {
+			return err
+		}
+		return errors.Wrap(err, "reading results")
+	}
+	if res.Err != "" {
+		return fmt.Errorf("error executing query: %s", res.Err)
+	}
+	i.series = []models.Row{}
+	for _, result := range res.Results {
+		if result.Err != "" {
+			return fmt.Errorf("error executing query: %s", result.Err)
+		}
+		i.series = append(i.series, result.Series...)
+	}
+	i.rowIdx = 0
+	return nil
+}
 
+func (i *influxDBIterator) Next() bool {
+	if i.done {
+		return false
 	}
-	if i.params.Hostname != "" {
-		options = append(options, fmt.Sprintf(`hostname='%s'`, i.params.Hostname))
+	if i.result == nil {
+		if err := i.execute(); err != nil {
+			i.err = err
+			i.done = true
+			return false
+		}
 	}
 
-	if len(options) > 0 {
-		q += strings.Join(options, ` and `)
+	for {
+		for len(i.series) > 0 {
+			if i.rowIdx >= len(i.series[0].Values) {
+				i.series = i.series[1:]
+				i.rowIdx = 0
+				continue
+			}
+			serie := i.series[0]
+			msg, err := rowToLogMessage(serie.Name, serie.Columns, serie.Values[i.rowIdx])
+			i.rowIdx++
+			if err != nil {
+				i.err = err
+				i.done = true
+				return false
+			}
+			if i.matchInGo && !i.params.Filter.Match(msg) {
+				continue
+			}
+			i.current = msg
+			return true
+		}
+		if err := i.nextChunk(); err != nil {
+			if err != io.EOF {
+				i.err = err
+			}
+			i.done = true
+			return false
+		}
 	}
+}
 
-	return q, nil
+func (i *influxDBIterator) Message() logging.LogMessage {
+	return i.current
 }
 
-var _ common.Reader = (*influxDBReader)(nil)
+func (i *influxDBIterator) Err() error {
+	return i.err
+}
 
-func (i *influxDBReader) ReadNext() ([]byte, error) {
+func (i *influxDBIterator) Close() error {
+	i.done = true
 	if i.result == nil {
-		i.datastore.flush()
-		query, err := i.prepareQuery()
-		if err != nil {
-			return nil, errors.Wrap(err, "preparing query")
-		}
-		influxQ := client.NewQuery(query, i.datastore.cfg.Database, "ns")
-		influxQ.ChunkSize = 20000
-		resp, err := i.datastore.con.QueryAsChunk(influxQ)
-		if err != nil {
-			return nil, errors.Wrap(err, "executing query")
-		}
-		i.result = resp
+		return nil
 	}
+	return i.result.Close()
+}
 
-	res, err := i.result.NextResponse()
-	if err != nil {
-		if err == io.EOF {
-			return nil, err
-		}
-		return nil, errors.Wrap(err, "reading results")
+// rowToLogMessage converts a row returned by influx into a log message.
+func rowToLogMessage(appName string, columns []string, row []interface{}) (logging.LogMessage, error) {
+	msg := logging.LogMessage{
+		AppName: appName,
 	}
-	newline := []byte("\n")
-	buf := bytes.NewBuffer([]byte{})
-	for _, result := range res.Results {
-		for _, serie := range result.Series {
-			for _, val := range serie.Values {
-				line := []byte(val[2].(string))
-				if len(line) > 0 && line[len(line)-1] != newline[0] {
-					line = append(line, []byte("\n")...)
-				}
-				_, err := buf.Write(line)
-				if err != nil {
-					return nil, errors.Wrap(err, "reading value")
-				}
+	for idx, col := range columns {
+		if idx >= len(row) || row[idx] == nil {
+			continue
+		}
+		switch col {
+		case "time":
+			stamp, err := toInt64(row[idx])
+			if err != nil {
+				return msg, errors.Wrap(err, "parsing timestamp")
+			}
+			msg.Timestamp = time.Unix(0, stamp).UTC()
+		case "sender_time", "received_time":
+			stamp, err := toInt64(row[idx])
+			if err != nil {
+				return msg, errors.Wrapf(err, "parsing %s", col)
 			}
+			if col == "sender_time" {
+				msg.SenderTimestamp = time.Unix(0, stamp).UTC()
+			} else {
+				msg.ReceivedAt = time.Unix(0, stamp).UTC()
+			}
+		case "hostname":
+			msg.Hostname, _ = row[idx].(string)
+		case "message":
+			msg.Message, _ = row[idx].(string)
+		case "fields":
+			val, _ := row[idx].(string)
+			if val == "" {
+				continue
+			}
+			if err := json.Unmarshal([]byte(val), &msg.Fields); err != nil {
+				return msg, errors.Wrap(err, "parsing fields")
+			}
+		case "severity":
+			val, _ := row[idx].(string)
+			severity, err := strconv.Atoi(val)
+			if err != nil {
+				severity = int(logging.UnknownSeverity)
+			}
+			msg.Severity = logging.Severity(severity)
+		case "facility":
+			val, _ := row[idx].(string)
+			facility, _ := strconv.Atoi(val)
+			msg.Facility = logging.Facility(facility)
 		}
 	}
-	contents := buf.Bytes()
-	buf.Reset()
-	return contents, nil
+	return msg, nil
+}
+
+func toInt64(val interface{}) (int64, error) {
+	switch v := val.(type) {
+	case json.Number:
+		return v.Int64()
+	case float64:
+		return int64(v), nil
+	case int64:
+		return v, nil
+	default:
+		return 0, fmt.Errorf("unexpected value type %T", val)
+	}
 }
@@ -0,0 +1,234 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	client "github.com/influxdata/influxdb1-client/v2"
+	"github.com/pkg/errors"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+// fakeClient records the queries it receives. It returns empty
+// results for all of them, except for chunked queries, which get rows.
+type fakeClient struct {
+	client.Client
+
+	mut     sync.Mutex
+	queries []string
+	// rows is the JSON encoded response to chunked queries.
+	rows string
+}
+
+func (f *fakeClient) QueryAsChunk(q client.Query) (*client.ChunkedResponse, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.queries = append(f.queries, q.Command)
+	return client.NewChunkedResponse(strings.NewReader(f.rows)), nil
+}
+
+func (f *fakeClient) Query(q client.Query) (*client.Response, error) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.queries = append(f.queries, q.Command)
+	return &client.Response{}, nil
+}
+
+func (f *fakeClient) count() int {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	return len(f.queries)
+}
+
+func TestLogSummariesCache(t *testing.T) {
+	con := &fakeClient{}
+	store := &InfluxDBDataStore{
+		cfg: &config.InfluxDB{Database: "logs"},
+		con: con,
+	}
+
+	if _, err := store.logSummaries([]string{"app"}); err != nil {
+		t.Fatalf("logSummaries: %v", err)
+	}
+	computed := con.count()
+	if computed == 0 {
+		t.Fatalf("summaries were not computed")
+	}
+
+	if _, err := store.logSummaries([]string{"app"}); err != nil {
+		t.Fatalf("logSummaries: %v", err)
+	}
+	if got := con.count(); got != computed {
+		t.Errorf("cached summaries ran %d queries", got-computed)
+	}
+
+	// A new log is not in the cache.
+	if _, err := store.logSummaries([]string{"app", "other"}); err != nil {
+		t.Fatalf("logSummaries: %v", err)
+	}
+	if got := con.count(); got != 2*computed {
+		t.Errorf("got %d queries after adding a log, want %d", got, 2*computed)
+	}
+
+	// Deleting logs invalidates the cache.
+	if err := store.Delete(params.QueryParams{AppName: "app"}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	deleted := con.count()
+	if _, err := store.logSummaries([]string{"app", "other"}); err != nil {
+		t.Fatalf("logSummaries: %v", err)
+	}
+	if got := con.count(); got != deleted+computed {
+		t.Errorf("got %d queries after deleting logs, want %d", got, deleted+computed)
+	}
+}
+
+func TestUnindexedFieldCounts(t *testing.T) {
+	start := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	row := func(offset time.Duration, hostname, severity, taskID string) string {
+		return fmt.Sprintf(`[%d, %q, %q, "1", "msg", "{\"task_id\": \"%s\"}"]`,
+			start.Add(offset).UnixNano(), hostname, severity, taskID)
+	}
+	con := &fakeClient{
+		rows: `{"results": [{"series": [{"name": "app", ` +
+			`"columns": ["time", "hostname", "severity", "facility", "message", "fields"], ` +
+			`"values": [` + strings.Join([]string{
+			row(0, "host-1", "3", "1"),
+			row(30*time.Second, "host-2", "6", "2"),
+			row(90*time.Second, "host-1", "6", "1"),
+		}, ", ") + `]}]}]}`,
+	}
+	store := &InfluxDBDataStore{
+		cfg:  &config.InfluxDB{Database: "logs"},
+		con:  con,
+		tags: newTagSet(nil),
+	}
+	p := params.QueryParams{
+		AppName:   "app",
+		StartDate: start,
+		EndDate:   start.Add(2 * time.Minute),
+		Filter:    params.Eq(params.FieldOf("task_id"), "1"),
+	}
+
+	count, err := store.Count(p)
+	if err != nil {
+		t.Fatalf("Count: %v", err)
+	}
+	if count != 2 {
+		t.Errorf("counted %d messages, want 2", count)
+	}
+
+	buckets, err := store.Histogram(p, time.Minute)
+	if err != nil {
+		t.Fatalf("Histogram: %v", err)
+	}
+	if len(buckets) != 3 {
+		t.Fatalf("got %d buckets, want 3", len(buckets))
+	}
+	want := []int64{1, 1, 0}
+	for idx, bucket := range buckets {
+		if bucket.Total != want[idx] {
+			t.Errorf("bucket %d has %d messages, want %d", idx, bucket.Total, want[idx])
+		}
+	}
+	if buckets[0].Severities["3"] != 1 || buckets[1].Hostnames["host-1"] != 1 {
+		t.Errorf("got buckets %+v", buckets)
+	}
+
+	for _, q := range con.queries {
+		if strings.Contains(q, "task_id") {
+			t.Errorf("query %q filters on a field that is not indexed", q)
+		}
+	}
+}
+
+// customExpression is a filter expression that cannot be translated
+// to InfluxQL.
+type customExpression struct{}
+
+func (customExpression) Validate() error                   { return nil }
+func (customExpression) Match(msg logging.LogMessage) bool { return true }
+
+func TestInvalidFilter(t *testing.T) {
+	store := &InfluxDBDataStore{
+		cfg:  &config.InfluxDB{Database: "logs"},
+		con:  &fakeClient{},
+		tags: newTagSet(nil),
+	}
+	_, err := store.Histogram(params.QueryParams{
+		AppName:   "app",
+		StartDate: time.Now().Add(-time.Hour),
+		EndDate:   time.Now(),
+		Filter:    customExpression{},
+	}, time.Minute)
+	if !errors.Is(err, common.ErrInvalidFilter) {
+		t.Errorf("got error %v, want an invalid filter", err)
+	}
+}
+
+// TestWriteSameSecond checks that messages sent within the same second
+// are all kept, in the order they were received, even when they were
+// received across a second boundary.
+func TestWriteSameSecond(t *testing.T) {
+	store := &InfluxDBDataStore{tags: newTagSet(nil)}
+	policy := logging.NewTimestampPolicy(logging.TimestampSender, nil, 0, nil)
+	sent := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	precise := time.Date(2019, 6, 1, 12, 0, 0, 500, time.UTC)
+	messages := []struct {
+		hostname string
+		sent     time.Time
+		received time.Time
+		want     time.Time
+	}{
+		{"host-1", sent, sent.Add(900 * time.Millisecond), sent},
+		{"host-1", sent, sent.Add(1100 * time.Millisecond), sent.Add(1)},
+		// Other series and seconds have their own sequence.
+		{"host-2", sent, sent.Add(1150 * time.Millisecond), sent},
+		{"host-1", sent.Add(time.Second), sent.Add(1200 * time.Millisecond), sent.Add(time.Second)},
+		{"host-1", sent, sent.Add(1300 * time.Millisecond), sent.Add(2)},
+		// Timestamps with a sub-second part are kept.
+		{"host-1", precise, sent.Add(1400 * time.Millisecond), precise},
+	}
+	for _, m := range messages {
+		msg := logging.LogMessage{
+			AppName:    "app",
+			Hostname:   m.hostname,
+			RFC:        logging.RFC3164,
+			Timestamp:  m.sent,
+			ReceivedAt: m.received,
+		}
+		policy.Apply(&msg)
+		if !msg.Timestamp.Equal(m.sent) {
+			t.Fatalf("the sender timestamp %v was changed to %v", m.sent, msg.Timestamp)
+		}
+		if err := store.Write(msg); err != nil {
+			t.Fatalf("writing message: %v", err)
+		}
+	}
+	for idx, m := range messages {
+		if got := store.points[idx].Time(); !got.Equal(m.want) {
+			t.Errorf("message %d is stored at %v, want %v", idx, got, m.want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"coriolis-logger/params"
+)
+
+const (
+	maxSeverity = 7
+	maxFacility = 23
+
+	// alwaysFalse is a condition no point can satisfy. InfluxQL has
+	// no boolean literals, so we use a contradiction.
+	alwaysFalse = `("hostname" = '' and "hostname" != '')`
+)
+
+// quoteIdent quotes an InfluxQL identifier, such as a measurement name.
+func quoteIdent(ident string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(ident) + `"`
+}
+
+// quoteString quotes an InfluxQL string literal.
+func quoteString(val string) string {
+	return `'` + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(val) + `'`
+}
+
+// quoteRegex quotes a regular expression as an InfluxQL regex literal.
+func quoteRegex(re *regexp.Regexp) string {
+	return `/` + strings.Replace(re.String(), `/`, `\/`, -1) + `/`
+}
+
+var negatedOperators = map[params.Operator]params.Operator{
+	params.OpEqual:          params.OpNotEqual,
+	params.OpNotEqual:       params.OpEqual,
+	params.OpLessThan:       params.OpGreaterOrEqual,
+	params.OpLessOrEqual:    params.OpGreaterThan,
+	params.OpGreaterThan:    params.OpLessOrEqual,
+	params.OpGreaterOrEqual: params.OpLessThan,
+	params.OpMatch:          params.OpNotMatch,
+	params.OpNotMatch:       params.OpMatch,
+}
+
+// tagSet holds the keys of the structured message fields that are
+// stored as tags.
+type tagSet map[string]bool
+
+func newTagSet(keys []string) tagSet {
+	tags := tagSet{}
+	for _, key := range keys {
+		tags[key] = true
+	}
+	return tags
+}
+
+// filterToInfluxQL translates a filter expression into an InfluxQL
+// condition. InfluxQL has no NOT operator, so negations are pushed
+// down to the individual conditions. An empty return value means the
+// expression matches everything. Structured message fields can only
+// be translated if they are stored as tags.
+func filterToInfluxQL(expr params.Expression, negate bool, tags tagSet) (string, error) {
+	switch e := expr.(type) {
+	case nil:
+		return "", nil
+	case params.Condition:
+		return conditionToInfluxQL(e, negate, tags)
+	case params.Not:
+		return filterToInfluxQL(e.Expression, !negate, tags)
+	case params.And:
+		if negate {
+			return joinExpressions(e, " or ", true, tags)
+		}
+		return joinExpressions(e, " and ", false, tags)
+	case params.Or:
+		if negate {
+			return joinExpressions(e, " and ", true, tags)
+		}
+		return joinExpressions(e, " or ", false, tags)
+	default:
+		return "", fmt.Errorf("unsupported filter expression %T", expr)
+	}
+}
+
+func joinExpressions(exprs []params.Expression, sep string, negate bool, tags tagSet) (string, error) {
+	isOr := sep == " or "
+	parts := []string{}
+	for _, expr := range exprs {
+		part, err := filterToInfluxQL(expr, negate, tags)
+		if err != nil {
+			return "", err
+		}
+		if part == "" {
+			if isOr {
+				// one branch always matches
+				return "", nil
+			}
+			continue
+		}
+		parts = append(parts, part)
+	}
+	if len(parts) == 0 {
+		if isOr {
+			return alwaysFalse, nil
+		}
+		return "", nil
+	}
+	return "(" + strings.Join(parts, sep) + ")", nil
+}
+
+func conditionToInfluxQL(c params.Condition, negate bool, tags tagSet) (string, error) {
+	if err := c.Validate(); err != nil {
+		return "", err
+	}
+	op := c.Operator
+	if negate {
+		op = negatedOperators[op]
+	}
+	field := quoteIdent(string(c.Field))
+	if key := c.Field.FieldKey(); key != "" {
+		if !tags[key] {
+			return "", fmt.Errorf("field %q is not indexed", key)
+		}
+		field = quoteIdent(key)
+	}
+
+	if c.Field == params.FieldReceivedTime {
+		// The receive time is stored as an integer field.
+		want, _ := c.IntValue()
+		return fmt.Sprintf(`%s %s %d`, field, op, want), nil
+	}
+	if c.Field.IsNumeric() {
+		// Severity and facility are stored as string tags, which only
+		// support equality and regex comparisons. Expand the comparison
+		// into the set of matching values. Negations exclude that set,
+		// so that they also match values outside the valid range.
+		want, _ := c.IntValue()
+		max := maxSeverity
+		if c.Field == params.FieldFacility {
+			max = maxFacility
+		}
+		values := []string{}
+		for val := 0; val <= max; val++ {
+			if compareInts(val, c.Operator, want) {
+				values = append(values, fmt.Sprintf("%d", val))
+			}
+		}
+		if len(values) == 0 {
+			if negate {
+				return "", nil
+			}
+			return alwaysFalse, nil
+		}
+		matchOp := params.OpMatch
+		if negate {
+			matchOp = params.OpNotMatch
+		}
+		return fmt.Sprintf(`%s %s /^(%s)$/`, field, matchOp, strings.Join(values, "|")), nil
+	}
+
+	switch op {
+	case params.OpEqual, params.OpNotEqual:
+		return fmt.Sprintf(`%s %s %s`, field, op, quoteString(c.Value.(string))), nil
+	case params.OpMatch, params.OpNotMatch:
+		return fmt.Sprintf(`%s %s %s`, field, op, quoteRegex(c.Value.(*regexp.Regexp))), nil
+	}
+	return "", fmt.Errorf("invalid operator %q", op)
+}
+
+func compareInts(have int, op params.Operator, want int) bool {
+	switch op {
+	case params.OpEqual:
+		return have == want
+	case params.OpNotEqual:
+		return have != want
+	case params.OpLessThan:
+		return have < want
+	case params.OpLessOrEqual:
+		return have <= want
+	case params.OpGreaterThan:
+		return have > want
+	case params.OpGreaterOrEqual:
+		return have >= want
+	}
+	return false
+}
+
+// usesField returns true if the expression references field.
+func usesField(expr params.Expression, field params.Field) bool {
+	switch e := expr.(type) {
+	case params.Condition:
+		return e.Field == field
+	case params.Not:
+		return usesField(e.Expression, field)
+	case params.And:
+		for _, val := range e {
+			if usesField(val, field) {
+				return true
+			}
+		}
+	case params.Or:
+		for _, val := range e {
+			if usesField(val, field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// usesUnindexedField returns true if the expression references a
+// structured message field that is not stored as a tag.
+func usesUnindexedField(expr params.Expression, tags tagSet) bool {
+	switch e := expr.(type) {
+	case params.Condition:
+		key := e.Field.FieldKey()
+		return key != "" && !tags[key]
+	case params.Not:
+		return usesUnindexedField(e.Expression, tags)
+	case params.And:
+		for _, val := range e {
+			if usesUnindexedField(val, tags) {
+				return true
+			}
+		}
+	case params.Or:
+		for _, val := range e {
+			if usesUnindexedField(val, tags) {
+				return true
+			}
+		}
+	}
+	return false
+}
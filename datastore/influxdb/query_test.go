@@ -0,0 +1,299 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package influxdb
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"coriolis-logger/params"
+)
+
+func TestFilterToInfluxQL(t *testing.T) {
+	tags := newTagSet([]string{"task_id"})
+	tests := []struct {
+		name    string
+		filter  params.Expression
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "nil filter",
+			filter: nil,
+			want:   "",
+		},
+		{
+			name:   "string equality",
+			filter: params.Eq(params.FieldHostname, "host-1"),
+			want:   `"hostname" = 'host-1'`,
+		},
+		{
+			name:   "quotes are escaped",
+			filter: params.Eq(params.FieldHostname, `it's\`),
+			want:   `"hostname" = 'it\'s\\'`,
+		},
+		{
+			name:   "regex",
+			filter: params.Matches(params.FieldMessage, regexp.MustCompile(`a/b`)),
+			want:   `"message" =~ /a\/b/`,
+		},
+		{
+			name: "severity range",
+			filter: params.Condition{
+				Field:    params.FieldSeverity,
+				Operator: params.OpLessOrEqual,
+				Value:    3,
+			},
+			want: `"severity" =~ /^(0|1|2|3)$/`,
+		},
+		{
+			name: "empty severity range",
+			filter: params.Condition{
+				Field:    params.FieldSeverity,
+				Operator: params.OpGreaterThan,
+				Value:    7,
+			},
+			want: alwaysFalse,
+		},
+		{
+			name: "negated severity range",
+			filter: params.Not{Expression: params.Condition{
+				Field:    params.FieldSeverity,
+				Operator: params.OpLessOrEqual,
+				Value:    3,
+			}},
+			want: `"severity" !~ /^(0|1|2|3)$/`,
+		},
+		{
+			name: "negated empty severity range",
+			filter: params.Not{Expression: params.Condition{
+				Field:    params.FieldSeverity,
+				Operator: params.OpGreaterThan,
+				Value:    7,
+			}},
+			want: "",
+		},
+		{
+			name: "received time",
+			filter: params.Condition{
+				Field:    params.FieldReceivedTime,
+				Operator: params.OpGreaterOrEqual,
+				Value:    int64(1500000000000000000),
+			},
+			want: `"received_time" >= 1500000000000000000`,
+		},
+		{
+			name: "negated received time",
+			filter: params.Not{Expression: params.Condition{
+				Field:    params.FieldReceivedTime,
+				Operator: params.OpGreaterOrEqual,
+				Value:    int64(1500000000000000000),
+			}},
+			want: `"received_time" < 1500000000000000000`,
+		},
+		{
+			name: "and",
+			filter: params.And{
+				params.Eq(params.FieldHostname, "a"),
+				params.Eq(params.FieldFacility, 1),
+			},
+			want: `("hostname" = 'a' and "facility" =~ /^(1)$/)`,
+		},
+		{
+			name: "negated or",
+			filter: params.Not{Expression: params.Or{
+				params.Eq(params.FieldHostname, "a"),
+				params.Matches(params.FieldMessage, regexp.MustCompile("x")),
+			}},
+			want: `("hostname" != 'a' and "message" !~ /x/)`,
+		},
+		{
+			name:   "empty or",
+			filter: params.Or{},
+			want:   alwaysFalse,
+		},
+		{
+			name:   "empty and",
+			filter: params.And{},
+			want:   "",
+		},
+		{
+			name:   "indexed field",
+			filter: params.Eq(params.FieldOf("task_id"), "t1"),
+			want:   `"task_id" = 't1'`,
+		},
+		{
+			name:    "unindexed field",
+			filter:  params.Eq(params.FieldOf("other"), "t1"),
+			wantErr: true,
+		},
+		{
+			name:    "invalid field",
+			filter:  params.Eq(params.Field("bogus"), "x"),
+			wantErr: true,
+		},
+		{
+			name: "ordering operator on string field",
+			filter: params.Condition{
+				Field:    params.FieldHostname,
+				Operator: params.OpLessThan,
+				Value:    "a",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := filterToInfluxQL(tt.filter, false, tags)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUsesUnindexedField(t *testing.T) {
+	tags := newTagSet([]string{"task_id"})
+	tests := []struct {
+		name   string
+		filter params.Expression
+		want   bool
+	}{
+		{"nil", nil, false},
+		{"builtin field", params.Eq(params.FieldHostname, "a"), false},
+		{"indexed field", params.Eq(params.FieldOf("task_id"), "a"), false},
+		{"unindexed field", params.Eq(params.FieldOf("other"), "a"), true},
+		{"nested", params.Not{Expression: params.Or{
+			params.Eq(params.FieldHostname, "a"),
+			params.And{params.Eq(params.FieldOf("other"), "a")},
+		}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := usesUnindexedField(tt.filter, tags); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrepareQuery(t *testing.T) {
+	store := &InfluxDBDataStore{tags: newTagSet(nil)}
+	cursor := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		params params.QueryParams
+		want   string
+	}{
+		{
+			name:   "all messages",
+			params: params.QueryParams{AppName: "app"},
+			want:   `select time,hostname,severity,facility,message,fields,sender_time,received_time from "app"`,
+		},
+		{
+			name: "descending with limit",
+			params: params.QueryParams{
+				AppName:    "app",
+				Descending: true,
+				Limit:      10,
+				Filter:     params.Eq(params.FieldHostname, "h"),
+			},
+			want: `select time,hostname,severity,facility,message,fields,sender_time,received_time from "app" where "hostname" = 'h' order by time desc limit 10`,
+		},
+		{
+			name: "ascending cursor",
+			params: params.QueryParams{
+				AppName: "app",
+				Limit:   10,
+				Cursor:  &params.Cursor{Timestamp: cursor, Skip: 3},
+			},
+			want: `select time,hostname,severity,facility,message,fields,sender_time,received_time from "app" where time >= 1559390400000000000 limit 13`,
+		},
+		{
+			name: "ascending cursor before the start date",
+			params: params.QueryParams{
+				AppName:   "app",
+				StartDate: cursor.Add(time.Second),
+				Cursor:    &params.Cursor{Timestamp: cursor, Skip: 3},
+			},
+			want: `select time,hostname,severity,facility,message,fields,sender_time,received_time from "app" where time >= 1559390401000000000`,
+		},
+		{
+			name: "descending cursor",
+			params: params.QueryParams{
+				AppName:    "app",
+				Descending: true,
+				EndDate:    cursor.Add(time.Second),
+				Limit:      10,
+				Cursor:     &params.Cursor{Timestamp: cursor, Skip: 1, Descending: true},
+			},
+			want: `select time,hostname,severity,facility,message,fields,sender_time,received_time from "app" where time <= 1559390400000000000 order by time desc limit 11`,
+		},
+		{
+			name: "descending cursor after the end date",
+			params: params.QueryParams{
+				AppName:    "app",
+				Descending: true,
+				EndDate:    cursor.Add(-time.Second),
+				Cursor:     &params.Cursor{Timestamp: cursor, Skip: 1, Descending: true},
+			},
+			want: `select time,hostname,severity,facility,message,fields,sender_time,received_time from "app" where time <= 1559390399000000000 order by time desc`,
+		},
+		{
+			name: "tail",
+			params: params.QueryParams{
+				AppName:    "app",
+				Descending: true,
+				Limit:      5,
+			},
+			want: `select time,hostname,severity,facility,message,fields,sender_time,received_time from "app" order by time desc limit 5`,
+		},
+		{
+			name: "unindexed field is matched in go",
+			params: params.QueryParams{
+				AppName: "app",
+				Limit:   10,
+				Filter:  params.Eq(params.FieldOf("other"), "x"),
+			},
+			want: `select time,hostname,severity,facility,message,fields,sender_time,received_time from "app"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			it := &influxDBIterator{
+				datastore: store,
+				params:    tt.params,
+				matchInGo: usesUnindexedField(tt.params.Filter, store.tags),
+			}
+			got, err := it.prepareQuery()
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
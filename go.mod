@@ -11,6 +11,7 @@ require (
 	github.com/gorilla/websocket v1.5.4-0.20240702125206-a62d9d2a8413
 	github.com/influxdata/influxdb1-client v0.0.0-20220302092344-a9ab5670611c
 	github.com/juju/loggo v1.0.0
+	github.com/klauspost/compress v1.17.9
 	github.com/pkg/errors v0.9.1
 	gopkg.in/mcuadros/go-syslog.v2 v2.3.0
 )
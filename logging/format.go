@@ -0,0 +1,195 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package logging
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// FormatMessage renders only the message, as sent by the app.
+	FormatMessage = "message"
+	// FormatFull renders the time, hostname, app name and severity
+	// of each message.
+	FormatFull = "full"
+	// FormatRaw reconstructs an RFC 5424 syslog line.
+	FormatRaw = "raw"
+	// FormatPrefixed renders the app name and hostname of each
+	// message. It is used for streams that hold several logs.
+	FormatPrefixed = "prefixed"
+)
+
+// BuiltinFormats are the line templates that are always available
+var BuiltinFormats = map[string]string{
+	FormatMessage:  "{message}",
+	FormatFull:     "{time} {hostname} {app_name} {severity_name}: {message}",
+	FormatRaw:      "<{priority}>1 {time} {hostname} {app_name} {proc_id} - - {message}",
+	FormatPrefixed: "{app_name} {hostname}: {message}",
+}
+
+type formatField func(buf *bytes.Buffer, msg LogMessage)
+
+// nilValue is written in place of empty fields, as in syslog
+const nilValue = "-"
+
+func writeOrNil(buf *bytes.Buffer, val string) {
+	if val == "" {
+		val = nilValue
+	}
+	buf.WriteString(val)
+}
+
+func writeTimeOrNil(buf *bytes.Buffer, val time.Time) {
+	if val.IsZero() {
+		buf.WriteString(nilValue)
+		return
+	}
+	buf.WriteString(val.UTC().Format(time.RFC3339Nano))
+}
+
+var formatFields = map[string]formatField{
+	"time": func(buf *bytes.Buffer, msg LogMessage) {
+		buf.WriteString(msg.Timestamp.UTC().Format(time.RFC3339Nano))
+	},
+	"sender_time": func(buf *bytes.Buffer, msg LogMessage) {
+		writeTimeOrNil(buf, msg.SenderTimestamp)
+	},
+	"received_time": func(buf *bytes.Buffer, msg LogMessage) {
+		writeTimeOrNil(buf, msg.ReceivedAt)
+	},
+	"unix": func(buf *bytes.Buffer, msg LogMessage) {
+		buf.WriteString(strconv.FormatInt(msg.Timestamp.Unix(), 10))
+	},
+	"hostname": func(buf *bytes.Buffer, msg LogMessage) {
+		writeOrNil(buf, msg.Hostname)
+	},
+	"app_name": func(buf *bytes.Buffer, msg LogMessage) {
+		writeOrNil(buf, msg.AppName)
+	},
+	"severity": func(buf *bytes.Buffer, msg LogMessage) {
+		buf.WriteString(msg.Severity.String())
+	},
+	"severity_name": func(buf *bytes.Buffer, msg LogMessage) {
+		buf.WriteString(msg.Severity.Name())
+	},
+	"facility": func(buf *bytes.Buffer, msg LogMessage) {
+		buf.WriteString(msg.Facility.String())
+	},
+	"priority": func(buf *bytes.Buffer, msg LogMessage) {
+		// Datastores may not keep the priority, but it can be
+		// computed from the facility and severity.
+		severity := msg.Severity
+		if severity < Emergency || severity > Debug {
+			severity = DefaultSeverityLevel
+		}
+		buf.WriteString(strconv.Itoa(int(msg.Facility)*8 + int(severity)))
+	},
+	"proc_id": func(buf *bytes.Buffer, msg LogMessage) {
+		if msg.ProcID == 0 {
+			buf.WriteString(nilValue)
+			return
+		}
+		buf.WriteString(strconv.Itoa(msg.ProcID))
+	},
+	"message": func(buf *bytes.Buffer, msg LogMessage) {
+		buf.WriteString(strings.TrimSuffix(msg.Message, "\n"))
+	},
+	"fields": func(buf *bytes.Buffer, msg LogMessage) {
+		if len(msg.Fields) == 0 {
+			buf.WriteString(nilValue)
+			return
+		}
+		writeOrNil(buf, FieldString(msg.Fields))
+	},
+}
+
+// fieldPrefix selects a single message field in line templates, as
+// in "{fields.task_id}".
+const fieldPrefix = "fields."
+
+func lookupFormatField(name string) (formatField, bool) {
+	if strings.HasPrefix(name, fieldPrefix) && len(name) > len(fieldPrefix) {
+		key := name[len(fieldPrefix):]
+		return func(buf *bytes.Buffer, msg LogMessage) {
+			writeOrNil(buf, FieldString(msg.Fields[key]))
+		}, true
+	}
+	field, ok := formatFields[name]
+	return field, ok
+}
+
+// LineFormat renders log messages as single lines of text, using a
+// template. Templates hold field names in curly braces, for example
+// "{time} {hostname}: {message}". Literal braces are written as "{{"
+// and "}}".
+type LineFormat struct {
+	fields []formatField
+}
+
+// ParseLineFormat parses a line template
+func ParseLineFormat(tmpl string) (*LineFormat, error) {
+	ret := &LineFormat{}
+	literal := strings.Builder{}
+	flush := func() {
+		if literal.Len() == 0 {
+			return
+		}
+		val := literal.String()
+		ret.fields = append(ret.fields, func(buf *bytes.Buffer, _ LogMessage) {
+			buf.WriteString(val)
+		})
+		literal.Reset()
+	}
+	for idx := 0; idx < len(tmpl); idx++ {
+		c := tmpl[idx]
+		switch {
+		case c == '{' && strings.HasPrefix(tmpl[idx:], "{{"),
+			c == '}' && strings.HasPrefix(tmpl[idx:], "}}"):
+			literal.WriteByte(c)
+			idx++
+		case c == '{':
+			end := strings.IndexByte(tmpl[idx:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated field in line format %q", tmpl)
+			}
+			name := tmpl[idx+1 : idx+end]
+			field, ok := lookupFormatField(name)
+			if !ok {
+				return nil, fmt.Errorf("unknown field %q in line format", name)
+			}
+			flush()
+			ret.fields = append(ret.fields, field)
+			idx += end
+		case c == '}':
+			return nil, fmt.Errorf("unexpected '}' in line format %q", tmpl)
+		default:
+			literal.WriteByte(c)
+		}
+	}
+	flush()
+	return ret, nil
+}
+
+// Append writes msg to buf, as a newline terminated line.
+func (f *LineFormat) Append(buf *bytes.Buffer, msg LogMessage) {
+	for _, field := range f.fields {
+		field(buf, msg)
+	}
+	buf.WriteByte('\n')
+}
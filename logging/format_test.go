@@ -0,0 +1,134 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package logging
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestLineFormat(t *testing.T) {
+	stamp := time.Date(2019, 6, 1, 12, 30, 0, 500000000, time.UTC)
+	msg := LogMessage{
+		Timestamp: stamp,
+		Hostname:  "host-1",
+		AppName:   "coriolis-worker",
+		Severity:  Error,
+		Facility:  UserLevelMessages,
+		ProcID:    42,
+		Message:   "task failed\n",
+		Fields: map[string]interface{}{
+			"task_id": "1234",
+			"retries": float64(3),
+		},
+	}
+
+	tests := []struct {
+		name    string
+		tmpl    string
+		msg     LogMessage
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "message",
+			tmpl: BuiltinFormats[FormatMessage],
+			msg:  msg,
+			want: "task failed\n",
+		},
+		{
+			name: "full",
+			tmpl: BuiltinFormats[FormatFull],
+			msg:  msg,
+			want: "2019-06-01T12:30:00.5Z host-1 coriolis-worker err: task failed\n",
+		},
+		{
+			name: "raw",
+			tmpl: BuiltinFormats[FormatRaw],
+			msg:  msg,
+			want: "<11>1 2019-06-01T12:30:00.5Z host-1 coriolis-worker 42 - - task failed\n",
+		},
+		{
+			name: "prefixed",
+			tmpl: BuiltinFormats[FormatPrefixed],
+			msg:  msg,
+			want: "coriolis-worker host-1: task failed\n",
+		},
+		{
+			name: "empty values are written as nil",
+			tmpl: "{hostname} {proc_id} {fields} {sender_time} {received_time}",
+			msg:  LogMessage{},
+			want: "- - - - -\n",
+		},
+		{
+			name: "unknown severity uses the default priority",
+			tmpl: "{priority} {severity} {severity_name}",
+			msg:  LogMessage{Severity: UnknownSeverity, Facility: UserLevelMessages},
+			want: "14 -1 unknown\n",
+		},
+		{
+			name: "fields",
+			tmpl: "{fields.task_id} {fields.retries} {fields.missing} {fields}",
+			msg:  msg,
+			want: `1234 3 - {"retries":3,"task_id":"1234"}` + "\n",
+		},
+		{
+			name: "unix and escaped braces",
+			tmpl: "{{{unix}}}",
+			msg:  msg,
+			want: "{1559392200}\n",
+		},
+		{
+			name:    "unknown field",
+			tmpl:    "{bogus}",
+			wantErr: true,
+		},
+		{
+			name:    "empty field prefix",
+			tmpl:    "{fields.}",
+			wantErr: true,
+		},
+		{
+			name:    "unterminated field",
+			tmpl:    "{message",
+			wantErr: true,
+		},
+		{
+			name:    "unexpected closing brace",
+			tmpl:    "message}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			format, err := ParseLineFormat(tt.tmpl)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error parsing %q", tt.tmpl)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsing %q: %v", tt.tmpl, err)
+			}
+			buf := &bytes.Buffer{}
+			format.Append(buf, tt.msg)
+			if got := buf.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
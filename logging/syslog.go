@@ -15,6 +15,7 @@
 package logging
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"time"
@@ -85,7 +86,29 @@ const (
 	DefaultSeverityLevel = Informational
 )
 
+var severityNames = map[Severity]string{
+	Emergency:     "emerg",
+	Alert:         "alert",
+	Critical:      "crit",
+	Error:         "err",
+	Warning:       "warning",
+	Notice:        "notice",
+	Informational: "info",
+	Debug:         "debug",
+}
+
+// Name returns the syslog keyword of the severity level
+func (s Severity) Name() string {
+	if name, ok := severityNames[s]; ok {
+		return name
+	}
+	return "unknown"
+}
+
 type LogMessage struct {
+	// Timestamp is the time the message is stored and ordered by. It
+	// is either SenderTimestamp or ReceivedAt, as decided by the
+	// timestamp policy.
 	Timestamp time.Time
 	Hostname  string
 	Priority  int
@@ -95,6 +118,42 @@ type LogMessage struct {
 	ProcID    int
 	Message   string
 	RFC       RFCVersion
+	// SenderTimestamp is the timestamp set by the sender.
+	SenderTimestamp time.Time
+	// ReceivedAt is the time the message was received.
+	ReceivedAt time.Time
+	// Listener is the name of the listener that received the message.
+	Listener string
+	// PeerAddress is the address of the sender, if known.
+	PeerAddress string
+	// StructuredData holds the raw RFC 5424 structured data elements
+	// of the message, if any.
+	StructuredData string
+	// Fields holds the structured data parsed from the message.
+	Fields map[string]interface{}
+}
+
+// FieldString returns the text form of a message field value, used
+// to compare and index field values.
+func FieldString(val interface{}) string {
+	switch v := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
 }
 
 func validateMessage(msg map[string]interface{}, rfc RFCVersion) bool {
@@ -140,6 +199,12 @@ func SyslogToLogMessage(msg map[string]interface{}) (LogMessage, error) {
 	}
 	switch rfc {
 	case RFC3164:
+		// The PID in the tag, if any, is added as proc_id by the
+		// syslog worker.
+		var procID int
+		if parsedProcID, ok := msg["proc_id"].(string); ok {
+			procID, _ = strconv.Atoi(parsedProcID)
+		}
 		return LogMessage{
 			Timestamp: msg["timestamp"].(time.Time),
 			Hostname:  msg["hostname"].(string),
@@ -148,6 +213,7 @@ func SyslogToLogMessage(msg map[string]interface{}) (LogMessage, error) {
 			Severity:  Severity(msg["severity"].(int)),
 			AppName:   msg["tag"].(string),
 			Message:   msg["content"].(string),
+			ProcID:    procID,
 			RFC:       rfc,
 		}, nil
 	case RFC5424:
@@ -156,6 +222,10 @@ func SyslogToLogMessage(msg map[string]interface{}) (LogMessage, error) {
 		if parsedProcID != "" && parsedProcID != "-" {
 			procID, _ = strconv.Atoi(parsedProcID)
 		}
+		structuredData, _ := msg["structured_data"].(string)
+		if structuredData == "-" {
+			structuredData = ""
+		}
 		return LogMessage{
 			Timestamp: msg["timestamp"].(time.Time),
 			Hostname:  msg["hostname"].(string),
@@ -166,6 +236,8 @@ func SyslogToLogMessage(msg map[string]interface{}) (LogMessage, error) {
 			Message:   msg["message"].(string),
 			ProcID:    procID,
 			RFC:       rfc,
+
+			StructuredData: structuredData,
 		}, nil
 	default:
 		return LogMessage{}, fmt.Errorf("failed to parse log message")
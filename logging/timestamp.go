@@ -0,0 +1,160 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package logging
+
+import (
+	"path"
+	"time"
+)
+
+// TimestampSource selects the timestamp a message is stored with
+type TimestampSource string
+
+const (
+	// TimestampAuto uses the sender timestamp of RFC 5424 messages,
+	// and the receive time of RFC 3164 messages.
+	TimestampAuto TimestampSource = "auto"
+	// TimestampSender uses the timestamp set by the sender.
+	TimestampSender TimestampSource = "sender"
+	// TimestampReceiver uses the time the message was received.
+	TimestampReceiver TimestampSource = "receiver"
+)
+
+// rfc3164YearRollover is how far in the future an RFC 3164 timestamp
+// may be before it is assumed to be from the previous year. RFC 3164
+// timestamps have no year, and are given the year they are received
+// in, so messages sent on December 31st and received on January 1st
+// would otherwise be a year off.
+const rfc3164YearRollover = 30 * 24 * time.Hour
+
+// TimezoneOverride sets the timezone of the RFC 3164 timestamps of
+// messages matching a listener name and hostname glob. Empty globs
+// match everything.
+type TimezoneOverride struct {
+	Listener string
+	Hostname string
+	Location *time.Location
+}
+
+func (t TimezoneOverride) match(msg LogMessage) bool {
+	if t.Listener != "" {
+		if matched, _ := path.Match(t.Listener, msg.Listener); !matched {
+			return false
+		}
+	}
+	if t.Hostname != "" {
+		if matched, _ := path.Match(t.Hostname, msg.Hostname); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// NewTimestampPolicy returns a timestamp policy. A nil location is
+// treated as UTC, and a maxSkew of 0 disables the clock skew check.
+func NewTimestampPolicy(source TimestampSource, location *time.Location, maxSkew time.Duration, overrides []TimezoneOverride) *TimestampPolicy {
+	if source == "" {
+		source = TimestampAuto
+	}
+	if location == nil {
+		location = time.UTC
+	}
+	return &TimestampPolicy{
+		source:    source,
+		location:  location,
+		maxSkew:   maxSkew,
+		overrides: overrides,
+	}
+}
+
+// TimestampPolicy decides the timestamp log messages are stored and
+// ordered by.
+type TimestampPolicy struct {
+	source    TimestampSource
+	location  *time.Location
+	maxSkew   time.Duration
+	overrides []TimezoneOverride
+}
+
+func (p *TimestampPolicy) locationOf(msg LogMessage) *time.Location {
+	for _, override := range p.overrides {
+		if override.match(msg) {
+			return override.Location
+		}
+	}
+	return p.location
+}
+
+// Apply sets the sender timestamp of msg, adjusting RFC 3164
+// timestamps to the timezone of their source, and sets the timestamp
+// of msg to either the sender timestamp or the receive time. Sender
+// timestamps more than the maximum skew away from the receive time
+// are not used. If the receive time of msg is not set, the current
+// time is used.
+func (p *TimestampPolicy) Apply(msg *LogMessage) {
+	if msg.ReceivedAt.IsZero() {
+		msg.ReceivedAt = time.Now()
+	}
+	sender := msg.Timestamp
+	if msg.RFC == RFC3164 && !sender.IsZero() {
+		// The parser reads RFC 3164 timestamps as UTC. Keep the wall
+		// clock, in the timezone of the source.
+		sender = time.Date(
+			sender.Year(), sender.Month(), sender.Day(),
+			sender.Hour(), sender.Minute(), sender.Second(),
+			sender.Nanosecond(), p.locationOf(*msg))
+		if sender.Sub(msg.ReceivedAt) > rfc3164YearRollover {
+			sender = sender.AddDate(-1, 0, 0)
+		}
+	}
+	msg.SenderTimestamp = sender
+
+	source := p.source
+	if source == TimestampAuto {
+		source = TimestampSender
+		if msg.RFC == RFC3164 {
+			source = TimestampReceiver
+		}
+	}
+	msg.Timestamp = sender
+	if source == TimestampReceiver || sender.IsZero() || p.skewed(sender, msg.ReceivedAt) {
+		msg.Timestamp = msg.ReceivedAt
+	}
+}
+
+// ReceivedSyslogMessage converts a syslog message received by the
+// named listener at receivedAt, and applies the timestamp policy.
+func (p *TimestampPolicy) ReceivedSyslogMessage(parts map[string]interface{}, listener string, receivedAt time.Time) (LogMessage, error) {
+	msg, err := SyslogToLogMessage(parts)
+	if err != nil {
+		return LogMessage{}, err
+	}
+	msg.ReceivedAt = receivedAt
+	msg.Listener = listener
+	msg.PeerAddress, _ = parts["client"].(string)
+	p.Apply(&msg)
+	return msg, nil
+}
+
+func (p *TimestampPolicy) skewed(sender, received time.Time) bool {
+	if p.maxSkew <= 0 {
+		return false
+	}
+	skew := sender.Sub(received)
+	if skew < 0 {
+		skew = -skew
+	}
+	return skew > p.maxSkew
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package logging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimestampPolicy(t *testing.T) {
+	bucharest, err := time.LoadLocation("Europe/Bucharest")
+	if err != nil {
+		t.Fatalf("loading timezone: %v", err)
+	}
+	received := time.Date(2019, 6, 1, 12, 30, 5, 250000000, time.UTC)
+	// RFC 3164 timestamps are parsed as UTC, whatever their timezone.
+	wallClock := time.Date(2019, 6, 1, 15, 30, 4, 0, time.UTC)
+	sent := time.Date(2019, 6, 1, 12, 30, 4, 0, time.UTC)
+	precise := time.Date(2019, 6, 1, 12, 30, 4, 125000000, time.UTC)
+
+	tests := []struct {
+		name       string
+		policy     *TimestampPolicy
+		msg        LogMessage
+		wantSender time.Time
+		want       time.Time
+	}{
+		{
+			name:       "auto uses the sender timestamp of RFC 5424 messages",
+			policy:     NewTimestampPolicy(TimestampAuto, nil, 0, nil),
+			msg:        LogMessage{RFC: RFC5424, Timestamp: precise, ReceivedAt: received},
+			wantSender: precise,
+			want:       precise,
+		},
+		{
+			name:       "auto uses the receive time of RFC 3164 messages",
+			policy:     NewTimestampPolicy(TimestampAuto, nil, 0, nil),
+			msg:        LogMessage{RFC: RFC3164, Timestamp: sent, ReceivedAt: received},
+			wantSender: sent,
+			want:       received,
+		},
+		{
+			name:       "whole seconds are kept",
+			policy:     NewTimestampPolicy(TimestampSender, nil, 0, nil),
+			msg:        LogMessage{RFC: RFC3164, Timestamp: sent, ReceivedAt: received},
+			wantSender: sent,
+			want:       sent,
+		},
+		{
+			name:       "receiver",
+			policy:     NewTimestampPolicy(TimestampReceiver, nil, 0, nil),
+			msg:        LogMessage{RFC: RFC5424, Timestamp: precise, ReceivedAt: received},
+			wantSender: precise,
+			want:       received,
+		},
+		{
+			name:   "RFC 3164 timezone",
+			policy: NewTimestampPolicy(TimestampSender, bucharest, 0, nil),
+			msg:    LogMessage{RFC: RFC3164, Timestamp: wallClock, ReceivedAt: received},
+			// Bucharest is 3 hours ahead of UTC in June.
+			wantSender: sent.In(bucharest),
+			want:       sent,
+		},
+		{
+			name: "timezone override",
+			policy: NewTimestampPolicy(TimestampSender, nil, 0, []TimezoneOverride{
+				{Hostname: "other-*", Location: time.UTC},
+				{Hostname: "host-*", Location: bucharest},
+			}),
+			msg:        LogMessage{RFC: RFC3164, Hostname: "host-1", Timestamp: wallClock, ReceivedAt: received},
+			wantSender: sent.In(bucharest),
+			want:       sent,
+		},
+		{
+			name:       "RFC 3164 timestamps in the future are from last year",
+			policy:     NewTimestampPolicy(TimestampSender, nil, 0, nil),
+			msg:        LogMessage{RFC: RFC3164, Timestamp: time.Date(2019, 12, 31, 23, 59, 59, 0, time.UTC), ReceivedAt: received},
+			wantSender: time.Date(2018, 12, 31, 23, 59, 59, 0, time.UTC),
+			want:       time.Date(2018, 12, 31, 23, 59, 59, 0, time.UTC),
+		},
+		{
+			name:       "skewed sender timestamps are not used",
+			policy:     NewTimestampPolicy(TimestampSender, nil, time.Minute, nil),
+			msg:        LogMessage{RFC: RFC5424, Timestamp: precise.Add(-time.Hour), ReceivedAt: received},
+			wantSender: precise.Add(-time.Hour),
+			want:       received,
+		},
+		{
+			name:   "missing sender timestamp",
+			policy: NewTimestampPolicy(TimestampSender, nil, 0, nil),
+			msg:    LogMessage{RFC: RFC5424, ReceivedAt: received},
+			want:   received,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.msg
+			tt.policy.Apply(&msg)
+			if !msg.SenderTimestamp.Equal(tt.wantSender) {
+				t.Errorf("got sender timestamp %v, want %v", msg.SenderTimestamp, tt.wantSender)
+			}
+			if !msg.Timestamp.Equal(tt.want) {
+				t.Errorf("got timestamp %v, want %v", msg.Timestamp, tt.want)
+			}
+		})
+	}
+}
+
+func TestReceivedSyslogMessage(t *testing.T) {
+	policy := NewTimestampPolicy(TimestampSender, nil, 0, nil)
+	sent := time.Date(2019, 6, 1, 12, 30, 4, 0, time.UTC)
+	parts := map[string]interface{}{
+		"timestamp": sent,
+		"hostname":  "host-1",
+		"priority":  11,
+		"facility":  1,
+		"severity":  3,
+		"tag":       "coriolis-worker",
+		"content":   "task failed",
+		"client":    "10.0.0.1:514",
+	}
+
+	received := sent.Add(time.Second)
+	msg, err := policy.ReceivedSyslogMessage(parts, "udp", received)
+	if err != nil {
+		t.Fatalf("converting message: %v", err)
+	}
+	if msg.Listener != "udp" || msg.PeerAddress != "10.0.0.1:514" || !msg.ReceivedAt.Equal(received) {
+		t.Errorf("got message %+v", msg)
+	}
+	if !msg.Timestamp.Equal(sent) {
+		t.Errorf("got timestamp %v, want the sender timestamp %v", msg.Timestamp, sent)
+	}
+
+	if _, err := policy.ReceivedSyslogMessage(map[string]interface{}{}, "udp", sent); err == nil {
+		t.Errorf("expected an error converting an invalid message")
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cursor marks a position in a log. Several messages may share the
+// same timestamp, so a cursor holds the timestamp of the last message
+// that was read, and the number of messages with that timestamp that
+// were already read. This relies on datastores returning messages
+// with equal timestamps in a stable order.
+type Cursor struct {
+	Timestamp time.Time
+	Skip      int
+	// Descending is true if the cursor walks the log from newest
+	// to oldest.
+	Descending bool
+}
+
+// Encode returns the opaque string representation of the cursor
+func (c Cursor) Encode() string {
+	order := "a"
+	if c.Descending {
+		order = "d"
+	}
+	raw := fmt.Sprintf("%s:%d:%d", order, c.Timestamp.UnixNano(), c.Skip)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// DecodeCursor parses a cursor returned by Cursor.Encode
+func DecodeCursor(cursor string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 || (parts[0] != "a" && parts[0] != "d") {
+		return Cursor{}, fmt.Errorf("invalid cursor")
+	}
+	stamp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return Cursor{}, fmt.Errorf("invalid cursor")
+	}
+	skip, err := strconv.Atoi(parts[2])
+	if err != nil || skip < 0 {
+		return Cursor{}, fmt.Errorf("invalid cursor")
+	}
+	return Cursor{
+		Timestamp:  time.Unix(0, stamp).UTC(),
+		Skip:       skip,
+		Descending: parts[0] == "d",
+	}, nil
+}
+
+// Advance returns the cursor that follows a page of messages read
+// from this cursor (or from the start of the log, if prev is nil).
+// Timestamps must be in the order they were read.
+func Advance(prev *Cursor, timestamps []time.Time, descending bool) Cursor {
+	if len(timestamps) == 0 {
+		if prev != nil {
+			return *prev
+		}
+		return Cursor{Descending: descending}
+	}
+	last := timestamps[len(timestamps)-1]
+	next := Cursor{
+		Timestamp:  last,
+		Descending: descending,
+	}
+	for idx := len(timestamps) - 1; idx >= 0 && timestamps[idx].Equal(last); idx-- {
+		next.Skip++
+	}
+	if prev != nil && prev.Timestamp.Equal(last) && next.Skip == len(timestamps) {
+		// The whole page shares the timestamp of the previous cursor.
+		next.Skip += prev.Skip
+	}
+	return next
+}
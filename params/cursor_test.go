@@ -0,0 +1,136 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"encoding/base64"
+	"testing"
+	"time"
+)
+
+func TestCursorEncoding(t *testing.T) {
+	stamp := time.Date(2019, 6, 1, 12, 0, 0, 123456789, time.UTC)
+	for _, cursor := range []Cursor{
+		{Timestamp: stamp, Skip: 3},
+		{Timestamp: stamp, Descending: true},
+		{Timestamp: time.Unix(0, 0).UTC()},
+	} {
+		got, err := DecodeCursor(cursor.Encode())
+		if err != nil {
+			t.Fatalf("decoding %+v: %v", cursor, err)
+		}
+		if got != cursor {
+			t.Errorf("got %+v, want %+v", got, cursor)
+		}
+	}
+
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+	for _, invalid := range []string{
+		"",
+		"not base64!",
+		encode("a:1"),
+		encode("x:1:0"),
+		encode("a:stamp:0"),
+		encode("a:1:skip"),
+		encode("a:1:-1"),
+		encode("a:1:0:0"),
+	} {
+		if _, err := DecodeCursor(invalid); err == nil {
+			t.Errorf("decoding %q did not fail", invalid)
+		}
+	}
+}
+
+func TestAdvance(t *testing.T) {
+	base := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds ...int) []time.Time {
+		ret := []time.Time{}
+		for _, s := range seconds {
+			ret = append(ret, base.Add(time.Duration(s)*time.Second))
+		}
+		return ret
+	}
+
+	tests := []struct {
+		name       string
+		prev       *Cursor
+		timestamps []time.Time
+		descending bool
+		want       Cursor
+	}{
+		{
+			name: "empty first page",
+			want: Cursor{},
+		},
+		{
+			name:       "empty page keeps the cursor",
+			prev:       &Cursor{Timestamp: base, Skip: 2, Descending: true},
+			descending: true,
+			want:       Cursor{Timestamp: base, Skip: 2, Descending: true},
+		},
+		{
+			name:       "distinct timestamps",
+			timestamps: at(1, 2, 3),
+			want:       Cursor{Timestamp: at(3)[0], Skip: 1},
+		},
+		{
+			name:       "page ending with shared timestamps",
+			timestamps: at(1, 2, 2, 2),
+			want:       Cursor{Timestamp: at(2)[0], Skip: 3},
+		},
+		{
+			name:       "page moving past the previous timestamp",
+			prev:       &Cursor{Timestamp: at(1)[0], Skip: 4},
+			timestamps: at(1, 2, 2),
+			want:       Cursor{Timestamp: at(2)[0], Skip: 2},
+		},
+		{
+			name:       "page sharing the previous timestamp",
+			prev:       &Cursor{Timestamp: at(1)[0], Skip: 4},
+			timestamps: at(1, 1, 1),
+			want:       Cursor{Timestamp: at(1)[0], Skip: 7},
+		},
+		{
+			name:       "page sharing a timestamp other than the previous one",
+			prev:       &Cursor{Timestamp: at(1)[0], Skip: 4},
+			timestamps: at(2, 2),
+			want:       Cursor{Timestamp: at(2)[0], Skip: 2},
+		},
+		{
+			name:       "descending",
+			prev:       &Cursor{Timestamp: at(5)[0], Skip: 1, Descending: true},
+			timestamps: at(4, 3, 3),
+			descending: true,
+			want:       Cursor{Timestamp: at(3)[0], Skip: 2, Descending: true},
+		},
+		{
+			name:       "descending page sharing the previous timestamp",
+			prev:       &Cursor{Timestamp: at(3)[0], Skip: 2, Descending: true},
+			timestamps: at(3, 3),
+			descending: true,
+			want:       Cursor{Timestamp: at(3)[0], Skip: 4, Descending: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Advance(tt.prev, tt.timestamps, tt.descending)
+			if !got.Timestamp.Equal(tt.want.Timestamp) || got.Skip != tt.want.Skip || got.Descending != tt.want.Descending {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package params
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"coriolis-logger/logging"
+)
+
+// Field identifies a log message attribute that can be used in a filter
+type Field string
+
+// Operator is a comparison operator used in a filter condition
+type Operator string
+
+const (
+	FieldHostname Field = "hostname"
+	FieldSeverity Field = "severity"
+	FieldFacility Field = "facility"
+	FieldMessage  Field = "message"
+	// FieldReceivedTime is the time a message was received, compared
+	// as Unix nanoseconds.
+	FieldReceivedTime Field = "received_time"
+
+	// FieldPrefix is the prefix of fields that select a key of the
+	// structured fields parsed from a message, as in "fields.task_id".
+	FieldPrefix = "fields."
+
+	OpEqual          Operator = "="
+	OpNotEqual       Operator = "!="
+	OpLessThan       Operator = "<"
+	OpLessOrEqual    Operator = "<="
+	OpGreaterThan    Operator = ">"
+	OpGreaterOrEqual Operator = ">="
+	OpMatch          Operator = "=~"
+	OpNotMatch       Operator = "!~"
+)
+
+// Expression is a node in a filter expression tree. Datastores either
+// translate expressions into their native query language, or fall back
+// to evaluating them using Match.
+type Expression interface {
+	Validate() error
+	Match(msg logging.LogMessage) bool
+}
+
+// Condition compares a single log message field to a value. String
+// fields (hostname, message and structured fields) accept a string value for equality
+// operators and a *regexp.Regexp for OpMatch and OpNotMatch. Numeric
+// fields (severity, facility, received time) accept an int, int64,
+// logging.Severity or logging.Facility, and support all ordering
+// operators.
+type Condition struct {
+	Field    Field
+	Operator Operator
+	Value    interface{}
+}
+
+// Eq returns a condition that matches when field equals value
+func Eq(field Field, value interface{}) Condition {
+	return Condition{Field: field, Operator: OpEqual, Value: value}
+}
+
+// Matches returns a condition that matches when field matches re
+func Matches(field Field, re *regexp.Regexp) Condition {
+	return Condition{Field: field, Operator: OpMatch, Value: re}
+}
+
+// FieldOf returns the field selecting key in the structured fields of
+// a message.
+func FieldOf(key string) Field {
+	return Field(FieldPrefix + key)
+}
+
+// FieldKey returns the key of a structured message field, or an empty
+// string if f is not one.
+func (f Field) FieldKey() string {
+	if !strings.HasPrefix(string(f), FieldPrefix) {
+		return ""
+	}
+	return string(f)[len(FieldPrefix):]
+}
+
+// IsNumeric returns true if the field holds an integer value
+func (f Field) IsNumeric() bool {
+	return f == FieldSeverity || f == FieldFacility || f == FieldReceivedTime
+}
+
+// IntValue returns the condition value as an int. It is only valid
+// for numeric fields.
+func (c Condition) IntValue() (int, error) {
+	switch val := c.Value.(type) {
+	case int:
+		return val, nil
+	case int64:
+		return int(val), nil
+	case logging.Severity:
+		return int(val), nil
+	case logging.Facility:
+		return int(val), nil
+	default:
+		return 0, fmt.Errorf("invalid value %v for field %q", c.Value, c.Field)
+	}
+}
+
+func (c Condition) Validate() error {
+	switch c.Field {
+	case FieldHostname, FieldMessage, FieldSeverity, FieldFacility, FieldReceivedTime:
+	default:
+		if c.Field.FieldKey() == "" {
+			return fmt.Errorf("invalid filter field %q", c.Field)
+		}
+	}
+
+	switch c.Operator {
+	case OpMatch, OpNotMatch:
+		if c.Field.IsNumeric() {
+			return fmt.Errorf("operator %q is not valid for field %q", c.Operator, c.Field)
+		}
+		if re, ok := c.Value.(*regexp.Regexp); !ok || re == nil {
+			return fmt.Errorf("operator %q requires a regular expression", c.Operator)
+		}
+	case OpEqual, OpNotEqual:
+		if c.Field.IsNumeric() {
+			if _, err := c.IntValue(); err != nil {
+				return err
+			}
+		} else if _, ok := c.Value.(string); !ok {
+			return fmt.Errorf("invalid value %v for field %q", c.Value, c.Field)
+		}
+	case OpLessThan, OpLessOrEqual, OpGreaterThan, OpGreaterOrEqual:
+		if !c.Field.IsNumeric() {
+			return fmt.Errorf("operator %q is not valid for field %q", c.Operator, c.Field)
+		}
+		if _, err := c.IntValue(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("invalid operator %q", c.Operator)
+	}
+	return nil
+}
+
+func (c Condition) stringField(msg logging.LogMessage) string {
+	switch c.Field {
+	case FieldHostname:
+		return msg.Hostname
+	case FieldMessage:
+		return msg.Message
+	}
+	if key := c.Field.FieldKey(); key != "" {
+		return logging.FieldString(msg.Fields[key])
+	}
+	return ""
+}
+
+func (c Condition) intField(msg logging.LogMessage) int {
+	switch c.Field {
+	case FieldSeverity:
+		return int(msg.Severity)
+	case FieldFacility:
+		return int(msg.Facility)
+	case FieldReceivedTime:
+		return int(msg.ReceivedAt.UnixNano())
+	}
+	return 0
+}
+
+func (c Condition) Match(msg logging.LogMessage) bool {
+	if c.Field.IsNumeric() {
+		want, err := c.IntValue()
+		if err != nil {
+			return false
+		}
+		have := c.intField(msg)
+		switch c.Operator {
+		case OpEqual:
+			return have == want
+		case OpNotEqual:
+			return have != want
+		case OpLessThan:
+			return have < want
+		case OpLessOrEqual:
+			return have <= want
+		case OpGreaterThan:
+			return have > want
+		case OpGreaterOrEqual:
+			return have >= want
+		}
+		return false
+	}
+
+	have := c.stringField(msg)
+	switch c.Operator {
+	case OpEqual:
+		want, _ := c.Value.(string)
+		return have == want
+	case OpNotEqual:
+		want, _ := c.Value.(string)
+		return have != want
+	case OpMatch, OpNotMatch:
+		re, ok := c.Value.(*regexp.Regexp)
+		if !ok || re == nil {
+			return false
+		}
+		return re.MatchString(have) == (c.Operator == OpMatch)
+	}
+	return false
+}
+
+// And matches if all of its expressions match. An empty And matches
+// everything.
+type And []Expression
+
+func (a And) Validate() error {
+	for _, expr := range a {
+		if err := expr.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a And) Match(msg logging.LogMessage) bool {
+	for _, expr := range a {
+		if !expr.Match(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// Or matches if any of its expressions match. An empty Or matches
+// nothing.
+type Or []Expression
+
+func (o Or) Validate() error {
+	for _, expr := range o {
+		if err := expr.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o Or) Match(msg logging.LogMessage) bool {
+	for _, expr := range o {
+		if expr.Match(msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// Not negates the wrapped expression
+type Not struct {
+	Expression Expression
+}
+
+func (n Not) Validate() error {
+	if n.Expression == nil {
+		return fmt.Errorf("missing expression in negation")
+	}
+	return n.Expression.Validate()
+}
+
+func (n Not) Match(msg logging.LogMessage) bool {
+	return !n.Expression.Match(msg)
+}
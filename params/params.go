@@ -14,13 +14,78 @@
 
 package params
 
-import "time"
+import (
+	"fmt"
+	"time"
+
+	"coriolis-logger/logging"
+)
 
 // QueryParams represents log filter parameters for log readers
 type QueryParams struct {
-	Hostname  string
+	AppName   string
 	StartDate time.Time
 	EndDate   time.Time
-	AppName   string
-	Severity  int
+	// Filter is an optional expression applied to every message
+	// in the selected time range.
+	Filter Expression
+	// Limit is the maximum number of messages to return. A value
+	// of 0 means no limit.
+	Limit int
+	// Descending returns messages from newest to oldest.
+	Descending bool
+	// Cursor, if set, resumes reading after the position it marks.
+	// The cursor direction must match Descending.
+	Cursor *Cursor
+}
+
+func (q QueryParams) Validate() error {
+	if q.AppName == "" {
+		return fmt.Errorf("missing application name")
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("invalid limit %d", q.Limit)
+	}
+	if q.Cursor != nil && q.Cursor.Descending != q.Descending {
+		return fmt.Errorf("cursor order does not match query order")
+	}
+	if q.Filter != nil {
+		if err := q.Filter.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match returns true if msg satisfies these parameters. Datastores
+// that cannot translate the filter into a native query may use
+// this to filter results.
+func (q QueryParams) Match(msg logging.LogMessage) bool {
+	if q.AppName != msg.AppName {
+		return false
+	}
+	if !q.StartDate.IsZero() && msg.Timestamp.Before(q.StartDate) {
+		return false
+	}
+	if !q.EndDate.IsZero() && msg.Timestamp.After(q.EndDate) {
+		return false
+	}
+	if q.Filter != nil && !q.Filter.Match(msg) {
+		return false
+	}
+	return true
+}
+
+// ListParams represents filter and sort parameters for log listings
+type ListParams struct {
+	// Since, if set, limits the listing to logs that have messages
+	// newer than this date.
+	Since time.Time
+	// SortBy is the log attribute used to sort the listing. Defaults
+	// to the log name.
+	SortBy     string
+	Descending bool
+	// NamesOnly skips computing usage and content summaries. Only
+	// the log names are returned, and Since is ignored.
+	NamesOnly bool
 }
@@ -0,0 +1,232 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+// CorrelationStageName is the name of the correlation stage
+const CorrelationStageName = "correlation"
+
+type correlationRule struct {
+	tag            string
+	appName        string
+	structuredData string
+	field          string
+	pattern        *regexp.Regexp
+	// id is the index of the id group of the pattern, or -1 if the
+	// whole match is used.
+	id int
+}
+
+// NewCorrelator returns a stage that extracts correlation IDs from log
+// messages, using the rules in cfg.
+func NewCorrelator(cfg config.Correlation) (*Correlator, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	c := &Correlator{
+		tagged: map[string]*int64{},
+	}
+	for _, rule := range cfg.Rules {
+		compiled := &correlationRule{
+			tag:            rule.Tag,
+			appName:        rule.AppName,
+			structuredData: rule.StructuredData,
+			field:          rule.Field,
+			id:             -1,
+		}
+		if rule.Pattern != "" {
+			compiled.pattern = regexp.MustCompile(rule.Pattern)
+			compiled.id = compiled.pattern.SubexpIndex("id")
+		}
+		c.rules = append(c.rules, compiled)
+		if _, ok := c.tagged[rule.Tag]; !ok {
+			c.tagged[rule.Tag] = new(int64)
+		}
+	}
+	return c, nil
+}
+
+var _ Stage = (*Correlator)(nil)
+
+// Correlator is a pipeline stage that stores the correlation IDs found
+// in a message, such as Coriolis task and migration IDs, in its
+// fields. IDs already present in the fields are kept.
+type Correlator struct {
+	rules  []*correlationRule
+	tagged map[string]*int64
+}
+
+func (c *Correlator) Name() string {
+	return CorrelationStageName
+}
+
+// messageIDs lazily parses the parts of a message that rules read IDs
+// from, so each is parsed at most once.
+type messageIDs struct {
+	msg            logging.LogMessage
+	structuredData map[string]string
+	fields         map[string]interface{}
+}
+
+func (m *messageIDs) sdParam(name string) string {
+	if m.structuredData == nil {
+		m.structuredData = parseStructuredData(m.msg.StructuredData)
+	}
+	return m.structuredData[name]
+}
+
+func (m *messageIDs) field(key string) string {
+	if m.fields == nil {
+		m.fields = m.msg.Fields
+		if m.fields == nil {
+			// The parser stage may be disabled, or may not run for
+			// this app.
+			m.fields, _ = parseJSON(m.msg.Message)
+		}
+		if m.fields == nil {
+			m.fields = map[string]interface{}{}
+		}
+	}
+	return logging.FieldString(m.fields[key])
+}
+
+func (r *correlationRule) find(m *messageIDs) string {
+	switch {
+	case r.structuredData != "":
+		return m.sdParam(r.structuredData)
+	case r.field != "":
+		return m.field(r.field)
+	}
+	match := r.pattern.FindStringSubmatchIndex(m.msg.Message)
+	if match == nil {
+		return ""
+	}
+	start, end := match[0], match[1]
+	if r.id >= 0 {
+		start, end = match[2*r.id], match[2*r.id+1]
+		if start < 0 {
+			return ""
+		}
+	}
+	return m.msg.Message[start:end]
+}
+
+// IDs returns the correlation IDs found in msg, by tag
+func (c *Correlator) IDs(msg logging.LogMessage) map[string]string {
+	ids := map[string]string{}
+	m := &messageIDs{msg: msg}
+	for _, rule := range c.rules {
+		if _, ok := ids[rule.tag]; ok {
+			continue
+		}
+		if logging.FieldString(msg.Fields[rule.tag]) != "" {
+			continue
+		}
+		if rule.appName != "" {
+			if matched, _ := path.Match(rule.appName, msg.AppName); !matched {
+				continue
+			}
+		}
+		if id := rule.find(m); id != "" {
+			ids[rule.tag] = id
+		}
+	}
+	return ids
+}
+
+func (c *Correlator) Handle(msg logging.LogMessage, emit func(logging.LogMessage) error) error {
+	ids := c.IDs(msg)
+	if len(ids) == 0 {
+		return emit(msg)
+	}
+	fields := make(map[string]interface{}, len(msg.Fields)+len(ids))
+	for key, val := range msg.Fields {
+		fields[key] = val
+	}
+	for tag, id := range ids {
+		fields[tag] = id
+		atomic.AddInt64(c.tagged[tag], 1)
+	}
+	msg.Fields = fields
+	return emit(msg)
+}
+
+// Stats returns the number of messages tagged with each tag
+func (c *Correlator) Stats() interface{} {
+	stats := map[string]int64{}
+	for tag, count := range c.tagged {
+		stats[tag] = atomic.LoadInt64(count)
+	}
+	return stats
+}
+
+// parseStructuredData returns the parameters of the RFC 5424
+// structured data elements in raw, by name. If several elements hold
+// the same parameter, the first one wins.
+func parseStructuredData(raw string) map[string]string {
+	params := map[string]string{}
+	for len(raw) > 0 && raw[0] == '[' {
+		end := strings.IndexAny(raw, " ]")
+		if end < 0 {
+			break
+		}
+		// skip the SD-ID
+		raw = raw[end:]
+		for len(raw) > 0 && raw[0] == ' ' {
+			raw = raw[1:]
+			eq := strings.Index(raw, `="`)
+			if eq <= 0 {
+				return params
+			}
+			name := raw[:eq]
+			raw = raw[eq+2:]
+			var val strings.Builder
+			closed := false
+			for len(raw) > 0 && !closed {
+				switch {
+				case raw[0] == '\\' && len(raw) > 1 && strings.IndexByte(`"\]`, raw[1]) >= 0:
+					val.WriteByte(raw[1])
+					raw = raw[2:]
+				case raw[0] == '"':
+					closed = true
+					raw = raw[1:]
+				default:
+					val.WriteByte(raw[0])
+					raw = raw[1:]
+				}
+			}
+			if !closed {
+				return params
+			}
+			if _, ok := params[name]; !ok {
+				params[name] = val.String()
+			}
+		}
+		if len(raw) == 0 || raw[0] != ']' {
+			break
+		}
+		raw = raw[1:]
+	}
+	return params
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+func TestCorrelator(t *testing.T) {
+	correlator, err := NewCorrelator(config.Correlation{
+		Rules: []config.CorrelationRule{
+			{Tag: "task_id", StructuredData: "task"},
+			{Tag: "task_id", AppName: "coriolis-*", Pattern: `task (?P<id>[0-9a-f-]{8,})`},
+			{Tag: "migration_id", Field: "migration"},
+			{Tag: "request_id", Pattern: `req-[0-9a-f]+`},
+		},
+	})
+	if err != nil {
+		t.Fatalf("creating correlator: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		msg  logging.LogMessage
+		want map[string]string
+	}{
+		{
+			name: "nothing found",
+			msg:  logging.LogMessage{AppName: "coriolis-worker", Message: "started"},
+			want: map[string]string{},
+		},
+		{
+			name: "structured data",
+			msg: logging.LogMessage{
+				StructuredData: `[meta@1 other="x" task="1234-abcd"]`,
+				Message:        "task 99999999 is ignored",
+				AppName:        "coriolis-worker",
+			},
+			want: map[string]string{"task_id": "1234-abcd"},
+		},
+		{
+			name: "pattern group",
+			msg:  logging.LogMessage{AppName: "coriolis-worker", Message: "running task 0a1b2c3d-00"},
+			want: map[string]string{"task_id": "0a1b2c3d-00"},
+		},
+		{
+			name: "pattern limited to apps",
+			msg:  logging.LogMessage{AppName: "other", Message: "running task 0a1b2c3d-00"},
+			want: map[string]string{},
+		},
+		{
+			name: "whole pattern match",
+			msg:  logging.LogMessage{Message: "request req-42ab done"},
+			want: map[string]string{"request_id": "req-42ab"},
+		},
+		{
+			name: "parsed field",
+			msg: logging.LogMessage{
+				Message: "done",
+				Fields:  map[string]interface{}{"migration": "m-1"},
+			},
+			want: map[string]string{"migration_id": "m-1"},
+		},
+		{
+			name: "json body without parsed fields",
+			msg:  logging.LogMessage{Message: `{"migration": "m-2"}`},
+			want: map[string]string{"migration_id": "m-2"},
+		},
+		{
+			name: "existing ids are kept",
+			msg: logging.LogMessage{
+				AppName: "coriolis-worker",
+				Message: "running task 0a1b2c3d-00",
+				Fields:  map[string]interface{}{"task_id": "set-before"},
+			},
+			want: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := correlator.IDs(tt.msg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got ids %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCorrelatorHandle(t *testing.T) {
+	correlator, err := NewCorrelator(config.Correlation{
+		Rules: []config.CorrelationRule{{Tag: "request_id", Pattern: `req-[0-9a-f]+`}},
+	})
+	if err != nil {
+		t.Fatalf("creating correlator: %v", err)
+	}
+	fields := map[string]interface{}{"region": "east"}
+	var got logging.LogMessage
+	correlator.Handle(logging.LogMessage{Message: "req-1 done", Fields: fields}, func(msg logging.LogMessage) error {
+		got = msg
+		return nil
+	})
+	want := map[string]interface{}{"region": "east", "request_id": "req-1"}
+	if !reflect.DeepEqual(got.Fields, want) {
+		t.Errorf("got fields %v, want %v", got.Fields, want)
+	}
+	if len(fields) != 1 {
+		t.Errorf("the fields of the original message were changed: %v", fields)
+	}
+	if stats := correlator.Stats().(map[string]int64); stats["request_id"] != 1 {
+		t.Errorf("got stats %v", stats)
+	}
+}
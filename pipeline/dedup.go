@@ -0,0 +1,169 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+// DedupStageName is the name of the dedup stage
+const DedupStageName = "dedup"
+
+// DedupStats holds the counters of the dedup stage
+type DedupStats struct {
+	// Suppressed is the number of repeated messages collapsed.
+	Suppressed int64 `json:"suppressed"`
+	// Records is the number of "repeated N times" records logged.
+	Records int64 `json:"records"`
+	// Streams is the number of streams currently tracked.
+	Streams int `json:"streams"`
+}
+
+// dedupStream is the last message of a stream, and the number of
+// times it was repeated since.
+type dedupStream struct {
+	last     logging.LogMessage
+	received time.Time
+	repeats  int64
+	// repeated is the timestamp of the last repeat.
+	repeated time.Time
+}
+
+// record returns the message logged in place of the repeats. It has
+// the tags of the last message, so it is stamped a nanosecond after it
+// and its repeats, and never overwrites it in the datastore.
+func (d *dedupStream) record() logging.LogMessage {
+	msg := d.last
+	stamp := d.repeated
+	if stamp.Before(d.last.Timestamp) {
+		stamp = d.last.Timestamp
+	}
+	msg.Timestamp = stamp.Add(time.Nanosecond)
+	msg.Message = fmt.Sprintf("last message repeated %d times", d.repeats)
+	return msg
+}
+
+// NewDedup returns a stage that collapses repeated messages
+func NewDedup(cfg config.Dedup) *Dedup {
+	return &Dedup{
+		window:  cfg.GetWindow(),
+		keys:    cfg.GetKeys(),
+		streams: map[string]*dedupStream{},
+	}
+}
+
+var _ Stage = (*Dedup)(nil)
+var _ Flusher = (*Dedup)(nil)
+
+// Dedup collapses messages that repeat the previous message of their
+// stream within a time window, like classic syslogd. The first message
+// is passed on, and the repeats are replaced by a single "last message
+// repeated N times" record, logged when the stream moves on to another
+// message, or when the window expires. Messages of other streams are
+// not held back.
+type Dedup struct {
+	window time.Duration
+	keys   []string
+
+	// mut is held while emitting, so that records are never
+	// reordered with the messages that follow them.
+	mut        sync.Mutex
+	streams    map[string]*dedupStream
+	suppressed int64
+	records    int64
+}
+
+func (d *Dedup) Name() string {
+	return DedupStageName
+}
+
+// streamKey returns the key of the stream of msg
+func (d *Dedup) streamKey(msg logging.LogMessage) string {
+	fields := make([]string, len(d.keys))
+	for idx, key := range d.keys {
+		switch key {
+		case "app_name":
+			fields[idx] = msg.AppName
+		case "hostname":
+			fields[idx] = msg.Hostname
+		case "severity":
+			fields[idx] = msg.Severity.String()
+		case "facility":
+			fields[idx] = msg.Facility.String()
+		case "proc_id":
+			fields[idx] = strconv.Itoa(msg.ProcID)
+		}
+	}
+	return strings.Join(fields, "\x00")
+}
+
+func (d *Dedup) Handle(msg logging.LogMessage, emit func(logging.LogMessage) error) error {
+	now := time.Now()
+	key := d.streamKey(msg)
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	stream, ok := d.streams[key]
+	if ok && stream.last.Message == msg.Message && now.Sub(stream.received) < d.window {
+		stream.repeats++
+		stream.repeated = msg.Timestamp
+		d.suppressed++
+		return nil
+	}
+	if ok && stream.repeats > 0 {
+		d.records++
+		if err := emit(stream.record()); err != nil {
+			log.Errorf("failed to log repeated messages record: %v", err)
+		}
+	}
+	d.streams[key] = &dedupStream{last: msg, received: now}
+	return emit(msg)
+}
+
+// Flush logs the records of the streams whose window expired
+func (d *Dedup) Flush(now time.Time, final bool, emit func(logging.LogMessage) error) {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	for key, stream := range d.streams {
+		if !final && now.Sub(stream.received) < d.window {
+			continue
+		}
+		delete(d.streams, key)
+		if stream.repeats == 0 {
+			continue
+		}
+		d.records++
+		if err := emit(stream.record()); err != nil {
+			log.Errorf("failed to log repeated messages record: %v", err)
+		}
+	}
+}
+
+func (d *Dedup) Stats() interface{} {
+	d.mut.Lock()
+	defer d.mut.Unlock()
+	return DedupStats{
+		Suppressed: d.suppressed,
+		Records:    d.records,
+		Streams:    len(d.streams),
+	}
+}
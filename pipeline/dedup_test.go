@@ -0,0 +1,135 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+func TestDedup(t *testing.T) {
+	stamp := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	msg := func(host, text string, offset time.Duration) logging.LogMessage {
+		return logging.LogMessage{
+			AppName:   "app",
+			Hostname:  host,
+			Message:   text,
+			Timestamp: stamp.Add(offset),
+		}
+	}
+
+	tests := []struct {
+		name string
+		in   []logging.LogMessage
+		// final is set if the stage is flushed at the end
+		final bool
+		want  []logging.LogMessage
+	}{
+		{
+			name: "distinct messages",
+			in:   []logging.LogMessage{msg("h", "a", 0), msg("h", "b", 0)},
+			want: []logging.LogMessage{msg("h", "a", 0), msg("h", "b", 0)},
+		},
+		{
+			name: "repeats are collapsed when the stream moves on",
+			in: []logging.LogMessage{
+				msg("h", "a", 0), msg("h", "a", 0), msg("h", "a", time.Second), msg("h", "b", time.Second),
+			},
+			want: []logging.LogMessage{
+				msg("h", "a", 0),
+				msg("h", "last message repeated 2 times", time.Second+time.Nanosecond),
+				msg("h", "b", time.Second),
+			},
+		},
+		{
+			name: "record follows the original",
+			in: []logging.LogMessage{
+				msg("h", "a", time.Second), msg("h", "a", 0), msg("h", "b", time.Second),
+			},
+			want: []logging.LogMessage{
+				msg("h", "a", time.Second),
+				msg("h", "last message repeated 1 times", time.Second+time.Nanosecond),
+				msg("h", "b", time.Second),
+			},
+		},
+		{
+			name: "streams are separate",
+			in: []logging.LogMessage{
+				msg("h1", "a", 0), msg("h2", "a", 0), msg("h1", "a", 0),
+			},
+			final: true,
+			want: []logging.LogMessage{
+				msg("h1", "a", 0),
+				msg("h2", "a", 0),
+				msg("h1", "last message repeated 1 times", time.Nanosecond),
+			},
+		},
+		{
+			name:  "pending records are logged on the final flush",
+			in:    []logging.LogMessage{msg("h", "a", 0), msg("h", "a", 0)},
+			final: true,
+			want: []logging.LogMessage{
+				msg("h", "a", 0),
+				msg("h", "last message repeated 1 times", time.Nanosecond),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dedup := NewDedup(config.Dedup{})
+			got := []logging.LogMessage{}
+			for _, msg := range tt.in {
+				if err := dedup.Handle(msg, collect(&got)); err != nil {
+					t.Fatalf("handling message: %v", err)
+				}
+			}
+			if tt.final {
+				dedup.Flush(time.Now(), true, collect(&got))
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d messages, want %d: %v", len(got), len(tt.want), got)
+			}
+			for idx := range got {
+				if got[idx].Hostname != tt.want[idx].Hostname ||
+					got[idx].Message != tt.want[idx].Message ||
+					!got[idx].Timestamp.Equal(tt.want[idx].Timestamp) {
+					t.Errorf("message %d is %+v, want %+v", idx, got[idx], tt.want[idx])
+				}
+			}
+		})
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	dedup := NewDedup(config.Dedup{})
+	got := []logging.LogMessage{}
+	dedup.Handle(logging.LogMessage{AppName: "app", Message: "a"}, collect(&got))
+	dedup.Handle(logging.LogMessage{AppName: "app", Message: "a"}, collect(&got))
+
+	dedup.Flush(time.Now(), false, collect(&got))
+	if len(got) != 1 {
+		t.Fatalf("record was logged before the window expired")
+	}
+	dedup.Flush(time.Now().Add(time.Hour), false, collect(&got))
+	if len(got) != 2 || got[1].Message != "last message repeated 1 times" {
+		t.Fatalf("got %v, want a record once the window expired", got)
+	}
+	if stats := dedup.Stats().(DedupStats); stats.Streams != 0 || stats.Suppressed != 1 || stats.Records != 1 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
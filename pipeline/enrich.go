@@ -0,0 +1,250 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+
+	"github.com/pkg/errors"
+)
+
+// EnrichmentStageName is the name of the enrichment stage
+const EnrichmentStageName = "enrichment"
+
+// EnrichmentStats holds the counters of the enrichment stage
+type EnrichmentStats struct {
+	// Hosts is the number of hostnames in the lookup file.
+	Hosts int `json:"hosts"`
+	// LookupHits is the number of messages whose hostname was found
+	// in the lookup file.
+	LookupHits int64 `json:"lookup_hits"`
+	// LookupMisses is the number of messages whose hostname was not
+	// found in the lookup file.
+	LookupMisses int64 `json:"lookup_misses"`
+	// LastLoad is the time the lookup file was last loaded.
+	LastLoad *time.Time `json:"last_load,omitempty"`
+}
+
+// NewEnricher returns a stage that attaches the tags in cfg to log
+// messages. The lookup file, if any, is loaded right away, and
+// reloaded whenever it changes.
+func NewEnricher(cfg config.Enrichment) (*Enricher, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	e := &Enricher{cfg: cfg}
+	if cfg.Lookup != nil {
+		if err := e.load(); err != nil {
+			return nil, errors.Wrapf(err, "loading %s", cfg.Lookup.Path)
+		}
+	}
+	return e, nil
+}
+
+var _ Stage = (*Enricher)(nil)
+var _ Flusher = (*Enricher)(nil)
+
+// Enricher is a pipeline stage that adds static tags, tags looked up
+// by hostname, and the listener and peer address tags to the fields
+// of log messages. Enrichment tags replace fields of the same name
+// sent by apps.
+type Enricher struct {
+	cfg config.Enrichment
+
+	mut      sync.RWMutex
+	lookup   map[string]map[string]string
+	modTime  time.Time
+	lastLoad time.Time
+
+	hits   int64
+	misses int64
+}
+
+func (e *Enricher) Name() string {
+	return EnrichmentStageName
+}
+
+// load reads the lookup file, keeping only the configured tags
+func (e *Enricher) load() error {
+	lookupCfg := e.cfg.Lookup
+	info, err := os.Stat(lookupCfg.Path)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(lookupCfg.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var entries map[string]map[string]string
+	switch lookupCfg.GetFormat() {
+	case config.LookupJSON:
+		entries, err = readJSONLookup(file)
+	default:
+		entries, err = readCSVLookup(file)
+	}
+	if err != nil {
+		return err
+	}
+
+	lookup := map[string]map[string]string{}
+	for hostname, values := range entries {
+		tags := map[string]string{}
+		for _, tag := range lookupCfg.Tags {
+			if val := values[tag]; val != "" {
+				tags[tag] = val
+			}
+		}
+		if len(tags) > 0 {
+			lookup[hostname] = tags
+		}
+	}
+
+	e.mut.Lock()
+	defer e.mut.Unlock()
+	e.lookup = lookup
+	e.modTime = info.ModTime()
+	e.lastLoad = time.Now()
+	return nil
+}
+
+func readJSONLookup(reader io.Reader) (map[string]map[string]string, error) {
+	entries := map[string]map[string]string{}
+	if err := json.NewDecoder(reader).Decode(&entries); err != nil {
+		return nil, errors.Wrap(err, "decoding JSON")
+	}
+	return entries, nil
+}
+
+func readCSVLookup(reader io.Reader) (map[string]map[string]string, error) {
+	records, err := csv.NewReader(reader).ReadAll()
+	if err != nil {
+		return nil, errors.Wrap(err, "reading CSV")
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("missing header row")
+	}
+	header := records[0]
+	hostnameCol := -1
+	for idx, name := range header {
+		if name == "hostname" {
+			hostnameCol = idx
+			break
+		}
+	}
+	if hostnameCol < 0 {
+		return nil, fmt.Errorf("missing hostname column")
+	}
+	entries := map[string]map[string]string{}
+	for _, record := range records[1:] {
+		values := map[string]string{}
+		for idx, val := range record {
+			if idx != hostnameCol {
+				values[header[idx]] = val
+			}
+		}
+		entries[record[hostnameCol]] = values
+	}
+	return entries, nil
+}
+
+// Flush reloads the lookup file if it changed
+func (e *Enricher) Flush(now time.Time, final bool, emit func(logging.LogMessage) error) {
+	if e.cfg.Lookup == nil || final {
+		return
+	}
+	info, err := os.Stat(e.cfg.Lookup.Path)
+	if err != nil {
+		return
+	}
+	e.mut.RLock()
+	changed := !info.ModTime().Equal(e.modTime)
+	e.mut.RUnlock()
+	if !changed {
+		return
+	}
+	if err := e.load(); err != nil {
+		// Keep the tags loaded last, and retry on the next flush.
+		log.Errorf("failed to reload %s: %v", e.cfg.Lookup.Path, err)
+		return
+	}
+	log.Infof("reloaded %s", e.cfg.Lookup.Path)
+}
+
+func (e *Enricher) Handle(msg logging.LogMessage, emit func(logging.LogMessage) error) error {
+	fields := make(map[string]interface{}, len(msg.Fields)+len(e.cfg.Tags)+2)
+	for key, val := range msg.Fields {
+		fields[key] = val
+	}
+	for tag, val := range e.cfg.Tags {
+		fields[tag] = val
+	}
+	if e.cfg.Lookup != nil {
+		e.mut.RLock()
+		tags, ok := e.lookup[msg.Hostname]
+		e.mut.RUnlock()
+		if ok {
+			atomic.AddInt64(&e.hits, 1)
+			for tag, val := range tags {
+				fields[tag] = val
+			}
+		} else {
+			atomic.AddInt64(&e.misses, 1)
+		}
+	}
+	if e.cfg.AddListener && msg.Listener != "" {
+		fields[config.ListenerTag] = msg.Listener
+	}
+	if e.cfg.AddPeerAddress && msg.PeerAddress != "" {
+		// The source port changes with each connection, so only the
+		// host is kept.
+		host, _, err := net.SplitHostPort(msg.PeerAddress)
+		if err != nil {
+			host = msg.PeerAddress
+		}
+		fields[config.PeerAddressTag] = host
+	}
+	if len(fields) > 0 {
+		msg.Fields = fields
+	}
+	return emit(msg)
+}
+
+func (e *Enricher) Stats() interface{} {
+	stats := EnrichmentStats{
+		LookupHits:   atomic.LoadInt64(&e.hits),
+		LookupMisses: atomic.LoadInt64(&e.misses),
+	}
+	e.mut.RLock()
+	defer e.mut.RUnlock()
+	stats.Hosts = len(e.lookup)
+	if !e.lastLoad.IsZero() {
+		lastLoad := e.lastLoad
+		stats.LastLoad = &lastLoad
+	}
+	return stats
+}
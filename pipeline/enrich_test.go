@@ -0,0 +1,165 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+func TestEnricher(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "hosts.csv")
+	if err := os.WriteFile(csvPath, []byte("rack,hostname,owner\nr1,host-1,ops\n,host-2,dev\n"), 0o600); err != nil {
+		t.Fatalf("writing lookup file: %v", err)
+	}
+	jsonPath := filepath.Join(dir, "hosts.json")
+	if err := os.WriteFile(jsonPath, []byte(`{"host-1": {"rack": "r9"}}`), 0o600); err != nil {
+		t.Fatalf("writing lookup file: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  config.Enrichment
+		msg  logging.LogMessage
+		want map[string]interface{}
+	}{
+		{
+			name: "nothing to add",
+			msg:  logging.LogMessage{Hostname: "host-1"},
+		},
+		{
+			name: "static tags replace app fields",
+			cfg:  config.Enrichment{Tags: map[string]string{"region": "east"}},
+			msg: logging.LogMessage{
+				Fields: map[string]interface{}{"region": "spoofed", "task_id": "1"},
+			},
+			want: map[string]interface{}{"region": "east", "task_id": "1"},
+		},
+		{
+			name: "csv lookup",
+			cfg: config.Enrichment{
+				Lookup: &config.EnrichmentLookup{Path: csvPath, Tags: []string{"rack"}},
+			},
+			msg:  logging.LogMessage{Hostname: "host-1"},
+			want: map[string]interface{}{"rack": "r1"},
+		},
+		{
+			name: "empty lookup values are skipped",
+			cfg: config.Enrichment{
+				Lookup: &config.EnrichmentLookup{Path: csvPath, Tags: []string{"rack"}},
+			},
+			msg: logging.LogMessage{Hostname: "host-2"},
+		},
+		{
+			name: "json lookup",
+			cfg: config.Enrichment{
+				Lookup: &config.EnrichmentLookup{Path: jsonPath, Tags: []string{"rack"}},
+			},
+			msg:  logging.LogMessage{Hostname: "host-1"},
+			want: map[string]interface{}{"rack": "r9"},
+		},
+		{
+			name: "listener and peer address",
+			cfg:  config.Enrichment{AddListener: true, AddPeerAddress: true},
+			msg:  logging.LogMessage{Listener: "tcp", PeerAddress: "10.0.0.1:51234"},
+			want: map[string]interface{}{
+				config.ListenerTag:    "tcp",
+				config.PeerAddressTag: "10.0.0.1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enricher, err := NewEnricher(tt.cfg)
+			if err != nil {
+				t.Fatalf("creating enricher: %v", err)
+			}
+			var got logging.LogMessage
+			err = enricher.Handle(tt.msg, func(msg logging.LogMessage) error {
+				got = msg
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("handling message: %v", err)
+			}
+			want := tt.want
+			if want == nil {
+				want = tt.msg.Fields
+			}
+			if !reflect.DeepEqual(got.Fields, want) {
+				t.Errorf("got fields %v, want %v", got.Fields, want)
+			}
+		})
+	}
+}
+
+func TestEnricherReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.csv")
+	if err := os.WriteFile(path, []byte("hostname,rack\nhost-1,r1\n"), 0o600); err != nil {
+		t.Fatalf("writing lookup file: %v", err)
+	}
+	enricher, err := NewEnricher(config.Enrichment{
+		Lookup: &config.EnrichmentLookup{Path: path, Tags: []string{"rack"}},
+	})
+	if err != nil {
+		t.Fatalf("creating enricher: %v", err)
+	}
+	rack := func() interface{} {
+		var got logging.LogMessage
+		enricher.Handle(logging.LogMessage{Hostname: "host-1"}, func(msg logging.LogMessage) error {
+			got = msg
+			return nil
+		})
+		return got.Fields["rack"]
+	}
+
+	if err := os.WriteFile(path, []byte("hostname,rack\nhost-1,r2\n"), 0o600); err != nil {
+		t.Fatalf("writing lookup file: %v", err)
+	}
+	// Make sure the change is seen on file systems with a coarse
+	// modification time.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("changing modification time: %v", err)
+	}
+	enricher.Flush(time.Now(), false, nil)
+	if got := rack(); got != "r2" {
+		t.Errorf("got rack %v after reloading, want r2", got)
+	}
+
+	// A broken file keeps the tags loaded last.
+	if err := os.WriteFile(path, []byte("rack\nr3\n"), 0o600); err != nil {
+		t.Fatalf("writing lookup file: %v", err)
+	}
+	later = later.Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatalf("changing modification time: %v", err)
+	}
+	enricher.Flush(time.Now(), false, nil)
+	if got := rack(); got != "r2" {
+		t.Errorf("got rack %v after a failed reload, want r2", got)
+	}
+	stats := enricher.Stats().(EnrichmentStats)
+	if stats.Hosts != 1 || stats.LookupHits != 2 || stats.LastLoad == nil {
+		t.Errorf("got stats %+v", stats)
+	}
+}
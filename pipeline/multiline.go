@@ -0,0 +1,217 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+// MultilineStageName is the name of the multi-line reassembly stage
+const MultilineStageName = "multiline"
+
+// MultilineStats holds the counters of the multi-line stage
+type MultilineStats struct {
+	// Messages is the number of multi-line messages logged.
+	Messages int64 `json:"messages"`
+	// Lines is the number of lines joined into multi-line messages.
+	Lines int64 `json:"lines"`
+	// TimedOut is the number of messages logged after the timeout.
+	TimedOut int64 `json:"timed_out"`
+	// Pending is the number of messages waiting for more lines.
+	Pending int `json:"pending"`
+}
+
+type multilineRule struct {
+	appName      string
+	start        *regexp.Regexp
+	continuation *regexp.Regexp
+}
+
+// begins returns true if line may begin a multi-line message
+func (r *multilineRule) begins(line string) bool {
+	return r.start == nil || r.start.MatchString(line)
+}
+
+// continues returns true if line must be joined to the message before
+func (r *multilineRule) continues(line string) bool {
+	if r.continuation != nil {
+		return r.continuation.MatchString(line)
+	}
+	return !r.start.MatchString(line)
+}
+
+// pendingMessage is a multi-line message waiting for more lines
+type pendingMessage struct {
+	msg      logging.LogMessage
+	lines    []string
+	received time.Time
+}
+
+// message returns the reassembled message. It keeps the fields of the
+// first line, and the highest severity of all lines.
+func (p *pendingMessage) message() logging.LogMessage {
+	msg := p.msg
+	msg.Message = strings.Join(p.lines, "\n")
+	return msg
+}
+
+func (p *pendingMessage) add(msg logging.LogMessage, now time.Time) {
+	p.lines = append(p.lines, msg.Message)
+	if msg.Severity < p.msg.Severity {
+		p.msg.Severity = msg.Severity
+		p.msg.Priority = int(p.msg.Facility)*8 + int(msg.Severity)
+	}
+	p.received = now
+}
+
+// NewMultiline returns a stage that reassembles multi-line messages
+func NewMultiline(cfg config.Multiline) (*Multiline, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	m := &Multiline{
+		timeout:  cfg.GetTimeout(),
+		maxLines: cfg.GetMaxLines(),
+		pending:  map[string]*pendingMessage{},
+	}
+	for _, rule := range cfg.Rules {
+		r := &multilineRule{appName: rule.AppName}
+		// Validated above.
+		if rule.Start != "" {
+			r.start = regexp.MustCompile(rule.Start)
+		}
+		if rule.Continuation != "" {
+			r.continuation = regexp.MustCompile(rule.Continuation)
+		}
+		m.rules = append(m.rules, r)
+	}
+	return m, nil
+}
+
+var _ Stage = (*Multiline)(nil)
+var _ Flusher = (*Multiline)(nil)
+
+// Multiline joins messages that are the lines of a single message,
+// such as Python tracebacks, sent by the same process. Lines are joined
+// until a line that does not belong to the message arrives, or until
+// no new line arrived for the timeout.
+type Multiline struct {
+	rules    []*multilineRule
+	timeout  time.Duration
+	maxLines int
+
+	// mut is held while emitting, so that messages of a process are
+	// never reordered.
+	mut      sync.Mutex
+	pending  map[string]*pendingMessage
+	messages int64
+	lines    int64
+	timedOut int64
+}
+
+func (m *Multiline) Name() string {
+	return MultilineStageName
+}
+
+func (m *Multiline) ruleFor(appName string) *multilineRule {
+	for _, rule := range m.rules {
+		if rule.appName == "" {
+			return rule
+		}
+		if matched, _ := path.Match(rule.appName, appName); matched {
+			return rule
+		}
+	}
+	return nil
+}
+
+// emitPending logs the pending message of a process
+func (m *Multiline) emitPending(key string, emit func(logging.LogMessage) error) {
+	pending, ok := m.pending[key]
+	if !ok {
+		return
+	}
+	delete(m.pending, key)
+	if len(pending.lines) > 1 {
+		m.messages++
+		m.lines += int64(len(pending.lines))
+	}
+	if err := emit(pending.message()); err != nil {
+		log.Errorf("failed to log multi-line message: %v", err)
+	}
+}
+
+func (m *Multiline) Handle(msg logging.LogMessage, emit func(logging.LogMessage) error) error {
+	rule := m.ruleFor(msg.AppName)
+	if rule == nil {
+		return emit(msg)
+	}
+	now := time.Now()
+	key := fmt.Sprintf("%s\x00%s\x00%d", msg.AppName, msg.Hostname, msg.ProcID)
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if pending, ok := m.pending[key]; ok && rule.continues(msg.Message) {
+		pending.add(msg, now)
+		if len(pending.lines) >= m.maxLines {
+			m.emitPending(key, emit)
+		}
+		return nil
+	}
+	m.emitPending(key, emit)
+	if !rule.begins(msg.Message) {
+		return emit(msg)
+	}
+	m.pending[key] = &pendingMessage{
+		msg:      msg,
+		lines:    []string{msg.Message},
+		received: now,
+	}
+	return nil
+}
+
+// Flush logs the messages that received no new line for the timeout
+func (m *Multiline) Flush(now time.Time, final bool, emit func(logging.LogMessage) error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	for key, pending := range m.pending {
+		if !final && now.Sub(pending.received) < m.timeout {
+			continue
+		}
+		if len(pending.lines) > 1 {
+			m.timedOut++
+		}
+		m.emitPending(key, emit)
+	}
+}
+
+func (m *Multiline) Stats() interface{} {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	return MultilineStats{
+		Messages: m.messages,
+		Lines:    m.lines,
+		TimedOut: m.timedOut,
+		Pending:  len(m.pending),
+	}
+}
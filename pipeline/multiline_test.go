@@ -0,0 +1,186 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+func TestMultiline(t *testing.T) {
+	line := func(procID int, text string) logging.LogMessage {
+		return logging.LogMessage{
+			AppName:  "coriolis-worker",
+			Hostname: "host",
+			ProcID:   procID,
+			Severity: logging.Informational,
+			Message:  text,
+		}
+	}
+	indented := config.MultilineRule{AppName: "coriolis-*", Start: `^\S`}
+
+	tests := []struct {
+		name     string
+		cfg      config.Multiline
+		in       []logging.LogMessage
+		want     []string
+		wantStat MultilineStats
+	}{
+		{
+			name: "traceback",
+			cfg:  config.Multiline{Rules: []config.MultilineRule{indented}},
+			in: []logging.LogMessage{
+				line(1, "Traceback (most recent call last):"),
+				line(1, `  File "worker.py", line 10`),
+				line(1, "    raise ValueError()"),
+				line(1, "next message"),
+			},
+			want: []string{
+				"Traceback (most recent call last):\n  File \"worker.py\", line 10\n    raise ValueError()",
+				"next message",
+			},
+			wantStat: MultilineStats{Messages: 1, Lines: 3},
+		},
+		{
+			name: "processes are joined separately",
+			cfg:  config.Multiline{Rules: []config.MultilineRule{indented}},
+			in: []logging.LogMessage{
+				line(1, "first"),
+				line(2, "second"),
+				line(1, "  first continued"),
+				line(2, "  second continued"),
+			},
+			want:     []string{"first\n  first continued", "second\n  second continued"},
+			wantStat: MultilineStats{Messages: 2, Lines: 4},
+		},
+		{
+			name: "continuation without a first line",
+			cfg:  config.Multiline{Rules: []config.MultilineRule{indented}},
+			in:   []logging.LogMessage{line(1, "  orphan")},
+			want: []string{"  orphan"},
+		},
+		{
+			name: "continuation pattern",
+			cfg: config.Multiline{Rules: []config.MultilineRule{
+				{Continuation: `^\.\.\.`},
+			}},
+			in: []logging.LogMessage{
+				line(1, "a"), line(1, "...b"), line(1, "c"),
+			},
+			want:     []string{"a\n...b", "c"},
+			wantStat: MultilineStats{Messages: 1, Lines: 2},
+		},
+		{
+			name: "max lines",
+			cfg:  config.Multiline{MaxLines: 2, Rules: []config.MultilineRule{indented}},
+			in: []logging.LogMessage{
+				line(1, "a"), line(1, "  b"), line(1, "  c"),
+			},
+			want:     []string{"a\n  b", "  c"},
+			wantStat: MultilineStats{Messages: 1, Lines: 2},
+		},
+		{
+			name: "other apps are not joined",
+			cfg:  config.Multiline{Rules: []config.MultilineRule{indented}},
+			in: []logging.LogMessage{
+				{AppName: "other", Message: "a"},
+				{AppName: "other", Message: "  b"},
+			},
+			want: []string{"a", "  b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			multiline, err := NewMultiline(tt.cfg)
+			if err != nil {
+				t.Fatalf("creating stage: %v", err)
+			}
+			got := []logging.LogMessage{}
+			for _, msg := range tt.in {
+				if err := multiline.Handle(msg, collect(&got)); err != nil {
+					t.Fatalf("handling message: %v", err)
+				}
+			}
+			multiline.Flush(time.Now(), true, collect(&got))
+			// Pending messages are flushed in no particular order.
+			texts := []string{}
+			for _, msg := range got {
+				texts = append(texts, msg.Message)
+			}
+			sort.Strings(texts)
+			sort.Strings(tt.want)
+			if !reflect.DeepEqual(texts, tt.want) {
+				t.Errorf("got messages %q, want %q", texts, tt.want)
+			}
+			stats := multiline.Stats().(MultilineStats)
+			if stats.Messages != tt.wantStat.Messages || stats.Lines != tt.wantStat.Lines || stats.Pending != 0 {
+				t.Errorf("got stats %+v, want %+v", stats, tt.wantStat)
+			}
+		})
+	}
+}
+
+func TestMultilineSeverity(t *testing.T) {
+	multiline, err := NewMultiline(config.Multiline{
+		Rules: []config.MultilineRule{{Start: `^\S`}},
+	})
+	if err != nil {
+		t.Fatalf("creating stage: %v", err)
+	}
+	got := []logging.LogMessage{}
+	multiline.Handle(logging.LogMessage{
+		Message: "a", Facility: logging.UserLevelMessages, Severity: logging.Informational,
+	}, collect(&got))
+	multiline.Handle(logging.LogMessage{
+		Message: "  b", Facility: logging.UserLevelMessages, Severity: logging.Error,
+	}, collect(&got))
+	multiline.Flush(time.Now(), true, collect(&got))
+	if len(got) != 1 {
+		t.Fatalf("got %d messages, want 1", len(got))
+	}
+	if got[0].Severity != logging.Error || got[0].Priority != 11 {
+		t.Errorf("got severity %v and priority %d, want err and 11", got[0].Severity, got[0].Priority)
+	}
+}
+
+func TestMultilineTimeout(t *testing.T) {
+	multiline, err := NewMultiline(config.Multiline{
+		Timeout: 5,
+		Rules:   []config.MultilineRule{{Start: `^\S`}},
+	})
+	if err != nil {
+		t.Fatalf("creating stage: %v", err)
+	}
+	got := []logging.LogMessage{}
+	multiline.Handle(logging.LogMessage{Message: "a"}, collect(&got))
+	multiline.Handle(logging.LogMessage{Message: "  b"}, collect(&got))
+
+	multiline.Flush(time.Now(), false, collect(&got))
+	if len(got) != 0 {
+		t.Fatalf("message was logged before the timeout")
+	}
+	multiline.Flush(time.Now().Add(10*time.Second), false, collect(&got))
+	if len(got) != 1 || got[0].Message != "a\n  b" {
+		t.Fatalf("got %v, want the joined message after the timeout", got)
+	}
+	if stats := multiline.Stats().(MultilineStats); stats.TimedOut != 1 || stats.Pending != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
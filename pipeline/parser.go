@@ -0,0 +1,197 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+// ParserStageName is the name of the parser stage
+const ParserStageName = "parser"
+
+// ParserStats holds the counters of the parser stage
+type ParserStats struct {
+	// Parsed holds the number of messages parsed, by format.
+	Parsed   map[config.ParserFormat]int64 `json:"parsed"`
+	Unparsed int64                         `json:"unparsed"`
+}
+
+// NewParser returns a stage that extracts structured fields from the
+// body of log messages.
+func NewParser(cfg config.Parser) (*Parser, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	p := &Parser{
+		formats: cfg.GetFormats(),
+		apps:    cfg.Apps,
+		parsed:  map[config.ParserFormat]*int64{},
+	}
+	for _, format := range p.formats {
+		p.parsed[format] = new(int64)
+	}
+	return p, nil
+}
+
+var _ Stage = (*Parser)(nil)
+
+// Parser is a pipeline stage that detects JSON or logfmt message
+// bodies, and sets the message fields from them. Messages that are in
+// neither format are passed on unchanged.
+type Parser struct {
+	formats []config.ParserFormat
+	apps    []string
+
+	parsed   map[config.ParserFormat]*int64
+	unparsed int64
+}
+
+func (p *Parser) Name() string {
+	return ParserStageName
+}
+
+func (p *Parser) parses(appName string) bool {
+	if len(p.apps) == 0 {
+		return true
+	}
+	for _, app := range p.apps {
+		if matched, _ := path.Match(app, appName); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse returns the fields held by text, and the format they were
+// found in.
+func (p *Parser) Parse(text string) (map[string]interface{}, config.ParserFormat, bool) {
+	for _, format := range p.formats {
+		var fields map[string]interface{}
+		var err error
+		switch format {
+		case config.ParserJSON:
+			fields, err = parseJSON(text)
+		case config.ParserLogfmt:
+			fields, err = parseLogfmt(text)
+		}
+		if err == nil && len(fields) > 0 {
+			return fields, format, true
+		}
+	}
+	return nil, "", false
+}
+
+func (p *Parser) Handle(msg logging.LogMessage, emit func(logging.LogMessage) error) error {
+	if !p.parses(msg.AppName) {
+		return emit(msg)
+	}
+	fields, format, ok := p.Parse(msg.Message)
+	if !ok {
+		atomic.AddInt64(&p.unparsed, 1)
+		return emit(msg)
+	}
+	atomic.AddInt64(p.parsed[format], 1)
+	// Fields set by earlier stages are kept, and copied so that the
+	// original map is not shared.
+	merged := make(map[string]interface{}, len(msg.Fields)+len(fields))
+	for key, val := range msg.Fields {
+		merged[key] = val
+	}
+	for key, val := range fields {
+		merged[key] = val
+	}
+	msg.Fields = merged
+	return emit(msg)
+}
+
+func (p *Parser) Stats() interface{} {
+	stats := ParserStats{
+		Parsed:   map[config.ParserFormat]int64{},
+		Unparsed: atomic.LoadInt64(&p.unparsed),
+	}
+	for format, count := range p.parsed {
+		stats.Parsed[format] = atomic.LoadInt64(count)
+	}
+	return stats
+}
+
+// parseJSON parses the JSON object in text. The object may be preceded
+// and followed by other text, such as a log level or a timestamp.
+func parseJSON(text string) (map[string]interface{}, error) {
+	start := strings.Index(text, "{")
+	end := strings.LastIndex(text, "}")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no JSON object found")
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(text[start:end+1]), &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// parseLogfmt parses text made of key=value pairs separated by spaces.
+// Values may be double quoted. All of text must be made of pairs.
+func parseLogfmt(text string) (map[string]interface{}, error) {
+	fields := map[string]interface{}{}
+	rest := strings.TrimSpace(text)
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("expected key=value pair")
+		}
+		key := rest[:eq]
+		if strings.ContainsAny(key, " \t\"") {
+			return nil, fmt.Errorf("invalid key %q", key)
+		}
+		rest = rest[eq+1:]
+
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted value for key %q", key)
+			}
+			if val, err = strconv.Unquote(quoted); err != nil {
+				return nil, fmt.Errorf("invalid quoted value for key %q", key)
+			}
+			rest = rest[len(quoted):]
+			if rest != "" && rest[0] != ' ' && rest[0] != '\t' {
+				return nil, fmt.Errorf("expected space after value of key %q", key)
+			}
+		} else {
+			end := strings.IndexAny(rest, " \t")
+			if end < 0 {
+				end = len(rest)
+			}
+			val = rest[:end]
+			if strings.ContainsAny(val, "=\"") {
+				return nil, fmt.Errorf("invalid value for key %q", key)
+			}
+			rest = rest[end:]
+		}
+		fields[key] = val
+		rest = strings.TrimLeft(rest, " \t")
+	}
+	return fields, nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+func TestParser(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        config.Parser
+		msg        logging.LogMessage
+		wantFields map[string]interface{}
+	}{
+		{
+			name:       "json",
+			msg:        logging.LogMessage{Message: `{"task_id": "1234", "retries": 3}`},
+			wantFields: map[string]interface{}{"task_id": "1234", "retries": float64(3)},
+		},
+		{
+			name:       "json with a prefix",
+			msg:        logging.LogMessage{Message: `ERROR {"task_id": "1234"} done`},
+			wantFields: map[string]interface{}{"task_id": "1234"},
+		},
+		{
+			name:       "logfmt",
+			msg:        logging.LogMessage{Message: `task_id=1234 state="in progress"  retries=3`},
+			wantFields: map[string]interface{}{"task_id": "1234", "state": "in progress", "retries": "3"},
+		},
+		{
+			name: "plain text",
+			msg:  logging.LogMessage{Message: "task 1234 failed"},
+		},
+		{
+			name: "text with an equals sign",
+			msg:  logging.LogMessage{Message: "expected a=b"},
+		},
+		{
+			name: "unterminated quote",
+			msg:  logging.LogMessage{Message: `state="running`},
+		},
+		{
+			name: "invalid json",
+			cfg:  config.Parser{Formats: []config.ParserFormat{config.ParserJSON}},
+			msg:  logging.LogMessage{Message: `{"task_id": }`},
+		},
+		{
+			name: "format not enabled",
+			cfg:  config.Parser{Formats: []config.ParserFormat{config.ParserJSON}},
+			msg:  logging.LogMessage{Message: "task_id=1234"},
+		},
+		{
+			name: "app not selected",
+			cfg:  config.Parser{Apps: []string{"coriolis-*"}},
+			msg:  logging.LogMessage{AppName: "other", Message: "task_id=1234"},
+		},
+		{
+			name: "existing fields are kept",
+			cfg:  config.Parser{Apps: []string{"coriolis-*"}},
+			msg: logging.LogMessage{
+				AppName: "coriolis-worker",
+				Message: "task_id=1234",
+				Fields:  map[string]interface{}{"region": "east", "task_id": "old"},
+			},
+			wantFields: map[string]interface{}{"region": "east", "task_id": "1234"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser, err := NewParser(tt.cfg)
+			if err != nil {
+				t.Fatalf("creating parser: %v", err)
+			}
+			var got logging.LogMessage
+			err = parser.Handle(tt.msg, func(msg logging.LogMessage) error {
+				got = msg
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("handling message: %v", err)
+			}
+			if got.Message != tt.msg.Message {
+				t.Errorf("message changed to %q", got.Message)
+			}
+			want := tt.wantFields
+			if want == nil {
+				want = tt.msg.Fields
+			}
+			if !reflect.DeepEqual(got.Fields, want) {
+				t.Errorf("got fields %v, want %v", got.Fields, want)
+			}
+		})
+	}
+}
+
+func TestParserDoesNotShareFields(t *testing.T) {
+	parser, err := NewParser(config.Parser{})
+	if err != nil {
+		t.Fatalf("creating parser: %v", err)
+	}
+	fields := map[string]interface{}{"region": "east"}
+	parser.Handle(logging.LogMessage{Message: "task_id=1", Fields: fields}, func(logging.LogMessage) error { return nil })
+	if len(fields) != 1 {
+		t.Errorf("the fields of the original message were changed: %v", fields)
+	}
+	stats := parser.Stats().(ParserStats)
+	if stats.Parsed[config.ParserLogfmt] != 1 || stats.Unparsed != 0 {
+		t.Errorf("got stats %+v", stats)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+	"coriolis-logger/worker"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+)
+
+var log = loggo.GetLogger("coriolis.logger.pipeline")
+
+const (
+	// drainTimeout is the time allowed to each writer to drain its
+	// queue on shutdown.
+	drainTimeout = 60 * time.Second
+	// flushInterval is the interval at which stages are flushed.
+	flushInterval = 1 * time.Second
+)
+
+// Stats holds the counters of the pipeline
+type Stats struct {
+	Writers []WriterStats `json:"writers"`
+	Routing *RoutingStats `json:"routing,omitempty"`
+	// Stages holds the counters of each stage, by name.
+	Stages map[string]interface{} `json:"stages,omitempty"`
+}
+
+// Stage is a processing step that messages go through before they are
+// routed to writers. Stages run in the order they were added.
+type Stage interface {
+	// Name is the key of the stage counters in the pipeline stats.
+	Name() string
+	// Handle processes msg, and passes the resulting messages on to
+	// the next step with emit. Messages that are not passed on are
+	// dropped.
+	Handle(msg logging.LogMessage, emit func(logging.LogMessage) error) error
+	// Stats returns the counters of the stage.
+	Stats() interface{}
+}
+
+// Flusher is implemented by stages that hold messages back, or that
+// emit messages of their own. Flush is called periodically, and a
+// last time with final set when the pipeline stops.
+type Flusher interface {
+	Flush(now time.Time, final bool, emit func(logging.LogMessage) error)
+}
+
+// NewPipeline returns a new pipeline, using the writer queue settings
+// in cfg. cfg may be nil, in which case the defaults are used.
+func NewPipeline(cfg *config.Pipeline) *Pipeline {
+	return &Pipeline{
+		cfg:     cfg,
+		quit:    make(chan struct{}),
+		flushed: make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+}
+
+var _ logging.Writer = (*Pipeline)(nil)
+var _ worker.SimpleWorker = (*Pipeline)(nil)
+
+// Pipeline fans out log messages to a set of writers. Each writer has
+// its own bounded queue and goroutine, so a slow writer only holds up
+// ingestion if its overflow policy is to block.
+type Pipeline struct {
+	cfg     *config.Pipeline
+	writers []*queuedWriter
+	router  *Router
+	stages  []Stage
+	// emit holds the entry point of each stage, followed by the
+	// dispatch of messages to writers.
+	emit []func(logging.LogMessage) error
+
+	// mut is held for reading while messages are queued, and for
+	// writing when the queues are closed.
+	mut     sync.RWMutex
+	stopped bool
+	quit    chan struct{}
+	flushed chan struct{}
+	closed  chan struct{}
+}
+
+// Add adds a named writer to the pipeline. Writers must be added
+// before the pipeline is started. On shutdown, writers are drained in
+// the order they were added.
+func (p *Pipeline) Add(name string, writer logging.Writer) error {
+	q, err := newQueuedWriter(name, writer, p.cfg.WriterConfig(name))
+	if err != nil {
+		return errors.Wrapf(err, "adding %s writer", name)
+	}
+	p.writers = append(p.writers, q)
+	return nil
+}
+
+// Use adds a stage to the pipeline. Stages must be added before the
+// pipeline is started.
+func (p *Pipeline) Use(stage Stage) {
+	p.stages = append(p.stages, stage)
+}
+
+// Route sends messages to the writers selected by the routing rules
+// in cfg, instead of all writers. It must be called after all writers
+// were added.
+func (p *Pipeline) Route(cfg config.Routing) error {
+	writers := []NamedWriter{}
+	for _, q := range p.writers {
+		writers = append(writers, NamedWriter{Name: q.name, Writer: q})
+	}
+	router, err := NewRouter(cfg, writers)
+	if err != nil {
+		return errors.Wrap(err, "creating router")
+	}
+	p.router = router
+	return nil
+}
+
+// Write passes msg through the pipeline stages, and queues the result
+// for the writers selected by the router, or for all writers if no
+// routing rules were set.
+func (p *Pipeline) Write(msg logging.LogMessage) error {
+	p.mut.RLock()
+	defer p.mut.RUnlock()
+	if p.stopped {
+		return fmt.Errorf("pipeline is stopped")
+	}
+	return p.emit[0](msg)
+}
+
+func (p *Pipeline) dispatch(msg logging.LogMessage) error {
+	if p.router != nil {
+		return p.router.Write(msg)
+	}
+	for _, q := range p.writers {
+		q.push(msg)
+	}
+	return nil
+}
+
+// Stats returns the counters of all writers
+func (p *Pipeline) Stats() Stats {
+	stats := Stats{Writers: []WriterStats{}}
+	for _, q := range p.writers {
+		stats.Writers = append(stats.Writers, q.Stats())
+	}
+	if p.router != nil {
+		routing := p.router.Stats()
+		stats.Routing = &routing
+	}
+	if len(p.stages) > 0 {
+		stats.Stages = map[string]interface{}{}
+		for _, stage := range p.stages {
+			stats.Stages[stage.Name()] = stage.Stats()
+		}
+	}
+	return stats
+}
+
+func (p *Pipeline) Start() error {
+	p.emit = make([]func(logging.LogMessage) error, len(p.stages)+1)
+	p.emit[len(p.stages)] = p.dispatch
+	for idx := len(p.stages) - 1; idx >= 0; idx-- {
+		stage, next := p.stages[idx], p.emit[idx+1]
+		p.emit[idx] = func(msg logging.LogMessage) error {
+			return stage.Handle(msg, next)
+		}
+	}
+	for _, q := range p.writers {
+		go q.run()
+	}
+	go p.flushLoop()
+	return nil
+}
+
+// flush flushes the stages in order, so that messages flushed by a
+// stage go through the flush of the following stages.
+func (p *Pipeline) flush(final bool) {
+	now := time.Now()
+	for idx, stage := range p.stages {
+		if flusher, ok := stage.(Flusher); ok {
+			flusher.Flush(now, final, p.emit[idx+1])
+		}
+	}
+}
+
+func (p *Pipeline) flushLoop() {
+	defer close(p.flushed)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+			p.mut.RLock()
+			if !p.stopped {
+				p.flush(false)
+			}
+			p.mut.RUnlock()
+		}
+	}
+}
+
+// Stop stops accepting messages, flushes the stages, and waits for the
+// writers to drain their queues, one after the other.
+func (p *Pipeline) Stop() error {
+	p.mut.Lock()
+	if p.stopped {
+		p.mut.Unlock()
+		p.Wait()
+		return nil
+	}
+	p.stopped = true
+	p.mut.Unlock()
+
+	defer close(p.closed)
+	close(p.quit)
+	<-p.flushed
+	p.flush(true)
+
+	var err error
+	for _, q := range p.writers {
+		close(q.queue)
+		select {
+		case <-q.closed:
+		case <-time.After(drainTimeout):
+			log.Errorf("timed out draining %s writer, %d messages left", q.name, len(q.queue))
+			err = fmt.Errorf("timed out draining %s writer", q.name)
+		}
+	}
+	return err
+}
+
+func (p *Pipeline) Wait() {
+	<-p.closed
+}
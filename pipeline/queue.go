@@ -0,0 +1,206 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+
+	"github.com/pkg/errors"
+)
+
+// spillBatchSize is the number of spilled messages read at once
+const spillBatchSize = 500
+
+// entry is a queued message
+type entry struct {
+	Message logging.LogMessage `json:"message"`
+	Queued  time.Time          `json:"queued"`
+}
+
+// WriterStats holds the counters of a queued writer
+type WriterStats struct {
+	Name           string                      `json:"name"`
+	OverflowPolicy config.WriterOverflowPolicy `json:"overflow_policy"`
+	// Queued is the number of messages queued in memory.
+	Queued int `json:"queued"`
+	// Spilled is the number of messages waiting in the spill file.
+	Spilled int64 `json:"spilled"`
+	Written int64 `json:"written"`
+	Failed  int64 `json:"failed"`
+	Dropped int64 `json:"dropped"`
+	// LagSeconds is the time the last written message spent queued.
+	LagSeconds float64 `json:"lag_seconds"`
+}
+
+func newQueuedWriter(name string, writer logging.Writer, cfg config.WriterQueue) (*queuedWriter, error) {
+	q := &queuedWriter{
+		name:   name,
+		writer: writer,
+		policy: cfg.GetOverflowPolicy(),
+		queue:  make(chan entry, cfg.GetQueueSize()),
+		closed: make(chan struct{}),
+	}
+	if q.policy == config.WriterOverflowSpill {
+		spill, err := openSpillFile(cfg.SpillDir, name, cfg.GetMaxSpillSize())
+		if err != nil {
+			return nil, errors.Wrapf(err, "opening spill file of %s writer", name)
+		}
+		q.spill = spill
+		q.spilling = !spill.empty()
+	}
+	return q, nil
+}
+
+// queuedWriter hands messages to a writer from its own goroutine, so
+// that a slow writer does not hold up ingestion, or the other writers.
+// Messages are written in the order they were queued.
+type queuedWriter struct {
+	name   string
+	writer logging.Writer
+	policy config.WriterOverflowPolicy
+	queue  chan entry
+	closed chan struct{}
+
+	// mut guards the spill file. While spilling is true, new messages
+	// are appended to the spill file instead of the queue, until the
+	// worker reads all of them back.
+	mut      sync.Mutex
+	spill    *spillFile
+	spilling bool
+
+	written int64
+	failed  int64
+	dropped int64
+	lag     int64
+}
+
+// push queues a message, applying the overflow policy if the queue
+// is full.
+func (q *queuedWriter) push(msg logging.LogMessage) {
+	e := entry{Message: msg, Queued: time.Now()}
+	switch q.policy {
+	case config.WriterOverflowDrop:
+		select {
+		case q.queue <- e:
+		default:
+			atomic.AddInt64(&q.dropped, 1)
+		}
+	case config.WriterOverflowSpill:
+		q.mut.Lock()
+		defer q.mut.Unlock()
+		if !q.spilling {
+			select {
+			case q.queue <- e:
+				return
+			default:
+				q.spilling = true
+			}
+		}
+		if err := q.spill.append(e); err != nil {
+			log.Errorf("failed to spill message of %s writer: %v", q.name, err)
+			atomic.AddInt64(&q.dropped, 1)
+		}
+	default:
+		q.queue <- e
+	}
+}
+
+// Write queues msg. It never fails, messages dropped because of the
+// overflow policy are only counted.
+func (q *queuedWriter) Write(msg logging.LogMessage) error {
+	q.push(msg)
+	return nil
+}
+
+func (q *queuedWriter) write(e entry) {
+	atomic.StoreInt64(&q.lag, int64(time.Since(e.Queued)))
+	if err := q.writer.Write(e.Message); err != nil {
+		atomic.AddInt64(&q.failed, 1)
+		log.Errorf("failed to write log message to %s writer: %q", q.name, err)
+		return
+	}
+	atomic.AddInt64(&q.written, 1)
+}
+
+// drainSpill writes the spilled messages, until the spill file is
+// empty. Spilled messages were queued after the ones in memory, so
+// nothing is read back while the in-memory queue holds messages.
+func (q *queuedWriter) drainSpill() {
+	for {
+		q.mut.Lock()
+		if !q.spilling || len(q.queue) > 0 {
+			q.mut.Unlock()
+			return
+		}
+		entries, err := q.spill.read(spillBatchSize)
+		if err != nil {
+			log.Errorf("failed to read spill file of %s writer: %v", q.name, err)
+			// Give up on the rest of the file, rather than
+			// stalling the writer.
+			if err := q.spill.reset(); err != nil {
+				log.Errorf("failed to reset spill file of %s writer: %v", q.name, err)
+			}
+		}
+		if q.spill.empty() {
+			q.spilling = false
+		}
+		q.mut.Unlock()
+		for _, e := range entries {
+			q.write(e)
+		}
+	}
+}
+
+// run writes queued messages until the queue is closed and drained.
+func (q *queuedWriter) run() {
+	defer close(q.closed)
+	q.drainSpill()
+	for e := range q.queue {
+		q.write(e)
+		if len(q.queue) == 0 {
+			q.drainSpill()
+		}
+	}
+	q.drainSpill()
+	if q.spill != nil {
+		if err := q.spill.close(); err != nil {
+			log.Errorf("failed to close spill file of %s writer: %v", q.name, err)
+		}
+	}
+}
+
+// Stats returns the counters of the writer
+func (q *queuedWriter) Stats() WriterStats {
+	stats := WriterStats{
+		Name:           q.name,
+		OverflowPolicy: q.policy,
+		Queued:         len(q.queue),
+		Written:        atomic.LoadInt64(&q.written),
+		Failed:         atomic.LoadInt64(&q.failed),
+		Dropped:        atomic.LoadInt64(&q.dropped),
+		LagSeconds:     time.Duration(atomic.LoadInt64(&q.lag)).Seconds(),
+	}
+	if q.spill != nil {
+		q.mut.Lock()
+		stats.Spilled = q.spill.pending
+		q.mut.Unlock()
+	}
+	return stats
+}
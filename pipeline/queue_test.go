@@ -0,0 +1,176 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+// gatedWriter records the messages written to it, and blocks writes
+// until its gate is opened.
+type gatedWriter struct {
+	gate chan struct{}
+
+	mut      sync.Mutex
+	messages []logging.LogMessage
+}
+
+func newGatedWriter() *gatedWriter {
+	return &gatedWriter{gate: make(chan struct{})}
+}
+
+func (g *gatedWriter) open() {
+	close(g.gate)
+}
+
+func (g *gatedWriter) Write(msg logging.LogMessage) error {
+	<-g.gate
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	g.messages = append(g.messages, msg)
+	return nil
+}
+
+// sequence returns the sequence numbers of the messages written,
+// which the tests store in ProcID.
+func (g *gatedWriter) sequence() []int {
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	ret := []int{}
+	for _, msg := range g.messages {
+		ret = append(ret, msg.ProcID)
+	}
+	return ret
+}
+
+func TestQueuedWriterOverflow(t *testing.T) {
+	const total = 50
+	tests := []struct {
+		name        string
+		policy      config.WriterOverflowPolicy
+		wantDropped bool
+	}{
+		{
+			name:        "drop",
+			policy:      config.WriterOverflowDrop,
+			wantDropped: true,
+		},
+		{
+			name:   "spill",
+			policy: config.WriterOverflowSpill,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slow, fast := newGatedWriter(), newGatedWriter()
+			fast.open()
+			p := NewPipeline(&config.Pipeline{
+				WriterQueue: config.WriterQueue{
+					QueueSize:      4,
+					OverflowPolicy: tt.policy,
+					SpillDir:       t.TempDir(),
+				},
+				Writers: map[string]config.WriterQueue{
+					config.WebsocketWriter: {
+						QueueSize:      total,
+						OverflowPolicy: config.WriterOverflowBlock,
+					},
+				},
+			})
+			if err := p.Add(config.DatastoreWriter, slow); err != nil {
+				t.Fatalf("adding writer: %v", err)
+			}
+			if err := p.Add(config.WebsocketWriter, fast); err != nil {
+				t.Fatalf("adding writer: %v", err)
+			}
+			if err := p.Start(); err != nil {
+				t.Fatalf("starting pipeline: %v", err)
+			}
+
+			// The slow writer is stuck, which must not hold up
+			// ingestion, or the other writer.
+			for seq := 0; seq < total; seq++ {
+				if err := p.Write(logging.LogMessage{ProcID: seq}); err != nil {
+					t.Fatalf("writing message: %v", err)
+				}
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for len(fast.sequence()) < total && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if got := len(fast.sequence()); got != total {
+				t.Fatalf("fast writer got %d of %d messages", got, total)
+			}
+
+			slow.open()
+			if err := p.Stop(); err != nil {
+				t.Fatalf("stopping pipeline: %v", err)
+			}
+
+			written := slow.sequence()
+			for idx := 1; idx < len(written); idx++ {
+				if written[idx] <= written[idx-1] {
+					t.Fatalf("messages written out of order: %v", written)
+				}
+			}
+			stats := p.Stats().Writers[0]
+			if stats.Written != int64(len(written)) || stats.Written+stats.Dropped != total {
+				t.Errorf("got stats %+v for %d messages written", stats, len(written))
+			}
+			if tt.wantDropped != (stats.Dropped > 0) {
+				t.Errorf("dropped %d messages", stats.Dropped)
+			}
+		})
+	}
+}
+
+func TestPipelineDrainsOnStop(t *testing.T) {
+	const total = 20
+	writer := newGatedWriter()
+	p := NewPipeline(nil)
+	if err := p.Add(config.DatastoreWriter, writer); err != nil {
+		t.Fatalf("adding writer: %v", err)
+	}
+	if err := p.Start(); err != nil {
+		t.Fatalf("starting pipeline: %v", err)
+	}
+	for seq := 0; seq < total; seq++ {
+		if err := p.Write(logging.LogMessage{ProcID: seq}); err != nil {
+			t.Fatalf("writing message: %v", err)
+		}
+	}
+	writer.open()
+	if err := p.Stop(); err != nil {
+		t.Fatalf("stopping pipeline: %v", err)
+	}
+	if err := p.Write(logging.LogMessage{}); err == nil {
+		t.Errorf("a stopped pipeline accepted a message")
+	}
+
+	written := writer.sequence()
+	if len(written) != total {
+		t.Fatalf("got %d of %d messages", len(written), total)
+	}
+	for idx, seq := range written {
+		if seq != idx {
+			t.Fatalf("messages written out of order: %v", written)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+const (
+	// RateLimitStageName is the name of the rate limiting stage
+	RateLimitStageName = "rate_limit"
+	// SyntheticAppName is the app name of messages logged by the
+	// pipeline itself, that are not about a single app.
+	SyntheticAppName = "coriolis-logger"
+
+	sourceApp  = "app"
+	sourceHost = "host"
+	// maxRateLimitSources is the maximum number of apps and of hosts
+	// whose counters are kept. Names are chosen by senders, so
+	// sources that hit their limit once the maximum is reached are
+	// only counted in the totals.
+	maxRateLimitSources = 10000
+)
+
+// localHostname is the hostname of messages logged by the pipeline
+var localHostname = func() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return hostname
+}()
+
+// syntheticMessage returns a message logged by the pipeline itself
+func syntheticMessage(appName, hostname string, severity logging.Severity, text string) logging.LogMessage {
+	return logging.LogMessage{
+		Timestamp: time.Now(),
+		Hostname:  hostname,
+		Facility:  logging.InternalSyslogMessage,
+		Severity:  severity,
+		Priority:  int(logging.InternalSyslogMessage)*8 + int(severity),
+		AppName:   appName,
+		Message:   text,
+		RFC:       logging.RFC5424,
+	}
+}
+
+// sourceCounters holds the lifetime counters of an app or host
+type sourceCounters struct {
+	passed     int64
+	suppressed int64
+}
+
+// tokenBucket limits the rate of messages of a single source
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// counters are the lifetime counters of the source. They are kept
+	// by the rate limiter once the source hits its limit, so they
+	// outlive the bucket.
+	counters *sourceCounters
+	// pending is the number of messages suppressed since the last
+	// summary.
+	pending int64
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := &tokenBucket{
+		rate:     rate,
+		burst:    float64(burst),
+		last:     now,
+		counters: &sourceCounters{},
+	}
+	if b.burst < 1 {
+		b.burst = rate
+		if b.burst < 1 {
+			b.burst = 1
+		}
+	}
+	b.tokens = b.burst
+	return b
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+func (b *tokenBucket) take() {
+	if b != nil {
+		b.tokens--
+		b.counters.passed++
+	}
+}
+
+func (b *tokenBucket) suppress() {
+	b.counters.suppressed++
+	b.pending++
+}
+
+// idle returns true if the bucket is full and no suppressed message
+// is waiting to be summarized, so it can be forgotten without changing
+// the outcome of future messages.
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst && b.pending == 0
+}
+
+// RateLimitSourceStats holds the counters of an app or host whose
+// messages were suppressed.
+type RateLimitSourceStats struct {
+	Type       string `json:"type"`
+	Name       string `json:"name"`
+	Passed     int64  `json:"passed"`
+	Suppressed int64  `json:"suppressed"`
+}
+
+// RateLimitStats holds the counters of the rate limiting stage
+type RateLimitStats struct {
+	Passed     int64                  `json:"passed"`
+	Suppressed int64                  `json:"suppressed"`
+	Sources    []RateLimitSourceStats `json:"sources"`
+}
+
+// NewRateLimiter returns a stage that applies token bucket rate
+// limits to each app and each host.
+func NewRateLimiter(cfg config.RateLimit) *RateLimiter {
+	return &RateLimiter{
+		cfg:          cfg,
+		apps:         map[string]*tokenBucket{},
+		hosts:        map[string]*tokenBucket{},
+		appCounters:  map[string]*sourceCounters{},
+		hostCounters: map[string]*sourceCounters{},
+		lastSummary:  time.Now(),
+	}
+}
+
+var _ Stage = (*RateLimiter)(nil)
+var _ Flusher = (*RateLimiter)(nil)
+
+// RateLimiter suppresses the messages of apps and hosts that exceed
+// their rate limit, and periodically logs how many messages were
+// suppressed.
+type RateLimiter struct {
+	cfg config.RateLimit
+
+	mut   sync.Mutex
+	apps  map[string]*tokenBucket
+	hosts map[string]*tokenBucket
+	// appCounters and hostCounters hold the counters of the sources
+	// that hit their limit. Buckets of idle sources are forgotten,
+	// but their counters are kept.
+	appCounters  map[string]*sourceCounters
+	hostCounters map[string]*sourceCounters
+	passed       int64
+	suppressed   int64
+	lastSummary  time.Time
+}
+
+func (r *RateLimiter) Name() string {
+	return RateLimitStageName
+}
+
+// limit returns the rate limit of a source
+func (r *RateLimiter) limit(source, name string) (float64, int) {
+	for _, override := range r.cfg.Overrides {
+		pattern := override.AppName
+		if source == sourceHost {
+			pattern = override.Hostname
+		}
+		if pattern == "" {
+			continue
+		}
+		if matched, _ := path.Match(pattern, name); matched {
+			return override.Rate, override.Burst
+		}
+	}
+	if source == sourceHost {
+		return r.cfg.HostRate, r.cfg.HostBurst
+	}
+	return r.cfg.AppRate, r.cfg.AppBurst
+}
+
+// bucket returns the bucket of a source, or nil if the source is not
+// rate limited. A new bucket picks up the counters kept for the
+// source, if any.
+func (r *RateLimiter) bucket(buckets map[string]*tokenBucket, counters map[string]*sourceCounters, source, name string, now time.Time) *tokenBucket {
+	if b, ok := buckets[name]; ok {
+		return b
+	}
+	rate, burst := r.limit(source, name)
+	if rate == 0 {
+		return nil
+	}
+	b := newTokenBucket(rate, burst, now)
+	if kept, ok := counters[name]; ok {
+		b.counters = kept
+	}
+	buckets[name] = b
+	return b
+}
+
+// suppress counts a message of the named source as suppressed, and
+// keeps the counters of the source.
+func (r *RateLimiter) suppress(b *tokenBucket, counters map[string]*sourceCounters, name string) {
+	b.suppress()
+	if _, ok := counters[name]; !ok && len(counters) < maxRateLimitSources {
+		counters[name] = b.counters
+	}
+	r.suppressed++
+}
+
+func (r *RateLimiter) Handle(msg logging.LogMessage, emit func(logging.LogMessage) error) error {
+	now := time.Now()
+	r.mut.Lock()
+	app := r.bucket(r.apps, r.appCounters, sourceApp, msg.AppName, now)
+	host := r.bucket(r.hosts, r.hostCounters, sourceHost, msg.Hostname, now)
+	switch {
+	case !app.allow(now):
+		r.suppress(app, r.appCounters, msg.AppName)
+	case !host.allow(now):
+		r.suppress(host, r.hostCounters, msg.Hostname)
+	default:
+		app.take()
+		host.take()
+		r.passed++
+		r.mut.Unlock()
+		return emit(msg)
+	}
+	r.mut.Unlock()
+	return nil
+}
+
+// Flush logs a summary of the messages suppressed for each source,
+// once per summary interval.
+func (r *RateLimiter) Flush(now time.Time, final bool, emit func(logging.LogMessage) error) {
+	r.mut.Lock()
+	if !final && now.Sub(r.lastSummary) < r.cfg.GetSummaryInterval() {
+		r.mut.Unlock()
+		return
+	}
+	r.lastSummary = now
+	summaries := []logging.LogMessage{}
+	for name, b := range r.apps {
+		if b.pending > 0 {
+			summaries = append(summaries, syntheticMessage(
+				name, localHostname, logging.Warning,
+				fmt.Sprintf("suppressed %d messages from app %s", b.pending, name)))
+			b.pending = 0
+		} else if b.idle(now) {
+			delete(r.apps, name)
+		}
+	}
+	for name, b := range r.hosts {
+		if b.pending > 0 {
+			summaries = append(summaries, syntheticMessage(
+				SyntheticAppName, name, logging.Warning,
+				fmt.Sprintf("suppressed %d messages from host %s", b.pending, name)))
+			b.pending = 0
+		} else if b.idle(now) {
+			delete(r.hosts, name)
+		}
+	}
+	r.mut.Unlock()
+
+	for _, msg := range summaries {
+		if err := emit(msg); err != nil {
+			log.Errorf("failed to log rate limit summary: %v", err)
+		}
+	}
+}
+
+func (r *RateLimiter) Stats() interface{} {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	stats := RateLimitStats{
+		Passed:     r.passed,
+		Suppressed: r.suppressed,
+		Sources:    []RateLimitSourceStats{},
+	}
+	add := func(source string, counters map[string]*sourceCounters) {
+		for name, c := range counters {
+			stats.Sources = append(stats.Sources, RateLimitSourceStats{
+				Type:       source,
+				Name:       name,
+				Passed:     c.passed,
+				Suppressed: c.suppressed,
+			})
+		}
+	}
+	add(sourceApp, r.appCounters)
+	add(sourceHost, r.hostCounters)
+	sort.Slice(stats.Sources, func(i, j int) bool {
+		return stats.Sources[i].Suppressed > stats.Sources[j].Suppressed
+	})
+	return stats
+}
@@ -0,0 +1,217 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+// collect returns an emit function that appends to msgs
+func collect(msgs *[]logging.LogMessage) func(logging.LogMessage) error {
+	return func(msg logging.LogMessage) error {
+		*msgs = append(*msgs, msg)
+		return nil
+	}
+}
+
+// repeatMessage returns count copies of msg
+func repeatMessage(msg logging.LogMessage, count int) []logging.LogMessage {
+	ret := make([]logging.LogMessage, count)
+	for idx := range ret {
+		ret[idx] = msg
+	}
+	return ret
+}
+
+func TestRateLimiter(t *testing.T) {
+	tests := []struct {
+		name           string
+		cfg            config.RateLimit
+		msgs           []logging.LogMessage
+		wantPassed     int
+		wantSuppressed int64
+	}{
+		{
+			name:       "no limits",
+			cfg:        config.RateLimit{},
+			msgs:       repeatMessage(logging.LogMessage{AppName: "app"}, 10),
+			wantPassed: 10,
+		},
+		{
+			name:           "app burst",
+			cfg:            config.RateLimit{AppRate: 0.001, AppBurst: 3},
+			msgs:           repeatMessage(logging.LogMessage{AppName: "app"}, 10),
+			wantPassed:     3,
+			wantSuppressed: 7,
+		},
+		{
+			name: "apps are limited separately",
+			cfg:  config.RateLimit{AppRate: 0.001, AppBurst: 2},
+			msgs: append(
+				repeatMessage(logging.LogMessage{AppName: "a"}, 3),
+				repeatMessage(logging.LogMessage{AppName: "b"}, 3)...),
+			wantPassed:     4,
+			wantSuppressed: 2,
+		},
+		{
+			name:           "host burst",
+			cfg:            config.RateLimit{HostRate: 0.001, HostBurst: 1},
+			msgs:           repeatMessage(logging.LogMessage{AppName: "app", Hostname: "host"}, 4),
+			wantPassed:     1,
+			wantSuppressed: 3,
+		},
+		{
+			name: "override",
+			cfg: config.RateLimit{
+				AppRate: 0.001, AppBurst: 1,
+				Overrides: []config.RateLimitOverride{
+					{AppName: "noisy-*", Rate: 0.001, Burst: 5},
+				},
+			},
+			msgs:           repeatMessage(logging.LogMessage{AppName: "noisy-app"}, 6),
+			wantPassed:     5,
+			wantSuppressed: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := NewRateLimiter(tt.cfg)
+			passed := []logging.LogMessage{}
+			for _, msg := range tt.msgs {
+				if err := limiter.Handle(msg, collect(&passed)); err != nil {
+					t.Fatalf("handling message: %v", err)
+				}
+			}
+			if len(passed) != tt.wantPassed {
+				t.Errorf("passed %d messages, want %d", len(passed), tt.wantPassed)
+			}
+			stats := limiter.Stats().(RateLimitStats)
+			if stats.Suppressed != tt.wantSuppressed {
+				t.Errorf("suppressed %d messages, want %d", stats.Suppressed, tt.wantSuppressed)
+			}
+		})
+	}
+}
+
+func TestRateLimiterSummary(t *testing.T) {
+	limiter := NewRateLimiter(config.RateLimit{AppRate: 1, AppBurst: 1, SummaryInterval: 60})
+	discard := func(logging.LogMessage) error { return nil }
+	for idx := 0; idx < 5; idx++ {
+		limiter.Handle(logging.LogMessage{AppName: "app"}, discard)
+	}
+
+	summaries := []logging.LogMessage{}
+	now := time.Now()
+	limiter.Flush(now, false, collect(&summaries))
+	if len(summaries) != 0 {
+		t.Fatalf("got a summary before the summary interval")
+	}
+	limiter.Flush(now.Add(time.Minute), false, collect(&summaries))
+	if len(summaries) != 1 || !strings.Contains(summaries[0].Message, "suppressed 4 messages from app app") {
+		t.Fatalf("got summaries %v, want one for 4 messages", summaries)
+	}
+	limiter.Flush(now.Add(2*time.Minute), false, collect(&summaries))
+	if len(summaries) != 1 {
+		t.Errorf("suppressed messages were summarized twice")
+	}
+}
+
+// TestRateLimiterForgetsIdleSources checks that the buckets of sources
+// which had messages suppressed are forgotten once they are summarized
+// and stay under their limit, while their counters are kept.
+func TestRateLimiterForgetsIdleSources(t *testing.T) {
+	limiter := NewRateLimiter(config.RateLimit{
+		AppRate: 1, AppBurst: 1,
+		HostRate: 1, HostBurst: 1,
+		SummaryInterval: 60,
+	})
+	discard := func(logging.LogMessage) error { return nil }
+	for idx := 0; idx < 1000; idx++ {
+		msg := logging.LogMessage{
+			AppName:  fmt.Sprintf("app-%d", idx),
+			Hostname: fmt.Sprintf("host-%d", idx),
+		}
+		limiter.Handle(msg, discard)
+		limiter.Handle(msg, discard)
+		// A new app, suppressed by the host limit.
+		msg.AppName += "-other"
+		limiter.Handle(msg, discard)
+	}
+	if stats := limiter.Stats().(RateLimitStats); stats.Suppressed != 2000 {
+		t.Fatalf("suppressed %d messages, want 2000", stats.Suppressed)
+	}
+
+	now := time.Now()
+	summaries := []logging.LogMessage{}
+	// The first flush logs the summaries, and the second one finds
+	// the sources idle.
+	limiter.Flush(now.Add(time.Minute), false, collect(&summaries))
+	limiter.Flush(now.Add(2*time.Minute), false, collect(&summaries))
+	if len(summaries) != 2000 {
+		t.Errorf("got %d summaries, want 2000", len(summaries))
+	}
+
+	limiter.mut.Lock()
+	apps, hosts := len(limiter.apps), len(limiter.hosts)
+	limiter.mut.Unlock()
+	if apps != 0 || hosts != 0 {
+		t.Errorf("%d apps and %d hosts are still tracked", apps, hosts)
+	}
+	stats := limiter.Stats().(RateLimitStats)
+	if stats.Suppressed != 2000 {
+		t.Errorf("the stage counters were reset, got %d suppressed", stats.Suppressed)
+	}
+	if len(stats.Sources) != 2000 {
+		t.Errorf("got counters for %d sources, want 2000", len(stats.Sources))
+	}
+}
+
+// TestRateLimiterKeepsSourceCounters checks that the counters of a
+// source outlive its bucket, and carry on when it comes back.
+func TestRateLimiterKeepsSourceCounters(t *testing.T) {
+	limiter := NewRateLimiter(config.RateLimit{AppRate: 1, AppBurst: 1, SummaryInterval: 60})
+	discard := func(logging.LogMessage) error { return nil }
+	msg := logging.LogMessage{AppName: "app"}
+	limiter.Handle(msg, discard)
+	limiter.Handle(msg, discard)
+
+	now := time.Now()
+	limiter.Flush(now.Add(time.Minute), false, discard)
+	limiter.Flush(now.Add(2*time.Minute), false, discard)
+	limiter.mut.Lock()
+	_, tracked := limiter.apps["app"]
+	limiter.mut.Unlock()
+	if tracked {
+		t.Fatalf("the idle app is still tracked")
+	}
+	want := []RateLimitSourceStats{{Type: sourceApp, Name: "app", Passed: 1, Suppressed: 1}}
+	if got := limiter.Stats().(RateLimitStats).Sources; !reflect.DeepEqual(got, want) {
+		t.Errorf("got sources %+v, want %+v", got, want)
+	}
+
+	limiter.Handle(msg, discard)
+	limiter.Handle(msg, discard)
+	want = []RateLimitSourceStats{{Type: sourceApp, Name: "app", Passed: 2, Suppressed: 2}}
+	if got := limiter.Stats().(RateLimitStats).Sources; !reflect.DeepEqual(got, want) {
+		t.Errorf("got sources %+v, want %+v", got, want)
+	}
+}
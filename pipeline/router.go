@@ -0,0 +1,199 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sync/atomic"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+
+	"github.com/pkg/errors"
+)
+
+// RuleStats holds the counters of a routing rule
+type RuleStats struct {
+	Rule    int      `json:"rule"`
+	Writers []string `json:"writers,omitempty"`
+	Drop    bool     `json:"drop,omitempty"`
+	Matched int64    `json:"matched"`
+}
+
+// RoutingStats holds the counters of a router
+type RoutingStats struct {
+	Rules []RuleStats `json:"rules"`
+	// Unmatched is the number of messages sent to the default writers.
+	Unmatched int64 `json:"unmatched"`
+}
+
+type route struct {
+	rule    config.RoutingRule
+	message *regexp.Regexp
+	writers []logging.Writer
+	matched int64
+}
+
+func (r *route) match(msg logging.LogMessage) bool {
+	if r.rule.AppName != "" {
+		if matched, _ := path.Match(r.rule.AppName, msg.AppName); !matched {
+			return false
+		}
+	}
+	if r.rule.Hostname != "" {
+		if matched, _ := path.Match(r.rule.Hostname, msg.Hostname); !matched {
+			return false
+		}
+	}
+	if len(r.rule.Facilities) > 0 && !containsInt(r.rule.Facilities, int(msg.Facility)) {
+		return false
+	}
+	if len(r.rule.Severities) > 0 && !containsInt(r.rule.Severities, int(msg.Severity)) {
+		return false
+	}
+	if r.message != nil && !r.message.MatchString(msg.Message) {
+		return false
+	}
+	return true
+}
+
+func containsInt(vals []int, val int) bool {
+	for _, v := range vals {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+// NamedWriter is a writer that routing rules refer to by name
+type NamedWriter struct {
+	Name   string
+	Writer logging.Writer
+}
+
+// NewRouter returns a writer that sends messages to the named writers
+// selected by the routing rules in cfg. Rules may only name writers in
+// writers. If cfg has no default writers, messages that match no rule
+// are sent to all writers, in order.
+func NewRouter(cfg config.Routing, writers []NamedWriter) (*Router, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, errors.Wrap(err, "validating routing config")
+	}
+	byName := map[string]logging.Writer{}
+	for _, named := range writers {
+		byName[named.Name] = named.Writer
+	}
+	lookup := func(names []string) ([]logging.Writer, error) {
+		ret := []logging.Writer{}
+		for _, name := range names {
+			writer, ok := byName[name]
+			if !ok {
+				return nil, fmt.Errorf("%s writer is not enabled", name)
+			}
+			ret = append(ret, writer)
+		}
+		return ret, nil
+	}
+
+	router := &Router{}
+	for idx, rule := range cfg.Rules {
+		ruleWriters, err := lookup(rule.Writers)
+		if err != nil {
+			return nil, errors.Wrapf(err, "routing rule %d", idx)
+		}
+		r := &route{
+			rule:    rule,
+			writers: ruleWriters,
+		}
+		if rule.Message != "" {
+			// Validated above.
+			r.message = regexp.MustCompile(rule.Message)
+		}
+		router.routes = append(router.routes, r)
+	}
+	if len(cfg.DefaultWriters) > 0 {
+		defaults, err := lookup(cfg.DefaultWriters)
+		if err != nil {
+			return nil, errors.Wrap(err, "default_writers")
+		}
+		router.defaults = defaults
+	} else {
+		for _, named := range writers {
+			router.defaults = append(router.defaults, named.Writer)
+		}
+	}
+	return router, nil
+}
+
+var _ logging.Writer = (*Router)(nil)
+
+// Router sends each message to the writers selected by the first
+// routing rule that matches it.
+type Router struct {
+	routes    []*route
+	defaults  []logging.Writer
+	unmatched int64
+}
+
+func (r *Router) Write(msg logging.LogMessage) error {
+	writers := r.defaults
+	matched := false
+	for _, rt := range r.routes {
+		if rt.match(msg) {
+			atomic.AddInt64(&rt.matched, 1)
+			if rt.rule.Drop {
+				return nil
+			}
+			writers = rt.writers
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		atomic.AddInt64(&r.unmatched, 1)
+	}
+	return writeAll(writers, msg)
+}
+
+// Stats returns the counters of the router
+func (r *Router) Stats() RoutingStats {
+	stats := RoutingStats{
+		Rules:     []RuleStats{},
+		Unmatched: atomic.LoadInt64(&r.unmatched),
+	}
+	for idx, rt := range r.routes {
+		stats.Rules = append(stats.Rules, RuleStats{
+			Rule:    idx,
+			Writers: rt.rule.Writers,
+			Drop:    rt.rule.Drop,
+			Matched: atomic.LoadInt64(&rt.matched),
+		})
+	}
+	return stats
+}
+
+// writeAll writes msg to all writers, and returns the first error
+func writeAll(writers []logging.Writer, msg logging.LogMessage) error {
+	var ret error
+	for _, writer := range writers {
+		if err := writer.Write(msg); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
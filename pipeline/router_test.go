@@ -0,0 +1,173 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"sync"
+	"testing"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+// recorder is a writer that keeps the messages written to it
+type recorder struct {
+	mut      sync.Mutex
+	messages []logging.LogMessage
+}
+
+func (r *recorder) Write(msg logging.LogMessage) error {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.messages = append(r.messages, msg)
+	return nil
+}
+
+func (r *recorder) count() int {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return len(r.messages)
+}
+
+func TestRouter(t *testing.T) {
+	cfg := config.Routing{
+		Rules: []config.RoutingRule{
+			{Severities: []int{int(logging.Debug)}, Writers: []string{config.WebsocketWriter}},
+			{AppName: "coriolis-*", Message: "heartbeat", Drop: true},
+			{Hostname: "db-*", Writers: []string{config.DatastoreWriter, config.WebsocketWriter}},
+		},
+		DefaultWriters: []string{config.DatastoreWriter},
+	}
+
+	tests := []struct {
+		name          string
+		msg           logging.LogMessage
+		wantDatastore int
+		wantWebsocket int
+	}{
+		{
+			name:          "severity rule",
+			msg:           logging.LogMessage{AppName: "app", Severity: logging.Debug},
+			wantWebsocket: 1,
+		},
+		{
+			name: "drop rule",
+			msg:  logging.LogMessage{AppName: "coriolis-worker", Message: "heartbeat ok"},
+		},
+		{
+			name:          "app does not match the drop rule",
+			msg:           logging.LogMessage{AppName: "other", Message: "heartbeat ok"},
+			wantDatastore: 1,
+		},
+		{
+			name:          "hostname rule",
+			msg:           logging.LogMessage{Hostname: "db-1"},
+			wantDatastore: 1,
+			wantWebsocket: 1,
+		},
+		{
+			name:          "first rule wins",
+			msg:           logging.LogMessage{Hostname: "db-1", Severity: logging.Debug},
+			wantWebsocket: 1,
+		},
+		{
+			name:          "default writers",
+			msg:           logging.LogMessage{Hostname: "web-1"},
+			wantDatastore: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datastore, websocket := &recorder{}, &recorder{}
+			router, err := NewRouter(cfg, []NamedWriter{
+				{Name: config.DatastoreWriter, Writer: datastore},
+				{Name: config.WebsocketWriter, Writer: websocket},
+			})
+			if err != nil {
+				t.Fatalf("creating router: %v", err)
+			}
+			if err := router.Write(tt.msg); err != nil {
+				t.Fatalf("writing message: %v", err)
+			}
+			if got := datastore.count(); got != tt.wantDatastore {
+				t.Errorf("datastore got %d messages, want %d", got, tt.wantDatastore)
+			}
+			if got := websocket.count(); got != tt.wantWebsocket {
+				t.Errorf("websocket got %d messages, want %d", got, tt.wantWebsocket)
+			}
+		})
+	}
+}
+
+func TestRouterRejectsDisabledWriters(t *testing.T) {
+	writers := []NamedWriter{{Name: config.DatastoreWriter, Writer: &recorder{}}}
+	tests := []struct {
+		name string
+		cfg  config.Routing
+	}{
+		{
+			name: "rule",
+			cfg: config.Routing{Rules: []config.RoutingRule{
+				{AppName: "app", Writers: []string{config.StdOutWriter}},
+			}},
+		},
+		{
+			name: "default writers",
+			cfg:  config.Routing{DefaultWriters: []string{config.WebsocketWriter}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRouter(tt.cfg, writers); err == nil {
+				t.Errorf("expected an error routing to a disabled writer")
+			}
+		})
+	}
+}
+
+// orderWriter records the order in which writers are called
+type orderWriter struct {
+	name  string
+	order *[]string
+}
+
+func (w orderWriter) Write(msg logging.LogMessage) error {
+	*w.order = append(*w.order, w.name)
+	return nil
+}
+
+func TestRouterDefaultsToAllWritersInOrder(t *testing.T) {
+	names := []string{config.WebsocketWriter, config.DatastoreWriter, config.StdOutWriter}
+	for attempt := 0; attempt < 10; attempt++ {
+		order := []string{}
+		writers := []NamedWriter{}
+		for _, name := range names {
+			writers = append(writers, NamedWriter{Name: name, Writer: orderWriter{name, &order}})
+		}
+		router, err := NewRouter(config.Routing{}, writers)
+		if err != nil {
+			t.Fatalf("creating router: %v", err)
+		}
+		router.Write(logging.LogMessage{})
+		if len(order) != len(names) {
+			t.Fatalf("got writers %v, want %v", order, names)
+		}
+		for idx := range names {
+			if order[idx] != names[idx] {
+				t.Fatalf("got writers %v, want %v", order, names)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// spillFile is an append only file of queued messages, encoded as
+// JSON lines. Messages are read back in the order they were written,
+// and the file is truncated once all of them were read. It is not
+// safe for concurrent use.
+type spillFile struct {
+	file    *os.File
+	maxSize int64
+	// readOffset and writeOffset are the offsets of the next message
+	// to read, and of the end of the file.
+	readOffset  int64
+	writeOffset int64
+	// pending is the number of messages left to read.
+	pending int64
+}
+
+// openSpillFile opens the spill file of the named writer in dir.
+// Messages left in the file by a previous run are kept, and read
+// back before any new message.
+func openSpillFile(dir, name string, maxSize int64) (*spillFile, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, errors.Wrap(err, "creating spill dir")
+	}
+	file, err := os.OpenFile(filepath.Join(dir, name+".spill"), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening spill file")
+	}
+	spill := &spillFile{
+		file:    file,
+		maxSize: maxSize,
+	}
+	if err := spill.countPending(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return spill, nil
+}
+
+func (s *spillFile) countPending() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "reading spill file info")
+	}
+	s.writeOffset = info.Size()
+	reader := bufio.NewReader(io.NewSectionReader(s.file, 0, s.writeOffset))
+	buf := make([]byte, 32*1024)
+	var last byte = '\n'
+	for {
+		n, err := reader.Read(buf)
+		s.pending += int64(bytes.Count(buf[:n], []byte{'\n'}))
+		if n > 0 {
+			last = buf[n-1]
+		}
+		if err == io.EOF {
+			if last != '\n' {
+				// Terminate the partial line left by a crash, so it
+				// is not merged with the next message.
+				if _, err := s.file.WriteAt([]byte{'\n'}, s.writeOffset); err != nil {
+					return errors.Wrap(err, "writing spill file")
+				}
+				s.writeOffset++
+				s.pending++
+			}
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading spill file")
+		}
+	}
+}
+
+// empty returns true if all messages were read
+func (s *spillFile) empty() bool {
+	return s.readOffset >= s.writeOffset
+}
+
+// append adds an entry at the end of the file
+func (s *spillFile) append(e entry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "encoding message")
+	}
+	data = append(data, '\n')
+	if s.maxSize > 0 && s.writeOffset+int64(len(data)) > s.maxSize {
+		return fmt.Errorf("spill file is full")
+	}
+	if _, err := s.file.WriteAt(data, s.writeOffset); err != nil {
+		return errors.Wrap(err, "writing spill file")
+	}
+	s.writeOffset += int64(len(data))
+	s.pending++
+	return nil
+}
+
+// read returns up to max entries, in the order they were appended.
+// Once all entries were read, the file is truncated.
+func (s *spillFile) read(max int) ([]entry, error) {
+	reader := bufio.NewReader(io.NewSectionReader(s.file, s.readOffset, s.writeOffset-s.readOffset))
+	entries := []entry{}
+	for len(entries) < max && !s.empty() {
+		line, err := reader.ReadBytes('\n')
+		s.readOffset += int64(len(line))
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			s.pending--
+			var e entry
+			if jsonErr := json.Unmarshal(line, &e); jsonErr != nil {
+				log.Errorf("skipping invalid spilled message: %v", jsonErr)
+			} else {
+				entries = append(entries, e)
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				return entries, errors.Wrap(err, "reading spill file")
+			}
+			break
+		}
+	}
+	if s.empty() {
+		if err := s.reset(); err != nil {
+			return entries, err
+		}
+	}
+	return entries, nil
+}
+
+func (s *spillFile) reset() error {
+	if err := s.file.Truncate(0); err != nil {
+		return errors.Wrap(err, "truncating spill file")
+	}
+	s.readOffset = 0
+	s.writeOffset = 0
+	s.pending = 0
+	return nil
+}
+
+// close closes the file, and removes it if all messages were read
+func (s *spillFile) close() error {
+	name := s.file.Name()
+	if err := s.file.Close(); err != nil {
+		return errors.Wrap(err, "closing spill file")
+	}
+	if s.empty() {
+		if err := os.Remove(name); err != nil {
+			return errors.Wrap(err, "removing spill file")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package retention
+
+import (
+	"path"
+	"time"
+
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/params"
+
+	"github.com/pkg/errors"
+)
+
+// limits returns the maximum message count and size for a log. A
+// zero value means no limit.
+func (m *Manager) limits(logName string) (int64, int64) {
+	if m.quota == nil {
+		return 0, 0
+	}
+	for _, rule := range m.quota.Rules {
+		if matched, _ := path.Match(rule.AppName, logName); matched {
+			// Validated when loading the config.
+			size, _ := config.ParseSize(rule.MaxSize)
+			return rule.MaxMessages, size
+		}
+	}
+	size, _ := config.ParseSize(m.quota.LogMaxSize)
+	return m.quota.LogMaxMessages, size
+}
+
+// excessMessages returns the number of messages that need to be
+// deleted to bring usage under the supplied limits. Size limits are
+// converted to a message count using the average message size, so
+// they are only an estimate: the disk usage reported by the datastore
+// is assumed to be evenly split between messages.
+func excessMessages(messages, size, maxMessages, maxSize int64) int64 {
+	allowed := messages
+	if maxMessages > 0 && maxMessages < allowed {
+		allowed = maxMessages
+	}
+	if maxSize > 0 && size > maxSize && messages > 0 {
+		bySize := int64(float64(maxSize) / float64(size) * float64(messages))
+		if bySize < allowed {
+			allowed = bySize
+		}
+	}
+	return messages - allowed
+}
+
+// countUntil returns the number of messages in logs that are no
+// newer than until.
+func (m *Manager) countUntil(logs []string, until time.Time) (int64, error) {
+	var total int64
+	for _, logName := range logs {
+		count, err := m.store.Count(params.QueryParams{
+			AppName: logName,
+			EndDate: until,
+		})
+		if err != nil {
+			return 0, errors.Wrapf(err, "counting logs in %q", logName)
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// oldestCutoff returns the earliest time between since and now such
+// that deleting all messages in logs up to and including it removes
+// at least n messages. It only relies on Count, so it works with any
+// datastore, at the cost of a binary search over the log timeline.
+// The search has nanosecond precision, so only messages sharing the
+// timestamp of the n-th oldest one are deleted in excess.
+func (m *Manager) oldestCutoff(logs []string, n int64, since, now time.Time) (time.Time, error) {
+	lo, hi := int64(0), now.UnixNano()
+	if !since.IsZero() && since.UnixNano() < hi {
+		lo = since.UnixNano()
+	}
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		count, err := m.countUntil(logs, time.Unix(0, mid))
+		if err != nil {
+			return time.Time{}, err
+		}
+		if count >= n {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return time.Unix(0, lo), nil
+}
+
+// trim deletes the oldest messages in logs, until at least excess
+// messages are removed. since is the timestamp of the oldest message
+// in logs, or the zero time if unknown.
+func (m *Manager) trim(logs []string, since time.Time, excess int64, reason string) error {
+	cutoff, err := m.oldestCutoff(logs, excess, since, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "finding quota cutoff")
+	}
+	for _, logName := range logs {
+		p := params.QueryParams{
+			AppName: logName,
+			EndDate: cutoff,
+		}
+		if m.dryRun {
+			log.Infof(
+				"dry run: %s exceeded, would delete messages from %q older than %s",
+				reason, logName, cutoff.Format(time.RFC3339Nano))
+			continue
+		}
+		if m.archiver != nil {
+			if _, err := m.archiver.Archive(p, nil); err != nil {
+				return errors.Wrapf(err, "archiving logs from %q", logName)
+			}
+		}
+		log.Infof(
+			"%s exceeded, deleting messages from %q older than %s",
+			reason, logName, cutoff.Format(time.RFC3339Nano))
+		if err := m.store.Delete(p); err != nil {
+			return errors.Wrapf(err, "deleting logs from %q", logName)
+		}
+	}
+	return nil
+}
+
+// enforceQuota deletes the oldest messages of logs that exceed their
+// quota, and then of all logs if the global quota is exceeded.
+func (m *Manager) enforceQuota(logs []common.LogInfo) error {
+	if m.quota == nil {
+		return nil
+	}
+	var totalMessages, totalSize int64
+	var oldest time.Time
+	names := []string{}
+	for _, info := range logs {
+		maxMessages, maxSize := m.limits(info.Name)
+		excess := excessMessages(info.Messages, info.Size, maxMessages, maxSize)
+		if excess > 0 {
+			if err := m.trim([]string{info.Name}, info.FirstTimestamp, excess, "log quota"); err != nil {
+				return err
+			}
+			if !m.dryRun {
+				// Assume the deleted messages were of average size.
+				info.Size -= int64(float64(info.Size) * float64(excess) / float64(info.Messages))
+				info.Messages -= excess
+			}
+		}
+		totalMessages += info.Messages
+		totalSize += info.Size
+		names = append(names, info.Name)
+		if !info.FirstTimestamp.IsZero() && (oldest.IsZero() || info.FirstTimestamp.Before(oldest)) {
+			oldest = info.FirstTimestamp
+		}
+	}
+
+	maxSize, _ := config.ParseSize(m.quota.MaxSize)
+	excess := excessMessages(totalMessages, totalSize, m.quota.MaxMessages, maxSize)
+	if excess > 0 {
+		if err := m.trim(names, oldest, excess, "global quota"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package retention
+
+import (
+	"testing"
+	"time"
+
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+)
+
+// memStore is an in-memory datastore, holding enough of the
+// DataStore behaviour for the retention manager.
+type memStore struct {
+	common.DataStore
+
+	messages []logging.LogMessage
+	// late holds messages written once the first query is done,
+	// standing in for messages that arrive during a retention run.
+	late []logging.LogMessage
+}
+
+func (s *memStore) Query(p params.QueryParams) (common.Iterator, error) {
+	matched := []logging.LogMessage{}
+	for _, msg := range s.messages {
+		if p.Match(msg) {
+			matched = append(matched, msg)
+		}
+	}
+	s.messages = append(s.messages, s.late...)
+	s.late = nil
+	return common.NewSliceIterator(matched), nil
+}
+
+func (s *memStore) Count(p params.QueryParams) (int64, error) {
+	var count int64
+	for _, msg := range s.messages {
+		if p.Match(msg) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *memStore) Delete(p params.QueryParams) error {
+	kept := s.messages[:0]
+	for _, msg := range s.messages {
+		if !p.Match(msg) {
+			kept = append(kept, msg)
+		}
+	}
+	s.messages = kept
+	return nil
+}
+
+func TestExcessMessages(t *testing.T) {
+	tests := []struct {
+		name        string
+		messages    int64
+		size        int64
+		maxMessages int64
+		maxSize     int64
+		want        int64
+	}{
+		{"no limits", 100, 1000, 0, 0, 0},
+		{"under limits", 100, 1000, 200, 2000, 0},
+		{"message limit", 100, 1000, 60, 0, 40},
+		{"size limit", 100, 1000, 0, 250, 75},
+		{"strictest limit wins", 100, 1000, 50, 900, 50},
+		{"empty log", 0, 1000, 0, 10, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := excessMessages(tt.messages, tt.size, tt.maxMessages, tt.maxSize)
+			if got != tt.want {
+				t.Errorf("excessMessages() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrimSubSecond(t *testing.T) {
+	base := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	store := &memStore{}
+	// Ten messages within the same second.
+	for i := 0; i < 10; i++ {
+		store.messages = append(store.messages, logging.LogMessage{
+			AppName:   "app",
+			Timestamp: base.Add(time.Duration(i) * time.Millisecond),
+		})
+	}
+	mgr := &Manager{store: store}
+
+	if err := mgr.trim([]string{"app"}, base, 3, "test quota"); err != nil {
+		t.Fatalf("trim: %v", err)
+	}
+	if len(store.messages) != 7 {
+		t.Fatalf("got %d messages left, want 7", len(store.messages))
+	}
+	if first := store.messages[0].Timestamp; !first.Equal(base.Add(3 * time.Millisecond)) {
+		t.Errorf("oldest message left is %s, want %s", first, base.Add(3*time.Millisecond))
+	}
+}
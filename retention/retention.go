@@ -0,0 +1,335 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package retention
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	"coriolis-logger/archive"
+	"coriolis-logger/config"
+	"coriolis-logger/datastore/common"
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+	"coriolis-logger/worker"
+
+	"github.com/juju/loggo"
+	"github.com/pkg/errors"
+)
+
+var log = loggo.GetLogger("coriolis.logger.retention")
+
+const (
+	// DefaultRuleName is reported for severities that do not
+	// match any configured retention rule.
+	DefaultRuleName = "default"
+
+	applyInterval = 1 * time.Hour
+)
+
+// EffectiveRule is the retention period applied to a set of
+// severity levels of a single log.
+type EffectiveRule struct {
+	// Rule is the app_name pattern of the rule that matched, or
+	// "default" if no rule matched.
+	Rule           string    `json:"rule"`
+	Severities     []int     `json:"severities"`
+	RetentionHours int64     `json:"retention_hours"`
+	DeleteBefore   time.Time `json:"delete_before"`
+	// Expired is the number of messages found to be past their
+	// retention period during the last dry run.
+	Expired *int64 `json:"expired,omitempty"`
+	// CatchAll is set on the rule that also applies to messages with
+	// a severity outside the valid range.
+	CatchAll bool `json:"catch_all,omitempty"`
+
+	period time.Duration
+}
+
+// Policy is the effective retention policy of a log.
+type Policy struct {
+	LogName string          `json:"log_name"`
+	DryRun  bool            `json:"dry_run"`
+	Rules   []EffectiveRule `json:"rules"`
+}
+
+// NewManager returns a new retention manager. If archiver is not nil,
+// expired logs are archived before being deleted.
+func NewManager(ctx context.Context, cfg config.Syslog, store common.DataStore, archiver *archive.Archiver) *Manager {
+	mgr := &Manager{
+		store:         store,
+		archiver:      archiver,
+		defaultPeriod: cfg.DefaultRetention(),
+		ctx:           ctx,
+		closed:        make(chan struct{}),
+		quit:          make(chan struct{}),
+		lastRun:       map[string]Policy{},
+	}
+	if cfg.Retention != nil {
+		mgr.rules = cfg.Retention.Rules
+		mgr.dryRun = cfg.Retention.DryRun
+	}
+	mgr.quota = cfg.Quota
+	return mgr
+}
+
+var _ worker.SimpleWorker = (*Manager)(nil)
+
+// Manager periodically deletes logs that are past their
+// retention period, or that exceed their storage quota.
+type Manager struct {
+	store         common.DataStore
+	archiver      *archive.Archiver
+	rules         []config.RetentionRule
+	quota         *config.Quota
+	defaultPeriod time.Duration
+	dryRun        bool
+
+	ctx    context.Context
+	closed chan struct{}
+	quit   chan struct{}
+
+	mut     sync.Mutex
+	lastRun map[string]Policy
+}
+
+func (m *Manager) ruleFor(logName string, severity int) (string, time.Duration) {
+	for _, rule := range m.rules {
+		if matched, _ := path.Match(rule.AppName, logName); !matched {
+			continue
+		}
+		if len(rule.Severities) > 0 && !containsInt(rule.Severities, severity) {
+			continue
+		}
+		// Validated when loading the config.
+		period, _ := config.ParseRetentionPeriod(rule.Period)
+		return rule.AppName, period
+	}
+	return DefaultRuleName, m.defaultPeriod
+}
+
+// EffectivePolicy returns the retention policy for a log, relative
+// to now.
+func (m *Manager) EffectivePolicy(logName string, now time.Time) Policy {
+	policy := Policy{
+		LogName: logName,
+		DryRun:  m.dryRun,
+		Rules:   []EffectiveRule{},
+	}
+	// Messages with an unknown severity are only matched by rules
+	// that do not filter by severity, or by the default rule.
+	for severity := int(logging.UnknownSeverity); severity <= int(logging.Debug); severity++ {
+		name, period := m.ruleFor(logName, severity)
+		idx := -1
+		for i, rule := range policy.Rules {
+			if rule.Rule == name && rule.period == period {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			policy.Rules = append(policy.Rules, EffectiveRule{
+				Rule:           name,
+				Severities:     []int{},
+				RetentionHours: int64(period / time.Hour),
+				DeleteBefore:   now.Add(-period),
+				period:         period,
+			})
+			idx = len(policy.Rules) - 1
+		}
+		if severity == int(logging.UnknownSeverity) {
+			policy.Rules[idx].CatchAll = true
+			continue
+		}
+		policy.Rules[idx].Severities = append(policy.Rules[idx].Severities, severity)
+	}
+	return policy
+}
+
+// ruleFilter returns the filter selecting the messages a rule applies
+// to, or nil if it applies to all messages.
+func ruleFilter(rule EffectiveRule) params.Expression {
+	if rule.CatchAll && len(rule.Severities) > int(logging.Debug) {
+		return nil
+	}
+	filter := params.Or{}
+	for _, severity := range rule.Severities {
+		filter = append(filter, params.Eq(params.FieldSeverity, severity))
+	}
+	if rule.CatchAll {
+		known := params.Or{}
+		for severity := int(logging.Emergency); severity <= int(logging.Debug); severity++ {
+			known = append(known, params.Eq(params.FieldSeverity, severity))
+		}
+		filter = append(filter, params.Not{Expression: known})
+	}
+	return filter
+}
+
+// Policies returns the effective retention policy of every log in
+// the datastore. If a dry run was performed, the number of expired
+// messages found during the last run is included.
+func (m *Manager) Policies() ([]Policy, error) {
+	logs, err := m.store.List(params.ListParams{NamesOnly: true})
+	if err != nil {
+		return nil, errors.Wrap(err, "listing logs")
+	}
+	now := time.Now()
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	ret := []Policy{}
+	for _, val := range logs {
+		logName := val.Name
+		if last, ok := m.lastRun[logName]; ok && m.dryRun {
+			ret = append(ret, last)
+			continue
+		}
+		ret = append(ret, m.EffectivePolicy(logName, now))
+	}
+	return ret, nil
+}
+
+func (m *Manager) applyPolicy(policy Policy) error {
+	for idx, rule := range policy.Rules {
+		p := params.QueryParams{
+			AppName: policy.LogName,
+			EndDate: rule.DeleteBefore,
+			Filter:  ruleFilter(rule),
+		}
+		var severities []int
+		if p.Filter != nil {
+			severities = rule.Severities
+		}
+
+		if m.dryRun {
+			count, err := m.store.Count(p)
+			if err != nil {
+				return errors.Wrapf(err, "counting logs in %q", policy.LogName)
+			}
+			policy.Rules[idx].Expired = &count
+			if count > 0 {
+				log.Infof(
+					"dry run: would delete %d messages with severities %v from %q older than %s (rule %q)",
+					count, rule.Severities, policy.LogName, rule.DeleteBefore.Format(time.RFC3339), rule.Rule)
+			}
+			continue
+		}
+
+		if m.archiver != nil {
+			manifest, err := m.archiver.Archive(p, severities)
+			if err != nil {
+				return errors.Wrapf(err, "archiving logs from %q", policy.LogName)
+			}
+			if manifest == nil {
+				// Nothing was archived, so nothing may be deleted.
+				continue
+			}
+			// Messages written since the archive was taken may have
+			// older timestamps than the delete cutoff. Only delete up
+			// to the newest archived message.
+			p.EndDate = manifest.EndDate
+		}
+
+		log.Infof(
+			"deleting messages with severities %v from %q older than %s (rule %q)",
+			rule.Severities, policy.LogName, rule.DeleteBefore.Format(time.RFC3339), rule.Rule)
+		if err := m.store.Delete(p); err != nil {
+			return errors.Wrapf(err, "deleting logs from %q", policy.LogName)
+		}
+	}
+	return nil
+}
+
+// Apply enforces the retention policy and quotas on all logs.
+func (m *Manager) Apply() error {
+	logs, err := m.store.List(params.ListParams{NamesOnly: true})
+	if err != nil {
+		return errors.Wrap(err, "listing logs")
+	}
+	now := time.Now()
+	lastRun := map[string]Policy{}
+	for _, val := range logs {
+		policy := m.EffectivePolicy(val.Name, now)
+		if err := m.applyPolicy(policy); err != nil {
+			return err
+		}
+		lastRun[policy.LogName] = policy
+	}
+	m.mut.Lock()
+	m.lastRun = lastRun
+	m.mut.Unlock()
+
+	if m.quota == nil {
+		return nil
+	}
+	// Usage has changed after applying the retention policy.
+	logs, err = m.store.List(params.ListParams{})
+	if err != nil {
+		return errors.Wrap(err, "listing logs")
+	}
+	if err := m.enforceQuota(logs); err != nil {
+		return errors.Wrap(err, "enforcing quota")
+	}
+	return nil
+}
+
+func (m *Manager) doWork() {
+	ticker := time.NewTicker(applyInterval)
+	defer func() {
+		ticker.Stop()
+		close(m.closed)
+	}()
+	if err := m.Apply(); err != nil {
+		log.Errorf("failed to apply retention policy: %v", err)
+	}
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Apply(); err != nil {
+				log.Errorf("failed to apply retention policy: %v", err)
+			}
+		case <-m.quit:
+			return
+		}
+	}
+}
+
+func (m *Manager) Start() error {
+	go m.doWork()
+	return nil
+}
+
+func (m *Manager) Stop() error {
+	close(m.quit)
+	m.Wait()
+	return nil
+}
+
+func (m *Manager) Wait() {
+	<-m.closed
+}
+
+func containsInt(values []int, val int) bool {
+	for _, v := range values {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
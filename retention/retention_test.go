@@ -0,0 +1,138 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package retention
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"coriolis-logger/archive"
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+func TestEffectivePolicyCatchAll(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []config.RetentionRule
+		catchAll string
+		matches  map[logging.Severity]string
+	}{
+		{
+			name:     "no rules",
+			catchAll: DefaultRuleName,
+			matches: map[logging.Severity]string{
+				logging.Emergency:   DefaultRuleName,
+				logging.Debug:       DefaultRuleName,
+				logging.Severity(9): DefaultRuleName,
+			},
+		},
+		{
+			name: "split by severity",
+			rules: []config.RetentionRule{
+				{AppName: "app", Severities: []int{6, 7}, Period: "1d"},
+			},
+			catchAll: DefaultRuleName,
+			matches: map[logging.Severity]string{
+				logging.Error:        DefaultRuleName,
+				logging.Debug:        "app",
+				logging.Severity(9):  DefaultRuleName,
+				logging.Severity(-1): DefaultRuleName,
+			},
+		},
+		{
+			name: "rule without severities",
+			rules: []config.RetentionRule{
+				{AppName: "app", Severities: []int{7}, Period: "1d"},
+				{AppName: "a*", Period: "2d"},
+			},
+			catchAll: "a*",
+			matches: map[logging.Severity]string{
+				logging.Error:       "a*",
+				logging.Debug:       "app",
+				logging.Severity(9): "a*",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Syslog{Retention: &config.Retention{Rules: tt.rules}}
+			mgr := NewManager(context.Background(), cfg, nil, nil)
+			policy := mgr.EffectivePolicy("app", time.Now())
+
+			catchAll := 0
+			for _, rule := range policy.Rules {
+				if rule.CatchAll {
+					catchAll++
+					if rule.Rule != tt.catchAll {
+						t.Errorf("catch-all rule is %q, want %q", rule.Rule, tt.catchAll)
+					}
+				}
+			}
+			if catchAll != 1 {
+				t.Fatalf("got %d catch-all rules, want 1", catchAll)
+			}
+
+			for severity, want := range tt.matches {
+				msg := logging.LogMessage{Severity: severity}
+				var got []string
+				for _, rule := range policy.Rules {
+					filter := ruleFilter(rule)
+					if filter == nil || filter.Match(msg) {
+						got = append(got, rule.Rule)
+					}
+				}
+				if len(got) != 1 || got[0] != want {
+					t.Errorf("severity %d matched rules %v, want [%s]", severity, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyPolicyKeepsLateMessages(t *testing.T) {
+	base := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	old := logging.LogMessage{AppName: "app", Timestamp: base}
+	// Written after the archive was taken, with a timestamp past the
+	// archived messages but before the delete cutoff.
+	late := logging.LogMessage{AppName: "app", Timestamp: base.Add(time.Minute)}
+	recent := logging.LogMessage{AppName: "app", Timestamp: base.Add(time.Hour)}
+	store := &memStore{
+		messages: []logging.LogMessage{old, recent},
+		late:     []logging.LogMessage{late},
+	}
+	archiver, err := archive.NewArchiver(&config.Archive{
+		Backend: config.LocalArchiveBackend,
+		Path:    t.TempDir(),
+	}, store)
+	if err != nil {
+		t.Fatalf("creating archiver: %v", err)
+	}
+	mgr := &Manager{store: store, archiver: archiver}
+
+	policy := Policy{
+		LogName: "app",
+		Rules: []EffectiveRule{
+			{Rule: "app", Severities: []int{0, 1, 2, 3, 4, 5, 6, 7}, CatchAll: true, DeleteBefore: base.Add(30 * time.Minute)},
+		},
+	}
+	if err := mgr.applyPolicy(policy); err != nil {
+		t.Fatalf("applying policy: %v", err)
+	}
+	if len(store.messages) != 2 || !store.messages[0].Timestamp.Equal(recent.Timestamp) || !store.messages[1].Timestamp.Equal(late.Timestamp) {
+		t.Errorf("got messages %+v, want the recent and late ones", store.messages)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"bytes"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+// pidFormat wraps a syslog format, to keep the PID that RFC 3164
+// senders put in the tag, as in "app[123]:". The parser drops it, and
+// without it the messages of all processes of an app look alike.
+type pidFormat struct {
+	format.Format
+}
+
+func (f pidFormat) GetParser(line []byte) format.LogParser {
+	return &pidParser{LogParser: f.Format.GetParser(line), line: line}
+}
+
+type pidParser struct {
+	format.LogParser
+	line []byte
+}
+
+// Dump returns the parsed message. RFC 3164 messages with a PID in
+// their tag get it as proc_id, like RFC 5424 messages.
+func (p *pidParser) Dump() format.LogParts {
+	parts := p.LogParser.Dump()
+	tag, ok := parts["tag"].(string)
+	if !ok || tag == "" {
+		return parts
+	}
+	header := p.line
+	if content, _ := parts["content"].(string); content != "" {
+		if idx := bytes.LastIndex(header, []byte(content)); idx >= 0 {
+			header = header[:idx]
+		}
+	}
+	if pid := tagPID(header, tag); pid != "" {
+		parts["proc_id"] = pid
+	}
+	return parts
+}
+
+// tagPID returns the PID between brackets that follows tag in the
+// header of an RFC 3164 message, or an empty string if there is none.
+func tagPID(header []byte, tag string) string {
+	idx := bytes.Index(header, []byte(tag+"["))
+	if idx < 0 {
+		return ""
+	}
+	rest := header[idx+len(tag)+1:]
+	end := bytes.IndexByte(rest, ']')
+	if end <= 0 {
+		return ""
+	}
+	for _, chr := range rest[:end] {
+		if chr < '0' || chr > '9' {
+			return ""
+		}
+	}
+	return string(rest[:end])
+}
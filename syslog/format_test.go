@@ -0,0 +1,100 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package syslog
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+	"coriolis-logger/pipeline"
+)
+
+func parseLine(t *testing.T, f format.Format, line string) format.LogParts {
+	t.Helper()
+	parser := pidFormat{f}.GetParser([]byte(line))
+	if err := parser.Parse(); err != nil {
+		t.Fatalf("parsing %q: %v", line, err)
+	}
+	return parser.Dump()
+}
+
+func TestPIDFormat(t *testing.T) {
+	tests := []struct {
+		name   string
+		format format.Format
+		line   string
+		want   interface{}
+	}{
+		{"rfc3164", &format.RFC3164{}, "<30>Oct 11 22:14:15 host app[123]: hello", "123"},
+		{"automatic", &format.Automatic{}, "<30>Oct 11 22:14:15 host app[123]: hello", "123"},
+		{"no pid", &format.RFC3164{}, "<30>Oct 11 22:14:15 host app: hello", nil},
+		{"pid in the content", &format.RFC3164{}, "<30>Oct 11 22:14:15 host app: see app[9]", nil},
+		{"not a pid", &format.RFC3164{}, "<30>Oct 11 22:14:15 host app[main]: hello", nil},
+		{"rfc5424", &format.Automatic{}, "<30>1 2019-10-11T22:14:15Z host app 42 - - hello", "42"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts := parseLine(t, tt.format, tt.line)
+			if got := parts["proc_id"]; got != tt.want {
+				t.Errorf("got proc_id %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPIDFormatMultiline checks that the tracebacks of two processes
+// of an RFC 3164 sender are joined separately, even when their lines
+// are interleaved.
+func TestPIDFormatMultiline(t *testing.T) {
+	multiline, err := pipeline.NewMultiline(config.Multiline{
+		Rules: []config.MultilineRule{{AppName: "app", Start: `^Traceback`}},
+	})
+	if err != nil {
+		t.Fatalf("creating multiline stage: %v", err)
+	}
+	lines := []string{
+		"<30>Oct 11 22:14:15 host app[1]: Traceback 1",
+		"<30>Oct 11 22:14:15 host app[2]: Traceback 2",
+		"<30>Oct 11 22:14:15 host app[1]:   line 1",
+		"<30>Oct 11 22:14:15 host app[2]:   line 2",
+	}
+	got := []string{}
+	emit := func(msg logging.LogMessage) error {
+		got = append(got, msg.Message)
+		return nil
+	}
+	for _, line := range lines {
+		msg, err := logging.SyslogToLogMessage(parseLine(t, &format.RFC3164{}, line))
+		if err != nil {
+			t.Fatalf("converting %q: %v", line, err)
+		}
+		if err := multiline.Handle(msg, emit); err != nil {
+			t.Fatalf("handling %q: %v", line, err)
+		}
+	}
+	multiline.Flush(time.Now(), true, emit)
+	want := []string{"Traceback 1\nline 1", "Traceback 2\nline 2"}
+	if len(got) == 2 && got[0] > got[1] {
+		got[0], got[1] = got[1], got[0]
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got messages %q, want %q", got, want)
+	}
+}
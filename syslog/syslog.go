@@ -18,6 +18,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"time"
 
 	syslog "gopkg.in/mcuadros/go-syslog.v2"
 
@@ -47,9 +48,14 @@ func NewSyslogServer(ctx context.Context, cfg config.Syslog, writer logging.Writ
 	if err != nil {
 		return nil, errors.Wrap(err, "getting log format")
 	}
-	server.SetFormat(logFormat)
+	server.SetFormat(pidFormat{logFormat})
 	server.SetHandler(handler)
 
+	timestamps, err := cfg.Timestamps.Policy()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting timestamp policy")
+	}
+
 	worker := &SyslogWorker{
 		server:  server,
 		logging: writer,
@@ -58,6 +64,8 @@ func NewSyslogServer(ctx context.Context, cfg config.Syslog, writer logging.Writ
 		ctx:     ctx,
 		errChan: errChan,
 		closed:  make(chan struct{}),
+
+		timestamps: timestamps,
 	}
 
 	return worker, nil
@@ -73,6 +81,8 @@ type SyslogWorker struct {
 	ctx     context.Context
 	errChan chan error
 	closed  chan struct{}
+
+	timestamps *logging.TimestampPolicy
 }
 
 func (s *SyslogWorker) doWork() {
@@ -83,7 +93,7 @@ func (s *SyslogWorker) doWork() {
 				// channel was closed, exiting
 				return
 			}
-			logMsg, err := logging.SyslogToLogMessage(logParts)
+			logMsg, err := s.timestamps.ReceivedSyslogMessage(logParts, s.cfg.GetListenerName(), time.Now())
 			if err != nil {
 				log.Errorf("failed to parse log message: %q", err)
 				continue
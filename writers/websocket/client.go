@@ -15,6 +15,7 @@
 package websocket
 
 import (
+	"fmt"
 	"sync"
 	"time"
 
@@ -24,6 +25,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/juju/loggo"
+	"github.com/pkg/errors"
 )
 
 var log = loggo.GetLogger("coriolis.apiserver.client")
@@ -39,34 +41,100 @@ const (
 	pingPeriod = (pongWait * 9) / 10
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 1024
+	maxMessageSize = 16384
 )
 
-type ClientFilterOptions struct {
-	Severity *logging.Severity `json:"omitempty"`
-	AppName  *string
+// NewClient returns a new websocket client. If filter is not nil, the client
+// starts with a subscription using it. The protocol spoken by the client is
+// the subprotocol negotiated on conn.
+func NewClient(conn *websocket.Conn, filter *Filter, hub *Hub) (*Client, error) {
+	client := newClient(hub)
+	client.conn = conn
+	client.versioned = conn.Subprotocol() == ProtocolV1
+	if filter != nil {
+		client.subscriptions[DefaultSubscription] = &subscription{filter: filter}
+		client.order = []string{DefaultSubscription}
+	}
+	return client, nil
+}
+
+// NewStreamClient returns a client that is not backed by a websocket
+// connection, for other streaming transports. Once registered with the
+// hub, messages matching filter are queued for the client, until it
+// is unregistered. Callers wait on Ready and fetch messages with
+// Receive, until Done is closed.
+func NewStreamClient(filter *Filter, hub *Hub) *Client {
+	client := newClient(hub)
+	client.subscriptions[DefaultSubscription] = &subscription{filter: filter}
+	client.order = []string{DefaultSubscription}
+	return client
 }
 
-func NewClient(conn *websocket.Conn, opts ClientFilterOptions, hub *Hub) (*Client, error) {
+func newClient(hub *Hub) *Client {
 	clientID := uuid.New()
 	return &Client{
-		id:      clientID.String(),
-		options: opts,
-		conn:    conn,
-		hub:     hub,
-		send:    make(chan LogMessage, 1024),
-	}, nil
+		id:            clientID.String(),
+		hub:           hub,
+		queue:         newMessageQueue(hub.cfg.GetQueueSize(), hub.cfg.GetOverflowPolicy()),
+		batchSize:     hub.cfg.GetBatchSize(),
+		done:          make(chan struct{}),
+		registered:    make(chan struct{}),
+		subscriptions: map[string]*subscription{},
+	}
 }
 
+type subscription struct {
+	filter *Filter
+	paused bool
+}
+
+// Client is a consumer of the live log feed. The hub goroutine is the
+// only one that queues messages for a client and closes it. The client
+// consumes its queue from a single goroutine.
 type Client struct {
-	id      string
-	options ClientFilterOptions
-	conn    *websocket.Conn
-	// Buffered channel of outbound messages.
-	send chan LogMessage
+	id   string
+	conn *websocket.Conn
+	// queue holds outbound messages.
+	queue     *messageQueue
+	batchSize int
+	// done is closed by the hub when the client is unregistered.
+	done chan struct{}
+	// registered is closed by the hub once it queues messages for
+	// the client.
+	registered chan struct{}
 
 	hub     *Hub
 	sendMux sync.Mutex
+
+	// versioned is true if the client negotiated ProtocolV1.
+	versioned bool
+
+	mut           sync.RWMutex
+	subscriptions map[string]*subscription
+	// order holds subscription IDs in creation order.
+	order     []string
+	nextSubID int
+	sent      int64
+	paused    int64
+}
+
+// Ready is signaled when messages are queued for the client
+func (c *Client) Ready() <-chan struct{} {
+	return c.queue.ready
+}
+
+// Done is closed once the client is unregistered from the hub
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Receive returns up to the configured batch size of queued messages,
+// and the number of messages dropped since the last call that the
+// consumer should be notified about.
+func (c *Client) Receive() ([]LogMessage, int64) {
+	batch, dropped := c.queue.pop(c.batchSize)
+	c.countSent(int64(len(batch)))
+	return batch, dropped
 }
 
 func (c *Client) Go() {
@@ -74,29 +142,137 @@ func (c *Client) Go() {
 	go c.clientWriter()
 }
 
-// clientReader waits for options changes from the client. The client can at any time
-// change the log level and binary name it watches.
+// clientReader waits for requests from the client. Legacy clients can at any
+// time replace the filters they watch with a new set of ClientFilterOptions.
+// Invalid filters are ignored, and the previous filters are kept. Legacy
+// clients only expect log messages, so they get no reply. Versioned clients
+// get a reply envelope for each request.
 func (c *Client) clientReader() {
 	defer func() {
-		c.hub.unregister <- c
+		c.hub.Unregister(c)
 		c.conn.Close()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		opts := ClientFilterOptions{}
-		if err := c.conn.ReadJSON(&opts); err != nil {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Errorf("error: %v", err)
 			}
 			break
 		}
-		c.options = opts
+		if !c.versioned {
+			if err := c.updateFilter(data); err != nil {
+				log.Warningf("client %s sent invalid filters: %v", c.id, err)
+			}
+			continue
+		}
+		if err := c.WriteJSON(c.handleRequest(data)); err != nil {
+			log.Errorf("error sending message: %v", err)
+			break
+		}
 	}
 }
 
-// clientWriter
+// updateFilter replaces the filter of a legacy client with the
+// options in data.
+func (c *Client) updateFilter(data []byte) error {
+	opts, err := decodeLegacyFilter(data)
+	if err != nil {
+		return errors.Wrap(err, "decoding filter options")
+	}
+	if _, err := c.subscribe(DefaultSubscription, opts); err != nil {
+		return err
+	}
+	return nil
+}
+
+// subscribe adds a subscription, or replaces the filter of an existing
+// one. If id is empty, a new ID is generated. It returns the ID of the
+// subscription.
+func (c *Client) subscribe(id string, opts ClientFilterOptions) (string, error) {
+	filter, err := NewFilter(opts)
+	if err != nil {
+		return "", err
+	}
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if sub, ok := c.subscriptions[id]; ok {
+		sub.filter = filter
+		return id, nil
+	}
+	if len(c.subscriptions) >= maxSubscriptions {
+		return "", fmt.Errorf("too many subscriptions")
+	}
+	for id == "" || c.subscriptions[id] != nil {
+		c.nextSubID++
+		id = fmt.Sprintf("sub-%d", c.nextSubID)
+	}
+	c.subscriptions[id] = &subscription{filter: filter}
+	c.order = append(c.order, id)
+	return id, nil
+}
+
+func (c *Client) unsubscribe(id string) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if _, ok := c.subscriptions[id]; !ok {
+		return fmt.Errorf("unknown subscription %q", id)
+	}
+	delete(c.subscriptions, id)
+	for idx, val := range c.order {
+		if val == id {
+			c.order = append(c.order[:idx], c.order[idx+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// setPaused pauses or resumes a subscription, or all subscriptions if
+// id is empty.
+func (c *Client) setPaused(id string, paused bool) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if id == "" {
+		for _, sub := range c.subscriptions {
+			sub.paused = paused
+		}
+		return nil
+	}
+	sub, ok := c.subscriptions[id]
+	if !ok {
+		return fmt.Errorf("unknown subscription %q", id)
+	}
+	sub.paused = paused
+	return nil
+}
+
+// Stats returns the counters and subscriptions of the client
+func (c *Client) Stats() ClientStats {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+	stats := ClientStats{
+		Sent:          c.sent,
+		Paused:        c.paused,
+		Dropped:       c.queue.Dropped(),
+		Subscriptions: []SubscriptionStats{},
+	}
+	for _, id := range c.order {
+		sub := c.subscriptions[id]
+		stats.Subscriptions = append(stats.Subscriptions, SubscriptionStats{
+			ID:     id,
+			Paused: sub.paused,
+			Filter: sub.filter.Options(),
+		})
+	}
+	return stats
+}
+
+// clientWriter sends queued messages to the client, until the hub
+// unregisters it.
 func (c *Client) clientWriter() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
@@ -105,14 +281,21 @@ func (c *Client) clientWriter() {
 	}()
 	for {
 		select {
-		case message, ok := <-c.send:
-			if !ok {
-				// The hub closed the channel.
-				c.WriteMessage(websocket.CloseMessage, []byte{})
-				return
+		case <-c.done:
+			c.WriteMessage(websocket.CloseMessage, []byte{})
+			return
+		case <-c.queue.ready:
+			batch, dropped := c.Receive()
+			if dropped > 0 && c.versioned {
+				if err := c.writeDropped(dropped); err != nil {
+					log.Errorf("error sending message: %v", err)
+					return
+				}
 			}
-
-			if err := c.WriteJSON(message); err != nil {
+			if len(batch) == 0 {
+				continue
+			}
+			if err := c.writeLogs(batch); err != nil {
 				log.Errorf("error sending message: %v", err)
 				return
 			}
@@ -124,6 +307,53 @@ func (c *Client) clientWriter() {
 	}
 }
 
+// writeDropped tells a versioned client that messages were dropped
+// because it was too slow. Legacy clients only expect log messages,
+// so they are not told.
+func (c *Client) writeDropped(dropped int64) error {
+	return c.WriteJSON(Envelope{
+		Version: ProtocolVersion,
+		Type:    TypeDropped,
+		Dropped: dropped,
+	})
+}
+
+// writeLogs sends log messages to the client. Versioned clients get
+// them in a single batch envelope.
+func (c *Client) writeLogs(batch []LogMessage) error {
+	if !c.versioned {
+		for _, message := range batch {
+			if err := c.WriteJSON(message); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	envelope := Envelope{
+		Version: ProtocolVersion,
+		Type:    TypeLog,
+	}
+	if len(batch) == 1 {
+		envelope.Log = &batch[0]
+	} else {
+		envelope.Type = TypeBatch
+		envelope.Logs = batch
+	}
+	return c.WriteJSON(envelope)
+}
+
+func (c *Client) countSent(count int64) {
+	c.mut.Lock()
+	c.sent += count
+	c.mut.Unlock()
+}
+
+// close is called by the hub when the client is unregistered.
+func (c *Client) close() {
+	close(c.done)
+}
+
 // WriteJSON wraps the websocket connection WriteJSON method with a mutex to
 // prevent multiple messages being sent over the same connection at the same time,
 // because this will cause a panic in the websocket package.
@@ -144,32 +374,47 @@ func (c *Client) WriteMessage(messageType int, data []byte) error {
 	return c.conn.WriteMessage(messageType, data)
 }
 
-func (c *Client) ShouldSend(msg logging.LogMessage) bool {
-	severity := logging.DefaultSeverityLevel
-	var binName string
-	if c.options.Severity != nil {
-		severity = *c.options.Severity
+// match returns the IDs of the active subscriptions that match msg. It
+// returns false if no subscription matches, or if all matching
+// subscriptions are paused.
+func (c *Client) match(msg logging.LogMessage) ([]string, bool) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	var matched []string
+	paused := false
+	for _, id := range c.order {
+		sub := c.subscriptions[id]
+		if !sub.filter.Match(msg) {
+			continue
+		}
+		if sub.paused {
+			paused = true
+			continue
+		}
+		matched = append(matched, id)
 	}
-
-	if c.options.AppName != nil {
-		binName = *c.options.AppName
+	if len(matched) == 0 {
+		if paused {
+			c.paused++
+		}
+		return nil, false
 	}
+	return matched, true
+}
 
-	if binName != "" && binName != msg.AppName {
-		return false
-	}
-	if msg.Severity > severity {
-		return false
-	}
-	return true
+func (c *Client) ShouldSend(msg logging.LogMessage) bool {
+	_, ok := c.match(msg)
+	return ok
 }
 
 func (c *Client) SyslogMessageToLogMessage(msg logging.LogMessage) LogMessage {
 	return LogMessage{
-		Severity:  int(msg.Severity),
-		AppName:   msg.AppName,
-		Hostname:  msg.Hostname,
-		Timestamp: msg.Timestamp,
-		Message:   msg.Message,
+		Severity:   int(msg.Severity),
+		AppName:    msg.AppName,
+		Hostname:   msg.Hostname,
+		Timestamp:  msg.Timestamp,
+		Message:    msg.Message,
+		Fields:     msg.Fields,
+		ReceivedAt: msg.ReceivedAt,
 	}
 }
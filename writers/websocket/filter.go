@@ -0,0 +1,306 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"coriolis-logger/logging"
+	"coriolis-logger/params"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxFacility is the highest syslog facility code
+	maxFacility = int(logging.LocalUse7)
+	// maxPatternLength is the maximum length of the include and
+	// exclude regular expressions.
+	maxPatternLength = 1024
+)
+
+// ClientFilterOptions are the filters a websocket client subscribes
+// with. Empty fields match all messages.
+type ClientFilterOptions struct {
+	// Severity is the highest (least severe) severity level to send.
+	// Defaults to logging.DefaultSeverityLevel.
+	Severity *logging.Severity `json:"severity,omitempty"`
+	// MinSeverity is the lowest (most severe) severity level to send.
+	MinSeverity *logging.Severity `json:"min_severity,omitempty"`
+	// AppName is a single app name or glob. It is kept for older
+	// clients, and is merged with AppNames.
+	AppName *string `json:"app_name,omitempty"`
+	// AppNames holds app names or globs.
+	AppNames []string `json:"app_names,omitempty"`
+	// Hostnames holds hostnames or globs.
+	Hostnames []string `json:"hostnames,omitempty"`
+	// Facilities holds the facility codes to send.
+	Facilities []int `json:"facilities,omitempty"`
+	// Include is a regular expression messages must match.
+	Include string `json:"include,omitempty"`
+	// Exclude is a regular expression messages must not match.
+	Exclude string `json:"exclude,omitempty"`
+	// Fields holds values that structured message fields must equal,
+	// by key.
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// legacyFilterOptions holds the keys sent by clients written against
+// older releases, before the filter options had their current names.
+type legacyFilterOptions struct {
+	Severity *logging.Severity `json:"omitempty"`
+	AppName  *string           `json:"AppName"`
+}
+
+// decodeLegacyFilter decodes the filter options sent by a client of
+// the legacy protocol. The keys used by older releases are accepted,
+// unless the current ones are also set.
+func decodeLegacyFilter(data []byte) (ClientFilterOptions, error) {
+	opts := ClientFilterOptions{}
+	if err := json.Unmarshal(data, &opts); err != nil {
+		return opts, err
+	}
+	legacy := legacyFilterOptions{}
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return opts, err
+	}
+	if opts.Severity == nil {
+		opts.Severity = legacy.Severity
+	}
+	if opts.AppName == nil {
+		opts.AppName = legacy.AppName
+	}
+	return opts, nil
+}
+
+// Filter is a validated and compiled set of client filter options
+type Filter struct {
+	options     ClientFilterOptions
+	minSeverity logging.Severity
+	maxSeverity logging.Severity
+	apps        []string
+	hostnames   []string
+	facilities  map[logging.Facility]bool
+	include     *regexp.Regexp
+	exclude     *regexp.Regexp
+}
+
+func validateGlobs(globs []string) error {
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", glob)
+		}
+	}
+	return nil
+}
+
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	if len(pattern) > maxPatternLength {
+		return nil, fmt.Errorf("pattern exceeds %d characters", maxPatternLength)
+	}
+	return regexp.Compile(pattern)
+}
+
+func validSeverity(severity logging.Severity) bool {
+	return severity >= logging.Emergency && severity <= logging.Debug
+}
+
+// NewFilter validates and compiles the supplied filter options
+func NewFilter(opts ClientFilterOptions) (*Filter, error) {
+	f := &Filter{
+		options:     opts,
+		minSeverity: logging.Emergency,
+		maxSeverity: logging.DefaultSeverityLevel,
+		apps:        opts.AppNames,
+		hostnames:   opts.Hostnames,
+	}
+	if opts.AppName != nil && *opts.AppName != "" {
+		f.apps = append([]string{*opts.AppName}, f.apps...)
+	}
+	if err := validateGlobs(f.apps); err != nil {
+		return nil, errors.Wrap(err, "validating app names")
+	}
+	if err := validateGlobs(f.hostnames); err != nil {
+		return nil, errors.Wrap(err, "validating hostnames")
+	}
+
+	if opts.Severity != nil {
+		if !validSeverity(*opts.Severity) {
+			return nil, fmt.Errorf("invalid severity %d", *opts.Severity)
+		}
+		f.maxSeverity = *opts.Severity
+	}
+	if opts.MinSeverity != nil {
+		if !validSeverity(*opts.MinSeverity) {
+			return nil, fmt.Errorf("invalid min_severity %d", *opts.MinSeverity)
+		}
+		f.minSeverity = *opts.MinSeverity
+	}
+	if f.minSeverity > f.maxSeverity {
+		return nil, fmt.Errorf("min_severity is higher than severity")
+	}
+
+	if len(opts.Facilities) > 0 {
+		f.facilities = map[logging.Facility]bool{}
+		for _, facility := range opts.Facilities {
+			if facility < 0 || facility > maxFacility {
+				return nil, fmt.Errorf("invalid facility %d", facility)
+			}
+			f.facilities[logging.Facility(facility)] = true
+		}
+	}
+
+	var err error
+	if f.include, err = compilePattern(opts.Include); err != nil {
+		return nil, errors.Wrap(err, "compiling include pattern")
+	}
+	if f.exclude, err = compilePattern(opts.Exclude); err != nil {
+		return nil, errors.Wrap(err, "compiling exclude pattern")
+	}
+	return f, nil
+}
+
+// Options returns the options the filter was created from
+func (f *Filter) Options() ClientFilterOptions {
+	return f.options
+}
+
+func matchAny(globs []string, val string) bool {
+	if len(globs) == 0 {
+		return true
+	}
+	for _, glob := range globs {
+		if matched, _ := path.Match(glob, val); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchApp returns true if messages from the named app may pass the
+// filter.
+func (f *Filter) MatchApp(appName string) bool {
+	return matchAny(f.apps, appName)
+}
+
+// Match returns true if msg passes the filter
+func (f *Filter) Match(msg logging.LogMessage) bool {
+	if msg.Severity < f.minSeverity || msg.Severity > f.maxSeverity {
+		return false
+	}
+	if f.facilities != nil && !f.facilities[msg.Facility] {
+		return false
+	}
+	if !matchAny(f.apps, msg.AppName) || !matchAny(f.hostnames, msg.Hostname) {
+		return false
+	}
+	if f.include != nil && !f.include.MatchString(msg.Message) {
+		return false
+	}
+	if f.exclude != nil && f.exclude.MatchString(msg.Message) {
+		return false
+	}
+	for key, val := range f.options.Fields {
+		if logging.FieldString(msg.Fields[key]) != val {
+			return false
+		}
+	}
+	return true
+}
+
+// globToRegexp converts a glob in path.Match syntax to an anchored
+// regular expression. The glob must be valid.
+func globToRegexp(glob string) string {
+	var buf strings.Builder
+	buf.WriteString("^")
+	inClass := false
+	for idx := 0; idx < len(glob); idx++ {
+		chr := glob[idx]
+		switch {
+		case chr == '\\' && idx+1 < len(glob):
+			idx++
+			buf.WriteString(regexp.QuoteMeta(glob[idx : idx+1]))
+		case inClass && chr == ']':
+			inClass = false
+			buf.WriteByte(chr)
+		case inClass && chr == '-':
+			buf.WriteByte(chr)
+		case inClass:
+			buf.WriteString(regexp.QuoteMeta(glob[idx : idx+1]))
+		case chr == '[':
+			inClass = true
+			buf.WriteByte(chr)
+			if idx+1 < len(glob) && glob[idx+1] == '^' {
+				idx++
+				buf.WriteByte('^')
+			}
+		case chr == '*':
+			buf.WriteString("[^/]*")
+		case chr == '?':
+			buf.WriteString("[^/]")
+		default:
+			buf.WriteString(regexp.QuoteMeta(glob[idx : idx+1]))
+		}
+	}
+	buf.WriteString("$")
+	return buf.String()
+}
+
+// Expression returns the filter as a datastore query expression. App
+// names are not part of it, as the datastore is queried per app, see
+// MatchApp.
+func (f *Filter) Expression() params.Expression {
+	expr := params.And{
+		params.Condition{Field: params.FieldSeverity, Operator: params.OpGreaterOrEqual, Value: f.minSeverity},
+		params.Condition{Field: params.FieldSeverity, Operator: params.OpLessOrEqual, Value: f.maxSeverity},
+	}
+	if f.facilities != nil {
+		facilities := params.Or{}
+		for _, facility := range f.options.Facilities {
+			facilities = append(facilities, params.Eq(params.FieldFacility, facility))
+		}
+		expr = append(expr, facilities)
+	}
+	if len(f.hostnames) > 0 {
+		hostnames := params.Or{}
+		for _, glob := range f.hostnames {
+			hostnames = append(hostnames, params.Matches(params.FieldHostname, regexp.MustCompile(globToRegexp(glob))))
+		}
+		expr = append(expr, hostnames)
+	}
+	if f.include != nil {
+		expr = append(expr, params.Matches(params.FieldMessage, f.include))
+	}
+	if f.exclude != nil {
+		expr = append(expr, params.Condition{Field: params.FieldMessage, Operator: params.OpNotMatch, Value: f.exclude})
+	}
+	keys := make([]string, 0, len(f.options.Fields))
+	for key := range f.options.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		expr = append(expr, params.Eq(params.FieldOf(key), f.options.Fields[key]))
+	}
+	return expr
+}
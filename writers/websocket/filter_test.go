@@ -0,0 +1,186 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package websocket
+
+import (
+	"path"
+	"regexp"
+	"testing"
+
+	"coriolis-logger/logging"
+)
+
+func TestDecodeLegacyFilter(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		severity *logging.Severity
+		appName  string
+		wantErr  bool
+	}{
+		{
+			name:     "current keys",
+			data:     `{"severity": 3, "app_name": "coriolis-worker"}`,
+			severity: severityPtr(logging.Error),
+			appName:  "coriolis-worker",
+		},
+		{
+			name:     "legacy keys",
+			data:     `{"omitempty": 3, "AppName": "coriolis-worker"}`,
+			severity: severityPtr(logging.Error),
+			appName:  "coriolis-worker",
+		},
+		{
+			name:     "current keys take precedence",
+			data:     `{"severity": 7, "omitempty": 3, "app_name": "new", "AppName": "old"}`,
+			severity: severityPtr(logging.Debug),
+			appName:  "new",
+		},
+		{
+			name: "no keys",
+			data: `{}`,
+		},
+		{
+			name:    "invalid json",
+			data:    `{"severity": "high"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := decodeLegacyFilter([]byte(tt.data))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decoding filter: %v", err)
+			}
+			switch {
+			case tt.severity == nil && opts.Severity != nil:
+				t.Errorf("got severity %d, want none", *opts.Severity)
+			case tt.severity != nil && (opts.Severity == nil || *opts.Severity != *tt.severity):
+				t.Errorf("got severity %v, want %d", opts.Severity, *tt.severity)
+			}
+			appName := ""
+			if opts.AppName != nil {
+				appName = *opts.AppName
+			}
+			if appName != tt.appName {
+				t.Errorf("got app name %q, want %q", appName, tt.appName)
+			}
+		})
+	}
+}
+
+func severityPtr(val logging.Severity) *logging.Severity {
+	return &val
+}
+
+func TestFilterMatch(t *testing.T) {
+	msg := logging.LogMessage{
+		AppName:  "coriolis-worker",
+		Hostname: "host-1",
+		Severity: logging.Warning,
+		Facility: logging.UserLevelMessages,
+		Message:  "replica failed",
+		Fields:   map[string]interface{}{"task_id": "1234"},
+	}
+	tests := []struct {
+		name    string
+		opts    ClientFilterOptions
+		want    bool
+		wantErr bool
+	}{
+		{"defaults", ClientFilterOptions{}, true, false},
+		{"severity too low", ClientFilterOptions{Severity: severityPtr(logging.Error)}, false, false},
+		{"min severity", ClientFilterOptions{MinSeverity: severityPtr(logging.Notice), Severity: severityPtr(logging.Debug)}, false, false},
+		{"app glob", ClientFilterOptions{AppNames: []string{"coriolis-*"}}, true, false},
+		{"other app", ClientFilterOptions{AppNames: []string{"other"}}, false, false},
+		{"hostname", ClientFilterOptions{Hostnames: []string{"host-2"}}, false, false},
+		{"hostname glob", ClientFilterOptions{Hostnames: []string{"other", "[a-h]ost-?"}}, true, false},
+		{"facility", ClientFilterOptions{Facilities: []int{int(logging.UserLevelMessages)}}, true, false},
+		{"include", ClientFilterOptions{Include: "fail"}, true, false},
+		{"exclude", ClientFilterOptions{Exclude: "^replica"}, false, false},
+		{"field", ClientFilterOptions{Fields: map[string]string{"task_id": "1234"}}, true, false},
+		{"other field value", ClientFilterOptions{Fields: map[string]string{"task_id": "5678"}}, false, false},
+		{"invalid severity", ClientFilterOptions{Severity: severityPtr(9)}, false, true},
+		{"inverted severities", ClientFilterOptions{MinSeverity: severityPtr(logging.Debug), Severity: severityPtr(logging.Error)}, false, true},
+		{"invalid facility", ClientFilterOptions{Facilities: []int{24}}, false, true},
+		{"invalid pattern", ClientFilterOptions{Include: "("}, false, true},
+		{"invalid glob", ClientFilterOptions{AppNames: []string{"["}}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter, err := NewFilter(tt.opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("creating filter: %v", err)
+			}
+			if got := filter.Match(msg); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+			// App names are matched separately when querying.
+			if len(filter.apps) > 0 {
+				return
+			}
+			if got := filter.Expression().Match(msg); got != tt.want {
+				t.Errorf("Expression().Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob string
+		val  string
+	}{
+		{"host", "host"},
+		{"host", "host-1"},
+		{"host-*", "host-1"},
+		{"host-*", "host-1/a"},
+		{"host-?", "host-12"},
+		{"h.st", "host"},
+		{"[a-c]*", "b"},
+		{"[^a-c]*", "b"},
+		{"[\\]a]", "]"},
+		{"\\*", "*"},
+		{"\\*", "a"},
+		{"a+b", "a+b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.glob+" "+tt.val, func(t *testing.T) {
+			want, err := path.Match(tt.glob, tt.val)
+			if err != nil {
+				t.Fatalf("invalid glob: %v", err)
+			}
+			re, err := regexp.Compile(globToRegexp(tt.glob))
+			if err != nil {
+				t.Fatalf("compiling %q: %v", globToRegexp(tt.glob), err)
+			}
+			if got := re.MatchString(tt.val); got != want {
+				t.Errorf("%s matched %q: %v, want %v", re, tt.val, got, want)
+			}
+		})
+	}
+}
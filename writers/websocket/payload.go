@@ -22,4 +22,12 @@ type LogMessage struct {
 	Message   string    `json:"message"`
 	Hostname  string    `json:"hostname"`
 	Timestamp time.Time `json:"timestamp"`
+	// Fields holds the structured data parsed from the message.
+	Fields map[string]interface{} `json:"fields,omitempty"`
+	// Subscriptions holds the IDs of the subscriptions that matched
+	// the message. It is only set for versioned clients.
+	Subscriptions []string `json:"subscriptions,omitempty"`
+	// ReceivedAt is the time the message was received. It is not
+	// sent to clients.
+	ReceivedAt time.Time `json:"-"`
 }
@@ -0,0 +1,147 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package websocket
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// ProtocolV1 is the websocket subprotocol of the versioned
+	// envelope protocol. Clients that do not request it use the
+	// legacy protocol, where they send bare ClientFilterOptions and
+	// receive bare log messages.
+	ProtocolV1 = "coriolis-logger.v1"
+	// ProtocolVersion is the envelope version of ProtocolV1
+	ProtocolVersion = 1
+
+	// DefaultSubscription is the ID of the subscription created from
+	// the query args of a legacy connection.
+	DefaultSubscription = "default"
+
+	// maxSubscriptions is the maximum number of subscriptions a
+	// single connection may hold.
+	maxSubscriptions = 32
+)
+
+// Envelope types. Requests sent by clients are answered with an
+// envelope of the same type and ID, or with an error envelope.
+const (
+	TypeSubscribe   = "subscribe"
+	TypeUnsubscribe = "unsubscribe"
+	TypePause       = "pause"
+	TypeResume      = "resume"
+	TypePing        = "ping"
+	TypeStats       = "stats"
+	TypeError       = "error"
+	// TypeLog and TypeBatch are only sent by the server.
+	TypeLog   = "log"
+	TypeBatch = "batch"
+	// TypeDropped is sent by the server when messages were dropped
+	// because the client could not keep up.
+	TypeDropped = "dropped"
+)
+
+// Envelope is a message of the versioned websocket protocol
+type Envelope struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	// ID is set by clients on requests, and echoed back in replies.
+	ID string `json:"id,omitempty"`
+	// Subscription is the subscription a request applies to. Pause
+	// and resume apply to all subscriptions if it is empty.
+	Subscription string               `json:"subscription,omitempty"`
+	Filter       *ClientFilterOptions `json:"filter,omitempty"`
+	Error        string               `json:"error,omitempty"`
+	Log          *LogMessage          `json:"log,omitempty"`
+	Logs         []LogMessage         `json:"logs,omitempty"`
+	Stats        *ClientStats         `json:"stats,omitempty"`
+	Dropped      int64                `json:"dropped,omitempty"`
+}
+
+// SubscriptionStats describes a subscription of a client
+type SubscriptionStats struct {
+	ID     string              `json:"id"`
+	Paused bool                `json:"paused"`
+	Filter ClientFilterOptions `json:"filter"`
+}
+
+// ClientStats holds the counters of a websocket connection
+type ClientStats struct {
+	// Sent is the number of log messages sent to the client.
+	Sent int64 `json:"sent"`
+	// Paused is the number of log messages that were not sent
+	// because all matching subscriptions were paused.
+	Paused int64 `json:"paused"`
+	// Dropped is the number of log messages that were not sent
+	// because the client could not keep up.
+	Dropped       int64               `json:"dropped"`
+	Subscriptions []SubscriptionStats `json:"subscriptions"`
+}
+
+func errorEnvelope(id string, err error) Envelope {
+	return Envelope{
+		Version: ProtocolVersion,
+		Type:    TypeError,
+		ID:      id,
+		Error:   err.Error(),
+	}
+}
+
+// handleRequest processes a request sent by a client using the
+// versioned protocol, and returns the reply.
+func (c *Client) handleRequest(data []byte) Envelope {
+	var req Envelope
+	if err := json.Unmarshal(data, &req); err != nil {
+		return errorEnvelope("", fmt.Errorf("invalid envelope: %v", err))
+	}
+	if req.Version != 0 && req.Version != ProtocolVersion {
+		return errorEnvelope(req.ID, fmt.Errorf("unsupported version %d", req.Version))
+	}
+	reply := Envelope{
+		Version:      ProtocolVersion,
+		Type:         req.Type,
+		ID:           req.ID,
+		Subscription: req.Subscription,
+	}
+
+	var err error
+	switch req.Type {
+	case TypeSubscribe:
+		opts := ClientFilterOptions{}
+		if req.Filter != nil {
+			opts = *req.Filter
+		}
+		reply.Subscription, err = c.subscribe(req.Subscription, opts)
+		reply.Filter = &opts
+	case TypeUnsubscribe:
+		err = c.unsubscribe(req.Subscription)
+	case TypePause:
+		err = c.setPaused(req.Subscription, true)
+	case TypeResume:
+		err = c.setPaused(req.Subscription, false)
+	case TypePing:
+	case TypeStats:
+		stats := c.Stats()
+		reply.Stats = &stats
+	default:
+		err = fmt.Errorf("unknown request type %q", req.Type)
+	}
+	if err != nil {
+		return errorEnvelope(req.ID, err)
+	}
+	return reply
+}
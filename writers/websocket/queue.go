@@ -0,0 +1,116 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package websocket
+
+import (
+	"sync"
+
+	"coriolis-logger/config"
+)
+
+// messageQueue is a bounded queue of messages waiting to be sent to a
+// client. The hub pushes messages without ever blocking, and the client
+// pops them in batches once signaled on ready.
+type messageQueue struct {
+	mut    sync.Mutex
+	items  []LogMessage
+	head   int
+	count  int
+	policy config.OverflowPolicy
+
+	// dropped is the total number of messages dropped because the
+	// queue was full. notify is the number of dropped messages the
+	// client was not told about yet.
+	dropped int64
+	notify  int64
+
+	ready chan struct{}
+}
+
+func newMessageQueue(size int, policy config.OverflowPolicy) *messageQueue {
+	return &messageQueue{
+		items:  make([]LogMessage, size),
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+func (q *messageQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// push adds a message to the queue, applying the overflow policy if
+// the queue is full. It returns false if the client must be
+// disconnected.
+func (q *messageQueue) push(msg LogMessage) bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	if q.count == len(q.items) {
+		switch q.policy {
+		case config.OverflowDisconnect:
+			return false
+		case config.OverflowDropNotify:
+			q.dropped++
+			q.notify++
+			q.signal()
+			return true
+		default:
+			q.head = (q.head + 1) % len(q.items)
+			q.count--
+			q.dropped++
+		}
+	}
+	q.items[(q.head+q.count)%len(q.items)] = msg
+	q.count++
+	q.signal()
+	return true
+}
+
+// pop removes up to max messages from the queue. It also returns the
+// number of messages dropped since the last call, if the client must
+// be notified about them.
+func (q *messageQueue) pop(max int) ([]LogMessage, int64) {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	n := q.count
+	if n > max {
+		n = max
+	}
+	batch := make([]LogMessage, n)
+	for idx := range batch {
+		batch[idx] = q.items[q.head]
+		q.items[q.head] = LogMessage{}
+		q.head = (q.head + 1) % len(q.items)
+	}
+	q.count -= n
+	if q.count > 0 {
+		// Leave a signal for the rest of the queue.
+		q.signal()
+	}
+	notify := q.notify
+	q.notify = 0
+	return batch, notify
+}
+
+// Dropped returns the number of messages dropped because the queue
+// was full.
+func (q *messageQueue) Dropped() int64 {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	return q.dropped
+}
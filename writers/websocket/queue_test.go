@@ -0,0 +1,147 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package websocket
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"coriolis-logger/config"
+)
+
+func TestMessageQueue(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     config.OverflowPolicy
+		pushes     int
+		wantOK     bool
+		wantQueued []string
+		wantDrop   int64
+		wantNotify int64
+	}{
+		{
+			name:       "under capacity",
+			policy:     config.OverflowDropOldest,
+			pushes:     2,
+			wantOK:     true,
+			wantQueued: []string{"0", "1"},
+		},
+		{
+			name:       "drop oldest",
+			policy:     config.OverflowDropOldest,
+			pushes:     5,
+			wantOK:     true,
+			wantQueued: []string{"2", "3", "4"},
+			wantDrop:   2,
+		},
+		{
+			name:       "drop and notify",
+			policy:     config.OverflowDropNotify,
+			pushes:     5,
+			wantOK:     true,
+			wantQueued: []string{"0", "1", "2"},
+			wantDrop:   2,
+			wantNotify: 2,
+		},
+		{
+			name:       "disconnect",
+			policy:     config.OverflowDisconnect,
+			pushes:     4,
+			wantOK:     false,
+			wantQueued: []string{"0", "1", "2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newMessageQueue(3, tt.policy)
+			ok := true
+			for idx := 0; idx < tt.pushes; idx++ {
+				ok = q.push(LogMessage{Message: fmt.Sprint(idx)})
+			}
+			if ok != tt.wantOK {
+				t.Errorf("last push returned %v, want %v", ok, tt.wantOK)
+			}
+			if got := q.Dropped(); got != tt.wantDrop {
+				t.Errorf("dropped %d messages, want %d", got, tt.wantDrop)
+			}
+
+			batch, notify := q.pop(2)
+			rest, _ := q.pop(10)
+			batch = append(batch, rest...)
+			if notify != tt.wantNotify {
+				t.Errorf("got %d dropped to notify, want %d", notify, tt.wantNotify)
+			}
+			if len(batch) != len(tt.wantQueued) {
+				t.Fatalf("got %d queued messages, want %d", len(batch), len(tt.wantQueued))
+			}
+			for idx, msg := range batch {
+				if msg.Message != tt.wantQueued[idx] {
+					t.Errorf("message %d is %q, want %q", idx, msg.Message, tt.wantQueued[idx])
+				}
+			}
+			if _, notify := q.pop(10); notify != 0 {
+				t.Errorf("dropped messages were notified twice")
+			}
+		})
+	}
+}
+
+// TestMessageQueueConcurrent pushes and pops from different
+// goroutines, and checks that every message was either received, in
+// order, or counted as dropped.
+func TestMessageQueueConcurrent(t *testing.T) {
+	for _, policy := range []config.OverflowPolicy{config.OverflowDropOldest, config.OverflowDropNotify} {
+		t.Run(string(policy), func(t *testing.T) {
+			const total = 10000
+			q := newMessageQueue(16, policy)
+			wg := sync.WaitGroup{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for idx := 0; idx < total; idx++ {
+					q.push(LogMessage{Severity: idx})
+				}
+			}()
+
+			var received, notified int64
+			last := -1
+			for received+q.Dropped() < total {
+				<-q.ready
+				batch, notify := q.pop(4)
+				notified += notify
+				for _, msg := range batch {
+					if msg.Severity <= last {
+						t.Fatalf("got message %d after %d", msg.Severity, last)
+					}
+					last = msg.Severity
+				}
+				received += int64(len(batch))
+			}
+			wg.Wait()
+			// Pick up anything left behind by the last push.
+			batch, notify := q.pop(total)
+			received += int64(len(batch))
+			notified += notify
+
+			if received+q.Dropped() != total {
+				t.Errorf("received %d and dropped %d of %d messages", received, q.Dropped(), total)
+			}
+			if policy == config.OverflowDropNotify && notified != q.Dropped() {
+				t.Errorf("notified %d of %d dropped messages", notified, q.Dropped())
+			}
+		})
+	}
+}
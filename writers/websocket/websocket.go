@@ -19,12 +19,14 @@ import (
 	"fmt"
 	"time"
 
+	"coriolis-logger/config"
 	"coriolis-logger/logging"
 	"coriolis-logger/worker"
 )
 
-func NewHub(ctx context.Context) *Hub {
+func NewHub(ctx context.Context, cfg *config.Stream) *Hub {
 	return &Hub{
+		cfg:        cfg,
 		clients:    map[string]*Client{},
 		broadcast:  make(chan logging.LogMessage, 100),
 		register:   make(chan *Client, 100),
@@ -37,7 +39,13 @@ func NewHub(ctx context.Context) *Hub {
 
 var _ worker.SimpleWorker = (*Hub)(nil)
 
+// Hub fans out log messages to live stream clients. A single goroutine
+// owns the set of clients: it queues messages, and it is the only one
+// that removes and closes clients. Queueing never blocks, so a slow
+// client cannot hold up the others; the overflow policy decides what
+// happens once its queue is full.
 type Hub struct {
+	cfg    *config.Stream
 	ctx    context.Context
 	closed chan struct{}
 	quit   chan struct{}
@@ -54,53 +62,84 @@ type Hub struct {
 	unregister chan *Client
 }
 
+// remove unregisters a client and closes it. It must only be called
+// from the hub goroutine.
+func (h *Hub) remove(client *Client) {
+	if _, ok := h.clients[client.id]; !ok {
+		return
+	}
+	delete(h.clients, client.id)
+	client.close()
+}
+
+func (h *Hub) removeAll() {
+	for _, client := range h.clients {
+		h.remove(client)
+	}
+}
+
 func (h *Hub) run() {
+	defer close(h.closed)
 	for {
 		select {
 		case <-h.quit:
-			close(h.closed)
+			h.removeAll()
 			return
 		case <-h.ctx.Done():
-			close(h.closed)
+			h.removeAll()
 			return
 		case client := <-h.register:
-			if client != nil {
+			if client == nil {
+				continue
+			}
+			if _, ok := h.clients[client.id]; !ok {
 				h.clients[client.id] = client
+				close(client.registered)
 			}
 		case client := <-h.unregister:
 			if client != nil {
-				if _, ok := h.clients[client.id]; ok {
-					delete(h.clients, client.id)
-					close(client.send)
-				}
+				h.remove(client)
 			}
 		case message := <-h.broadcast:
-			for id, client := range h.clients {
-				if client == nil {
-					continue
-				}
-				if !client.ShouldSend(message) {
+			for _, client := range h.clients {
+				subscriptions, ok := client.match(message)
+				if !ok {
 					continue
 				}
 				msg := client.SyslogMessageToLogMessage(message)
-				go func(msg LogMessage) {
-					timer := time.NewTimer(time.Duration(5) * time.Second)
-					defer timer.Stop()
-
-					select {
-					case client.send <- msg:
-					case <-timer.C:
-						close(client.send)
-						delete(h.clients, id)
-					}
-				}(msg)
+				if client.versioned {
+					msg.Subscriptions = subscriptions
+				}
+				if !client.queue.push(msg) {
+					log.Warningf("client %s is too slow, disconnecting", client.id)
+					h.remove(client)
+				}
 			}
 		}
 	}
 }
 
+// Register adds a client to the hub. Messages written once it returns
+// are queued for the client.
 func (h *Hub) Register(client *Client) error {
-	h.register <- client
+	select {
+	case h.register <- client:
+	case <-h.closed:
+		return fmt.Errorf("hub is stopped")
+	}
+	select {
+	case <-client.registered:
+	case <-h.closed:
+		return fmt.Errorf("hub is stopped")
+	}
+	return nil
+}
+
+func (h *Hub) Unregister(client *Client) error {
+	select {
+	case h.unregister <- client:
+	case <-h.closed:
+	}
 	return nil
 }
 
@@ -111,6 +150,8 @@ func (h *Hub) Write(msg logging.LogMessage) error {
 	select {
 	case <-ticker.C:
 		return fmt.Errorf("timed out sending message to client")
+	case <-h.closed:
+		return fmt.Errorf("hub is stopped")
 	case h.broadcast <- msg:
 	}
 	return nil
@@ -0,0 +1,284 @@
+// Copyright 2019 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"coriolis-logger/config"
+	"coriolis-logger/logging"
+)
+
+// newTestHub starts a hub, which is stopped when the test ends.
+func newTestHub(t *testing.T, cfg *config.Stream) *Hub {
+	t.Helper()
+	hub := NewHub(context.Background(), cfg)
+	hub.Start()
+	t.Cleanup(func() { hub.Stop() })
+	return hub
+}
+
+// dialClient connects a websocket client to a server that registers
+// it with hub. setup, if not nil, is called before the client starts.
+func dialClient(t *testing.T, hub *Hub, subprotocols []string, setup func(*Client)) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{Subprotocols: []string{ProtocolV1}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			return
+		}
+		debug := logging.Debug
+		filter, _ := NewFilter(ClientFilterOptions{Severity: &debug})
+		client, _ := NewClient(conn, filter, hub)
+		if setup != nil {
+			setup(client)
+		}
+		hub.Register(client)
+		client.Go()
+	}))
+	t.Cleanup(server.Close)
+
+	dialer := websocket.Dialer{Subprotocols: subprotocols}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dialing websocket: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readFrame reads and decodes the next frame sent to conn.
+func readFrame(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatalf("reading frame: %v", err)
+	}
+	frame := map[string]interface{}{}
+	if err := json.Unmarshal(data, &frame); err != nil {
+		t.Fatalf("decoding frame %q: %v", data, err)
+	}
+	return frame
+}
+
+// expectNoFrame fails if a frame is sent to conn within a short
+// while. The connection can not be read from afterwards.
+func expectNoFrame(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, data, err := conn.ReadMessage(); err == nil {
+		t.Errorf("got unexpected frame %s", data)
+	}
+}
+
+func testMessage(text string) logging.LogMessage {
+	return logging.LogMessage{
+		AppName:   "app",
+		Hostname:  "host",
+		Severity:  logging.Informational,
+		Message:   text,
+		Timestamp: time.Now(),
+	}
+}
+
+func TestLegacyClientOnlyGetsLogs(t *testing.T) {
+	hub := newTestHub(t, &config.Stream{QueueSize: 2, OverflowPolicy: config.OverflowDropNotify})
+	conn := dialClient(t, hub, nil, func(client *Client) {
+		// Overflow the queue before the client starts sending.
+		for idx := 0; idx < 5; idx++ {
+			client.queue.push(client.SyslogMessageToLogMessage(testMessage("queued")))
+		}
+	})
+
+	// Filter changes, valid or not, are not answered.
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"omitempty": 9}`)); err != nil {
+		t.Fatalf("sending filter: %v", err)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"AppName": "app"}`)); err != nil {
+		t.Fatalf("sending filter: %v", err)
+	}
+
+	// Only the queued messages are sent, without a dropped notice.
+	for idx := 0; idx < 2; idx++ {
+		if frame := readFrame(t, conn); frame["message"] != "queued" {
+			t.Fatalf("got frame %v, want a queued message", frame)
+		}
+	}
+	if err := hub.Write(testMessage("live")); err != nil {
+		t.Fatalf("writing message: %v", err)
+	}
+	if frame := readFrame(t, conn); frame["message"] != "live" {
+		t.Fatalf("got frame %v, want the live message", frame)
+	}
+	expectNoFrame(t, conn)
+}
+
+func TestVersionedClientGetsDroppedNotice(t *testing.T) {
+	hub := newTestHub(t, &config.Stream{QueueSize: 2, OverflowPolicy: config.OverflowDropNotify})
+	conn := dialClient(t, hub, []string{ProtocolV1}, func(client *Client) {
+		for idx := 0; idx < 5; idx++ {
+			client.queue.push(client.SyslogMessageToLogMessage(testMessage("queued")))
+		}
+	})
+
+	if frame := readFrame(t, conn); frame["type"] != TypeDropped || frame["dropped"] != float64(3) {
+		t.Errorf("got %v, want a notice for 3 dropped messages", frame)
+	}
+	if frame := readFrame(t, conn); frame["type"] != TypeBatch {
+		t.Errorf("got %v, want a batch", frame)
+	}
+
+	if err := conn.WriteJSON(Envelope{Version: ProtocolVersion, Type: TypePing, ID: "1"}); err != nil {
+		t.Fatalf("sending ping: %v", err)
+	}
+	if frame := readFrame(t, conn); frame["type"] != TypePing || frame["id"] != "1" {
+		t.Errorf("got %v, want a ping reply", frame)
+	}
+	expectNoFrame(t, conn)
+}
+
+// slowConsumer reads from a stream client, pausing after each batch,
+// until the client is closed or stop is. It returns the number of
+// messages received and of dropped messages it was notified about.
+func slowConsumer(client *Client, stop <-chan struct{}) (int64, int64) {
+	var received, notified int64
+	for {
+		select {
+		case <-client.Ready():
+			batch, dropped := client.Receive()
+			received += int64(len(batch))
+			notified += dropped
+			time.Sleep(time.Millisecond)
+		case <-client.Done():
+			return received, notified
+		case <-stop:
+			// Collect anything queued since the last batch.
+			batch, dropped := client.Receive()
+			return received + int64(len(batch)), notified + dropped
+		}
+	}
+}
+
+func TestHubFloodWithSlowClients(t *testing.T) {
+	const (
+		clients   = 20
+		writers   = 4
+		perWriter = 2500
+		total     = writers * perWriter
+	)
+	for _, policy := range []config.OverflowPolicy{config.OverflowDropOldest, config.OverflowDropNotify, config.OverflowDisconnect} {
+		t.Run(string(policy), func(t *testing.T) {
+			hub := newTestHub(t, &config.Stream{QueueSize: 10, BatchSize: 5, OverflowPolicy: policy})
+			debug := logging.Debug
+			filter, err := NewFilter(ClientFilterOptions{Severity: &debug})
+			if err != nil {
+				t.Fatalf("creating filter: %v", err)
+			}
+
+			type result struct {
+				client             *Client
+				received, notified int64
+			}
+			results := make(chan result, clients)
+			stop := make(chan struct{})
+			registered := []*Client{}
+			for idx := 0; idx < clients; idx++ {
+				client := NewStreamClient(filter, hub)
+				registered = append(registered, client)
+				if err := hub.Register(client); err != nil {
+					t.Fatalf("registering client: %v", err)
+				}
+				go func() {
+					received, notified := slowConsumer(client, stop)
+					results <- result{client, received, notified}
+				}()
+			}
+
+			wg := sync.WaitGroup{}
+			for idx := 0; idx < writers; idx++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for count := 0; count < perWriter; count++ {
+						if err := hub.Write(testMessage("flood")); err != nil {
+							t.Errorf("writing message: %v", err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			// The hub may still be queueing the last messages, so give
+			// the clients time to account for all of them.
+			deadline := time.Now().Add(10 * time.Second)
+			for time.Now().Before(deadline) {
+				pending := false
+				for _, client := range registered {
+					select {
+					case <-client.Done():
+						continue
+					default:
+					}
+					if stats := client.Stats(); stats.Sent+stats.Dropped < total {
+						pending = true
+					}
+				}
+				if !pending {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			close(stop)
+
+			for idx := 0; idx < clients; idx++ {
+				res := <-results
+				stats := res.client.Stats()
+				select {
+				case <-res.client.Done():
+					if policy != config.OverflowDisconnect {
+						t.Errorf("client was disconnected with the %s policy", policy)
+					}
+					continue
+				default:
+				}
+				if policy == config.OverflowDisconnect {
+					t.Errorf("slow client was not disconnected")
+					continue
+				}
+				if res.received+stats.Dropped != total {
+					t.Errorf("client received %d and dropped %d of %d messages", res.received, stats.Dropped, total)
+				}
+				if stats.Dropped == 0 {
+					t.Errorf("slow client had no messages dropped")
+				}
+				if policy == config.OverflowDropNotify && res.notified != stats.Dropped {
+					t.Errorf("client was notified of %d of %d dropped messages", res.notified, stats.Dropped)
+				}
+			}
+		})
+	}
+}